@@ -0,0 +1,275 @@
+// Package auth stores the API keys used to access the manager
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Scope is a permission granted to an API key
+type Scope string
+
+const (
+	ScopeSubmit Scope = "jobs:submit" // Create new jobs
+	ScopeRead   Scope = "status:read" // Read job and worker statuses
+	ScopeAdmin  Scope = "admin"       // Manage keys, implies every other scope
+	ScopeWorker Scope = "worker"      // Register as a worker
+)
+
+// Scopes lists every valid scope
+var Scopes = []Scope{ScopeSubmit, ScopeRead, ScopeAdmin, ScopeWorker}
+
+// ErrNotFound is returned when a key doesn't exist
+var ErrNotFound = errors.New("key not found")
+
+type (
+	// Key is an API key. Only a hash of the secret is kept,
+	// the secret itself is given out once on creation.
+	Key struct {
+		ID      string    `json:"id"`
+		Name    string    `json:"name"`
+		Hash    string    `json:"hash,omitempty"` // SHA-256 of the secret
+		Scopes  []Scope   `json:"scopes"`
+		Quota   *Quota    `json:"quota,omitempty"` // Overrides the manager's default quota
+		Created time.Time `json:"created"`
+	}
+	// Quota limits how many jobs a key can submit, zero values are unlimited
+	Quota struct {
+		RatePerMinute float64 `json:"ratePerMinute"` // Sustained job submissions per minute
+		Burst         int     `json:"burst"`         // Submissions allowed at once above the rate
+		MaxConcurrent int     `json:"maxConcurrent"` // Jobs queued or being processed at once
+		MaxQueued     int     `json:"maxQueued"`     // Jobs waiting for a worker
+	}
+	// Store is a set of API keys persisted to a JSON file
+	Store struct {
+		mu        sync.RWMutex
+		path      string
+		keys      map[string]Key
+		bootstrap *Key
+	}
+)
+
+// Has returns whether the key has been granted a scope
+func (k Key) Has(scope Scope) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidScope returns whether a scope exists
+func ValidScope(scope Scope) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// NewStore opens the key store at path, creating it when the first key
+// is added. bootstrapSecret is an optional admin key which isn't
+// persisted, so the first keys can be made.
+func NewStore(path, bootstrapSecret string) (*Store, error) {
+	s := &Store{path: path, keys: make(map[string]Key)}
+	if bootstrapSecret != "" {
+		s.bootstrap = &Key{
+			ID:     "bootstrap",
+			Name:   "bootstrap",
+			Hash:   hash(bootstrapSecret),
+			Scopes: []Scope{ScopeAdmin},
+		}
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("failed to read key store: %w", err)
+	}
+	keys := []Key{}
+	err = json.Unmarshal(b, &keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal key store: %w", err)
+	}
+	for _, k := range keys {
+		s.keys[k.ID] = k
+	}
+	return s, nil
+}
+
+// Create makes a new key, returning it alongside its secret
+func (s *Store) Create(name string, scopes []Scope, quota *Quota) (Key, string, error) {
+	if len(scopes) == 0 {
+		return Key{}, "", errors.New("key needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if !ValidScope(scope) {
+			return Key{}, "", fmt.Errorf("invalid scope \"%s\"", scope)
+		}
+	}
+
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return Key{}, "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+	secret := "vt_" + base64.RawURLEncoding.EncodeToString(b)
+
+	k := Key{
+		ID:      uuid.NewString(),
+		Name:    name,
+		Hash:    hash(secret),
+		Scopes:  scopes,
+		Quota:   quota,
+		Created: time.Now(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[k.ID] = k
+	err = s.save()
+	if err != nil {
+		delete(s.keys, k.ID)
+		return Key{}, "", err
+	}
+	return k, secret, nil
+}
+
+// Get returns a key by its ID
+func (s *Store) Get(id string) (Key, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.keys[id]
+	return k, ok
+}
+
+// List returns every stored key, oldest first
+func (s *Store) List() []Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+	return keys
+}
+
+// SetQuota changes a key's quota, nil reverts to the default
+func (s *Store) SetQuota(id string, quota *Quota) (Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return Key{}, ErrNotFound
+	}
+	prev := k.Quota
+	k.Quota = quota
+	s.keys[id] = k
+	err := s.save()
+	if err != nil {
+		k.Quota = prev
+		s.keys[id] = k
+		return Key{}, err
+	}
+	return k, nil
+}
+
+// Delete revokes a key
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.keys, id)
+	err := s.save()
+	if err != nil {
+		s.keys[id] = k
+		return err
+	}
+	return nil
+}
+
+// Authenticate finds the key a secret belongs to
+func (s *Store) Authenticate(secret string) (Key, bool) {
+	if secret == "" {
+		return Key{}, false
+	}
+	h := []byte(hash(secret))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.bootstrap != nil && subtle.ConstantTimeCompare(h, []byte(s.bootstrap.Hash)) == 1 {
+		return *s.bootstrap, true
+	}
+	for _, k := range s.keys {
+		if subtle.ConstantTimeCompare(h, []byte(k.Hash)) == 1 {
+			return k, true
+		}
+	}
+	return Key{}, false
+}
+
+// save writes the keys to disk, replacing the old file
+// in one go so it can't be left half written
+func (s *Store) save() error {
+	keys := make([]Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	b, err := json.MarshalIndent(keys, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal keys: %w", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".keys-*")
+	if err != nil {
+		return fmt.Errorf("failed to create key store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write key store: %w", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write key store: %w", err)
+	}
+	err = os.Chmod(tmp.Name(), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to set key store permissions: %w", err)
+	}
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		return fmt.Errorf("failed to replace key store: %w", err)
+	}
+	return nil
+}
+
+func hash(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
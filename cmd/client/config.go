@@ -0,0 +1,383 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/uuid"
+	"github.com/ystv/video-transcode/task"
+)
+
+type (
+	// Config represents VT's configuration, loaded from config.toml
+	// with environment variables taking precedence
+	Config struct {
+		Name         string `toml:"name"`
+		IDFile       string `toml:"id_file"` // Where the worker's ID is kept
+		Concurrency  int    `toml:"concurrency"`
+		DrainTimeout int64  `toml:"drain_timeout"` // Seconds
+		MetricsAddr  string `toml:"metrics_addr"`
+		AMQPEndpoint string `toml:"-"`
+		APIEndpoint  string `toml:"api_endpoint"`
+
+		MQ       MQConfig       `toml:"mq"`
+		Manager  ManagerConfig  `toml:"manager"`
+		Tasks    TasksConfig    `toml:"tasks"`
+		FFmpeg   FFmpegConfig   `toml:"ffmpeg"`
+		Scratch  ScratchConfig  `toml:"scratch"`
+		Cache    CacheConfig    `toml:"cache"`
+		Storage  StorageConfig  `toml:"storage"`
+		Timeouts TimeoutsConfig `toml:"timeouts"`
+	}
+	MQConfig struct {
+		Host  string `toml:"host"`
+		User  string `toml:"user"`
+		Pass  string `toml:"pass"`
+		VHost string `toml:"vhost"`
+	}
+	ManagerConfig struct {
+		Host string `toml:"host"`
+	}
+	// TasksConfig picks which task types the worker takes
+	TasksConfig struct {
+		VideoSimple   bool `toml:"video_simple"`
+		VideoOnDemand bool `toml:"video_on_demand"`
+		VideoQuality  bool `toml:"video_quality"`
+		VideoClip     bool `toml:"video_clip"`
+		VideoConcat   bool `toml:"video_concat"`
+		VideoChunked  bool `toml:"video_chunked"` // Parts of chunked VOD jobs
+		Subtitles     bool `toml:"subtitles"`     // Every subtitle/* task
+		AudioExtract  bool `toml:"audio_extract"`
+		AudioWaveform bool `toml:"audio_waveform"`
+		ImageSimple   bool `toml:"image_simple"`
+	}
+	// TimeoutsConfig limits how long tasks can run for, in seconds
+	// with 0 being no limit
+	TimeoutsConfig struct {
+		VideoSimple   int64 `toml:"video_simple"`
+		VideoOnDemand int64 `toml:"video_on_demand"`
+		VideoQuality  int64 `toml:"video_quality"`
+		VideoClip     int64 `toml:"video_clip"`
+		VideoConcat   int64 `toml:"video_concat"`
+		Subtitles     int64 `toml:"subtitles"`
+		AudioExtract  int64 `toml:"audio_extract"`
+		AudioWaveform int64 `toml:"audio_waveform"`
+		Stall         int64 `toml:"stall"` // Without ffmpeg making progress
+		StallRetries  int64 `toml:"stall_retries"`
+	}
+	FFmpegConfig struct {
+		FFmpeg  string `toml:"ffmpeg"`
+		FFprobe string `toml:"ffprobe"`
+	}
+	ScratchConfig struct {
+		Dir     string `toml:"dir"`
+		MinFree int64  `toml:"min_free"` // GiB
+	}
+	CacheConfig struct {
+		Dir  string `toml:"dir"`
+		Size int64  `toml:"size"` // GiB
+	}
+	StorageConfig struct {
+		S3     S3Config     `toml:"s3"`
+		File   FileConfig   `toml:"file"`
+		WebDAV WebDAVConfig `toml:"webdav"`
+		SFTP   SFTPConfig   `toml:"sftp"`
+	}
+	S3Config struct {
+		Endpoint        string `toml:"endpoint"`
+		AccessKeyID     string `toml:"access_key_id"`
+		SecretAccessKey string `toml:"secret_access_key"`
+		PartSize        int64  `toml:"part_size"` // MiB
+		Concurrency     int    `toml:"concurrency"`
+	}
+	FileConfig struct {
+		Root string `toml:"root"`
+	}
+	WebDAVConfig struct {
+		User string `toml:"user"`
+		Pass string `toml:"pass"`
+	}
+	SFTPConfig struct {
+		User       string `toml:"user"`
+		Pass       string `toml:"pass"`
+		KeyFile    string `toml:"key_file"`
+		KnownHosts string `toml:"known_hosts"`
+	}
+)
+
+// defaultConfig is used for anything config.toml leaves out
+func defaultConfig() Config {
+	return Config{
+		IDFile:       ".worker-id",
+		Concurrency:  1,
+		DrainTimeout: 600,
+		FFmpeg: FFmpegConfig{
+			FFmpeg:  "ffmpeg",
+			FFprobe: "ffprobe",
+		},
+		Scratch: ScratchConfig{
+			Dir:     filepath.Join(os.TempDir(), "vt-scratch"),
+			MinFree: 1,
+		},
+		Cache: CacheConfig{
+			Dir:  filepath.Join(os.TempDir(), "vt-cache"),
+			Size: 10,
+		},
+		Timeouts: TimeoutsConfig{
+			Stall:        120,
+			StallRetries: 1,
+		},
+	}
+}
+
+// loadConfig reads the config file, a missing file is only an
+// error when it was asked for explicitly
+func loadConfig(path string, required bool) (Config, error) {
+	c := defaultConfig()
+	md, err := toml.DecodeFile(path, &c)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return c, nil
+		}
+		return c, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := []string{}
+		for _, k := range undecoded {
+			keys = append(keys, k.String())
+		}
+		return c, fmt.Errorf("unknown keys in %s: %s", path, strings.Join(keys, ", "))
+	}
+	return c, nil
+}
+
+// applyEnv overrides the config with any environment variables
+// which are set
+func (c *Config) applyEnv() error {
+	str := func(name string, dst *string) {
+		if v := os.Getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	errs := []string{}
+	num := func(name string, dst *int64) {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s isn't a number", name))
+				return
+			}
+			*dst = n
+		}
+	}
+
+	str("VT_WORKER_NAME", &c.Name)
+	str("VT_WORKER_ID_FILE", &c.IDFile)
+	concurrency := int64(c.Concurrency)
+	num("VT_CONCURRENCY", &concurrency)
+	c.Concurrency = int(concurrency)
+	num("VT_DRAIN_TIMEOUT", &c.DrainTimeout)
+	str("VT_METRICS_ADDR", &c.MetricsAddr)
+	str("VT_AMQP_ENDPOINT", &c.AMQPEndpoint)
+	str("VT_WAPI_ENDPOINT", &c.APIEndpoint)
+	str("VT_FFMPEG", &c.FFmpeg.FFmpeg)
+	str("VT_FFPROBE", &c.FFmpeg.FFprobe)
+	str("VT_SCRATCH_DIR", &c.Scratch.Dir)
+	num("VT_SCRATCH_MIN_FREE", &c.Scratch.MinFree)
+	str("VT_CACHE_DIR", &c.Cache.Dir)
+	num("VT_CACHE_SIZE", &c.Cache.Size)
+	num("VT_TIMEOUT_VIDEO_SIMPLE", &c.Timeouts.VideoSimple)
+	num("VT_TIMEOUT_VIDEO_ON_DEMAND", &c.Timeouts.VideoOnDemand)
+	num("VT_TIMEOUT_VIDEO_QUALITY", &c.Timeouts.VideoQuality)
+	num("VT_TIMEOUT_VIDEO_CLIP", &c.Timeouts.VideoClip)
+	num("VT_TIMEOUT_VIDEO_CONCAT", &c.Timeouts.VideoConcat)
+	num("VT_TIMEOUT_SUBTITLES", &c.Timeouts.Subtitles)
+	num("VT_TIMEOUT_AUDIO_EXTRACT", &c.Timeouts.AudioExtract)
+	num("VT_TIMEOUT_AUDIO_WAVEFORM", &c.Timeouts.AudioWaveform)
+	num("VT_STALL_TIMEOUT", &c.Timeouts.Stall)
+	num("VT_STALL_RETRIES", &c.Timeouts.StallRetries)
+
+	s := &c.Storage
+	str("VT_CDN_ENDPOINT", &s.S3.Endpoint)
+	str("VT_CDN_ACCESSKEYID", &s.S3.AccessKeyID)
+	str("VT_CDN_SECRETACCESSKEY", &s.S3.SecretAccessKey)
+	num("VT_UPLOAD_PART_SIZE", &s.S3.PartSize)
+	uploadConcurrency := int64(s.S3.Concurrency)
+	num("VT_UPLOAD_CONCURRENCY", &uploadConcurrency)
+	s.S3.Concurrency = int(uploadConcurrency)
+	str("VT_FILE_ROOT", &s.File.Root)
+	str("VT_WEBDAV_USER", &s.WebDAV.User)
+	str("VT_WEBDAV_PASS", &s.WebDAV.Pass)
+	str("VT_SFTP_USER", &s.SFTP.User)
+	str("VT_SFTP_PASS", &s.SFTP.Pass)
+	str("VT_SFTP_KEYFILE", &s.SFTP.KeyFile)
+	str("VT_SFTP_KNOWN_HOSTS", &s.SFTP.KnownHosts)
+
+	if c.AMQPEndpoint == "" && c.MQ.Host != "" {
+		u := url.URL{
+			Scheme: "amqp",
+			Host:   c.MQ.Host,
+			Path:   "/" + c.MQ.VHost,
+		}
+		if c.MQ.User != "" {
+			u.User = url.UserPassword(c.MQ.User, c.MQ.Pass)
+		}
+		c.AMQPEndpoint = u.String()
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// TasksEnabled returns the task types the worker should take
+func (c *Config) TasksEnabled() []string {
+	tasks := []string{}
+	if c.Tasks.VideoSimple {
+		tasks = append(tasks, task.TypeSimpleVideo)
+	}
+	if c.Tasks.VideoOnDemand {
+		tasks = append(tasks, task.TypeVOD)
+	}
+	if c.Tasks.VideoQuality {
+		tasks = append(tasks, task.TypeQuality)
+	}
+	if c.Tasks.VideoClip {
+		tasks = append(tasks, task.TypeClip)
+	}
+	if c.Tasks.VideoConcat {
+		tasks = append(tasks, task.TypeConcat)
+	}
+	if c.Tasks.VideoChunked {
+		tasks = append(tasks, task.TypeSplit, task.TypeSegment, task.TypeMux)
+	}
+	if c.Tasks.Subtitles {
+		tasks = append(tasks, task.TypeSubtitleConvert, task.TypeSubtitleExtract, task.TypeSubtitleMux)
+	}
+	if c.Tasks.AudioExtract {
+		tasks = append(tasks, task.TypeAudioExtract)
+	}
+	if c.Tasks.AudioWaveform {
+		tasks = append(tasks, task.TypeWaveform)
+	}
+	return tasks
+}
+
+// taskTimeouts returns the maximum runtime of each task type
+func (c *Config) taskTimeouts() map[string]time.Duration {
+	return map[string]time.Duration{
+		task.TypeSimpleVideo: time.Duration(c.Timeouts.VideoSimple) * time.Second,
+		task.TypeVOD:         time.Duration(c.Timeouts.VideoOnDemand) * time.Second,
+		task.TypeQuality:     time.Duration(c.Timeouts.VideoQuality) * time.Second,
+		task.TypeClip:        time.Duration(c.Timeouts.VideoClip) * time.Second,
+		task.TypeConcat:      time.Duration(c.Timeouts.VideoConcat) * time.Second,
+		// The parts of a chunked job are limited like a whole one
+		task.TypeSplit:   time.Duration(c.Timeouts.VideoOnDemand) * time.Second,
+		task.TypeSegment: time.Duration(c.Timeouts.VideoOnDemand) * time.Second,
+		task.TypeMux:     time.Duration(c.Timeouts.VideoOnDemand) * time.Second,
+
+		task.TypeSubtitleConvert: time.Duration(c.Timeouts.Subtitles) * time.Second,
+		task.TypeSubtitleExtract: time.Duration(c.Timeouts.Subtitles) * time.Second,
+		task.TypeSubtitleMux:     time.Duration(c.Timeouts.Subtitles) * time.Second,
+		task.TypeAudioExtract:    time.Duration(c.Timeouts.AudioExtract) * time.Second,
+		task.TypeWaveform:        time.Duration(c.Timeouts.AudioWaveform) * time.Second,
+	}
+}
+
+// validate checks the config is one the worker can run with,
+// describing everything wrong with it
+func (c *Config) validate() error {
+	errs := []string{}
+	if strings.TrimSpace(c.Name) == "" {
+		errs = append(errs, "name is required")
+	}
+	if c.AMQPEndpoint == "" {
+		errs = append(errs, "mq host is required")
+	}
+	if c.Tasks.ImageSimple {
+		errs = append(errs, "image_simple isn't supported by workers yet")
+	}
+	if len(c.TasksEnabled()) == 0 {
+		errs = append(errs, "no tasks are enabled")
+	}
+	if c.Concurrency < 1 {
+		errs = append(errs, "concurrency must be at least 1")
+	}
+	if c.DrainTimeout < 0 {
+		errs = append(errs, "drain_timeout can't be negative")
+	}
+	if _, err := exec.LookPath(c.FFmpeg.FFmpeg); err != nil {
+		errs = append(errs, fmt.Sprintf("ffmpeg binary \"%s\" not found", c.FFmpeg.FFmpeg))
+	}
+	if _, err := exec.LookPath(c.FFmpeg.FFprobe); err != nil {
+		errs = append(errs, fmt.Sprintf("ffprobe binary \"%s\" not found", c.FFmpeg.FFprobe))
+	}
+	if c.Scratch.Dir == "" {
+		errs = append(errs, "scratch dir is required")
+	}
+	if c.Scratch.MinFree < 0 {
+		errs = append(errs, "scratch min_free can't be negative")
+	}
+	if c.Cache.Dir == "" {
+		errs = append(errs, "cache dir is required")
+	}
+	if c.Cache.Size < 0 {
+		errs = append(errs, "cache size can't be negative")
+	}
+	if c.Timeouts.VideoSimple < 0 || c.Timeouts.VideoOnDemand < 0 || c.Timeouts.VideoQuality < 0 ||
+		c.Timeouts.VideoClip < 0 || c.Timeouts.VideoConcat < 0 || c.Timeouts.Subtitles < 0 ||
+		c.Timeouts.AudioExtract < 0 || c.Timeouts.AudioWaveform < 0 || c.Timeouts.Stall < 0 || c.Timeouts.StallRetries < 0 {
+		errs = append(errs, "timeouts can't be negative")
+	}
+	if c.Storage.S3.PartSize < 0 || c.Storage.S3.Concurrency < 0 {
+		errs = append(errs, "s3 part_size and concurrency can't be negative")
+	}
+	if c.Storage.SFTP.KeyFile != "" {
+		if _, err := os.Stat(c.Storage.SFTP.KeyFile); err != nil {
+			errs = append(errs, fmt.Sprintf("sftp key_file: %v", err))
+		}
+	}
+	if c.Storage.SFTP.KnownHosts != "" {
+		if _, err := os.Stat(c.Storage.SFTP.KnownHosts); err != nil {
+			errs = append(errs, fmt.Sprintf("sftp known_hosts: %v", err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// workerID returns the worker's ID, generating one the first time
+// the worker is run so it stays the same across restarts
+func (c *Config) workerID() (string, error) {
+	if id := os.Getenv("VT_WORKER_ID"); id != "" {
+		return id, nil
+	}
+	b, err := ioutil.ReadFile(c.IDFile)
+	if err == nil {
+		id := strings.TrimSpace(string(b))
+		if id != "" {
+			return id, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read worker id: %w", err)
+	}
+
+	id := fmt.Sprintf("%s-%s", strings.ReplaceAll(strings.TrimSpace(c.Name), " ", "-"), uuid.NewString())
+	err = ioutil.WriteFile(c.IDFile, []byte(id+"\n"), 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to save worker id: %w", err)
+	}
+	return id, nil
+}
@@ -5,7 +5,9 @@ import (
 	"log"
 	"os"
 	"os/exec"
-	"strings"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -18,38 +20,47 @@ import (
 	"github.com/ystv/video-transcode/worker"
 )
 
-// Config represents VT's configuration
-type Config struct {
-	AMQPEndpoint       string
-	CDNEndpoint        string
-	CDNAccessKeyID     string
-	CDNSecretAccessKey string
-	APIEndpoint        string
-}
-
-var conf Config
-
 func main() {
 	// Initialising config
 	godotenv.Load(".env.local")
 	godotenv.Load(".env")
-	conf.AMQPEndpoint = os.Getenv("VT_AMQP_ENDPOINT")
-	conf.CDNEndpoint = os.Getenv("VT_CDN_ENDPOINT")
-	conf.CDNAccessKeyID = os.Getenv("VT_CDN_ACCESSKEYID")
-	conf.CDNSecretAccessKey = os.Getenv("VT_CDN_SECRETACCESSKEY")
-	conf.APIEndpoint = os.Getenv("VT_WAPI_ENDPOINT")
+	// An explicitly given config has to exist
+	confPath := os.Getenv("VT_CONFIG")
+	required := confPath != ""
+	if !required {
+		confPath = "config.toml"
+	}
+	conf, err := loadConfig(confPath, required)
+	if err != nil {
+		log.Fatalf("failed to load config: %+v", err)
+	}
+	err = conf.applyEnv()
+	if err != nil {
+		log.Fatalf("invalid config: %+v", err)
+	}
+	err = conf.validate()
+	if err != nil {
+		log.Fatalf("invalid config: %+v", err)
+	}
+	workerID, err := conf.workerID()
+	if err != nil {
+		log.Fatalf("failed to get worker id: %+v", err)
+	}
 
-	// Confirm ffmpeg installation
-	output, err := exec.Command("ffmpeg", "-version").Output()
+	// Confirm ffmpeg installation and find out what it can do
+	caps, err := task.DetectCapabilities(conf.FFmpeg.FFmpeg)
 	if err != nil {
 		if errors.Is(err, exec.ErrNotFound) {
 			log.Fatalf("failed to find ffmpeg install")
 		}
-		log.Fatalf("failed to get ffmpeg version: %+v", err)
+		log.Fatalf("failed to detect ffmpeg capabilities: %+v", err)
 	}
-	ver := strings.Split(string(output), " ")
 	log.Println("video-transcode: v0.3.0")
-	log.Printf("ffmpeg: v%s", ver[2])
+	log.Printf("ffmpeg: v%s, %d encoders, %d decoders, %d filters",
+		caps.Version, len(caps.Encoders), len(caps.Decoders), len(caps.Filters))
+	if conf.Manager.Host != "" {
+		log.Printf("manager: %s", conf.Manager.Host)
+	}
 
 	conn, err := amqp.Dial(conf.AMQPEndpoint)
 	if err != nil {
@@ -57,31 +68,92 @@ func main() {
 	}
 	defer conn.Close()
 
-	cdn := NewCDN()
+	cache, err := task.NewCache(conf.Cache.Dir, conf.Cache.Size*1024*1024*1024)
+	if err != nil {
+		log.Fatalf("failed to open source cache: %+v", err)
+	}
+	workspaces, err := task.NewWorkspaces(conf.Scratch.Dir, conf.Scratch.MinFree*1024*1024*1024)
+	if err != nil {
+		log.Fatalf("failed to open scratch dir: %+v", err)
+	}
+	env := &task.Env{
+		Store:       NewStorage(conf.Storage),
+		Cache:       cache,
+		Workspaces:  workspaces,
+		APIEndpoint: conf.APIEndpoint,
+		FFmpeg:      conf.FFmpeg.FFmpeg,
+		FFprobe:     conf.FFmpeg.FFprobe,
+
+		Timeouts:     conf.taskTimeouts(),
+		StallTimeout: time.Duration(conf.Timeouts.Stall) * time.Second,
+		StallRetries: int(conf.Timeouts.StallRetries),
+	}
 	eventer, err := event.NewEventer(conn)
 	if err != nil {
 		log.Fatalf("failed to create new eventer: %+v", err)
 	}
 
 	wConf := worker.Config{
-		WorkerID:     "test-worker",
-		APIEndpoint:  conf.APIEndpoint,
-		TasksEnabled: []string{"video/simple", "video/vod"}}
+		WorkerID:     workerID,
+		TasksEnabled: conf.TasksEnabled(),
+		Concurrency:  conf.Concurrency,
+		DrainTimeout: time.Duration(conf.DrainTimeout) * time.Second,
+		MetricsAddr:  conf.MetricsAddr,
+		Capabilities: caps}
+
+	w := worker.New(wConf, eventer, task.New(env), env)
+
+	// Finish what we're doing before exiting, a second signal
+	// exits straight away leaving the broker to requeue our tasks
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-sigs
+		log.Printf("received %s", sig)
+		w.Drain()
+		sig = <-sigs
+		log.Fatalf("received %s while draining, exiting", sig)
+	}()
 
-	w := worker.New(wConf, eventer, task.New(cdn), cdn)
 	err = w.Run()
 	if err != nil {
 		log.Fatalf("failed to run worker: %+v", err)
 	}
 }
 
+// NewStorage registers a backend for each supported URL scheme
+func NewStorage(conf StorageConfig) *task.Storage {
+	store := task.NewStorage()
+	store.Register("s3", task.NewS3Backend(NewCDN(conf.S3), task.S3Options{
+		PartSize:    conf.S3.PartSize * 1024 * 1024,
+		Concurrency: conf.S3.Concurrency,
+	}))
+	store.Register("file", &task.FileBackend{Root: conf.File.Root})
+	web := &task.HTTPBackend{}
+	store.Register("http", web)
+	store.Register("https", web)
+	dav := &task.WebDAVBackend{
+		Username: conf.WebDAV.User,
+		Password: conf.WebDAV.Pass,
+	}
+	store.Register("webdav", dav)
+	store.Register("webdavs", dav)
+	store.Register("sftp", &task.SFTPBackend{
+		Username:       conf.SFTP.User,
+		Password:       conf.SFTP.Pass,
+		KeyFile:        conf.SFTP.KeyFile,
+		KnownHostsFile: conf.SFTP.KnownHosts,
+	})
+	return store
+}
+
 // NewCDN creates a connection to s3
-func NewCDN() *s3.S3 {
+func NewCDN(conf S3Config) *s3.S3 {
 	s3Config := &aws.Config{
 		Credentials: credentials.NewStaticCredentials(
-			conf.CDNAccessKeyID,
-			conf.CDNSecretAccessKey, ""),
-		Endpoint:         aws.String(conf.CDNEndpoint),
+			conf.AccessKeyID,
+			conf.SecretAccessKey, ""),
+		Endpoint:         aws.String(conf.Endpoint),
 		Region:           aws.String("ystv-wales-1"),
 		S3ForcePathStyle: aws.Bool(true),
 	}
@@ -4,21 +4,29 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	"github.com/streadway/amqp"
+	"github.com/ystv/video-transcode/auth"
 	"github.com/ystv/video-transcode/event"
 	"github.com/ystv/video-transcode/manager"
+	"github.com/ystv/video-transcode/task"
 )
 
 // Config represents VT's configuration
 type Config struct {
 	AMQPEndpoint string
-	HTTPUser     string
-	HTTPPass     string
 	HTTPPort     string
+	KeyStore     string
+	AdminKey     string
+	Quota        auth.Quota
 }
 
 var conf Config
@@ -28,12 +36,25 @@ func main() {
 	godotenv.Load(".env")
 	conf.AMQPEndpoint = os.Getenv("VT_AMQP_ENDPOINT")
 	conf.HTTPPort = os.Getenv("VT_HTTP_PORT")
-	conf.HTTPUser = os.Getenv("VT_HTTP_USER")
-	conf.HTTPPass = os.Getenv("VT_HTTP_PASS")
+	conf.KeyStore = os.Getenv("VT_KEY_STORE")
+	conf.AdminKey = os.Getenv("VT_ADMIN_KEY")
+	// Quotas are unlimited when left unset
+	conf.Quota.RatePerMinute, _ = strconv.ParseFloat(os.Getenv("VT_QUOTA_RATE"), 64)
+	conf.Quota.Burst, _ = strconv.Atoi(os.Getenv("VT_QUOTA_BURST"))
+	conf.Quota.MaxConcurrent, _ = strconv.Atoi(os.Getenv("VT_QUOTA_MAX_CONCURRENT"))
+	conf.Quota.MaxQueued, _ = strconv.Atoi(os.Getenv("VT_QUOTA_MAX_QUEUED"))
 
 	if conf.HTTPPort == "" {
 		conf.HTTPPort = "7071"
 	}
+	if conf.KeyStore == "" {
+		conf.KeyStore = "keys.json"
+	}
+
+	keys, err := auth.NewStore(conf.KeyStore, conf.AdminKey)
+	if err != nil {
+		log.Fatalf("failed to open key store: %+v", err)
+	}
 
 	conn, err := amqp.Dial(conf.AMQPEndpoint)
 	if err != nil {
@@ -45,7 +66,14 @@ func main() {
 		log.Fatalf("failed to start eventer: %+v", err)
 	}
 
-	m := manager.New(emitter, conf.HTTPUser, conf.HTTPPass)
+	m := manager.New(emitter, keys, conf.Quota, newStorage())
+
+	go func() {
+		err := m.ListenWorkerStatus()
+		if err != nil {
+			log.Fatalf("failed to listen to worker status: %+v", err)
+		}
+	}()
 
 	r := mux.NewRouter()
 	mount(r, "/", m.Router())
@@ -54,6 +82,38 @@ func main() {
 	log.Fatal(http.ListenAndServe(":"+conf.HTTPPort, r))
 }
 
+// newStorage registers a backend for each URL scheme workers upload
+// job logs to, with the same credentials as the workers
+func newStorage() *task.Storage {
+	store := task.NewStorage()
+	cdn := s3.New(session.New(&aws.Config{
+		Credentials: credentials.NewStaticCredentials(
+			os.Getenv("VT_CDN_ACCESSKEYID"),
+			os.Getenv("VT_CDN_SECRETACCESSKEY"), ""),
+		Endpoint:         aws.String(os.Getenv("VT_CDN_ENDPOINT")),
+		Region:           aws.String("ystv-wales-1"),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+	store.Register("s3", task.NewS3Backend(cdn, task.S3Options{}))
+	store.Register("file", &task.FileBackend{Root: os.Getenv("VT_FILE_ROOT")})
+	web := &task.HTTPBackend{}
+	store.Register("http", web)
+	store.Register("https", web)
+	dav := &task.WebDAVBackend{
+		Username: os.Getenv("VT_WEBDAV_USER"),
+		Password: os.Getenv("VT_WEBDAV_PASS"),
+	}
+	store.Register("webdav", dav)
+	store.Register("webdavs", dav)
+	store.Register("sftp", &task.SFTPBackend{
+		Username:       os.Getenv("VT_SFTP_USER"),
+		Password:       os.Getenv("VT_SFTP_PASS"),
+		KeyFile:        os.Getenv("VT_SFTP_KEYFILE"),
+		KnownHostsFile: os.Getenv("VT_SFTP_KNOWN_HOSTS"),
+	})
+	return store
+}
+
 // mount another mux router ontop of another
 func mount(r *mux.Router, path string, handler http.Handler) {
 	r.PathPrefix(path).Handler(
@@ -1,32 +1,120 @@
 package event
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 
 	"github.com/streadway/amqp"
 )
 
-func ListenToQueues(ch *amqp.Channel, queues []string) (<-chan amqp.Delivery, error) {
-	msgChan := make(<-chan amqp.Delivery)
-	for _, queue := range queues {
-		q, err := declareQueue(ch, queue)
-		if err != nil {
-			return nil, fmt.Errorf("failed to declare queue \"%s\"", queue)
+// Consumer consumes from a set of queues on one channel, queues
+// can be added while it's running
+type Consumer struct {
+	mu      sync.Mutex
+	ch      *amqp.Channel
+	queues  map[string]bool
+	stopped bool
+	msgChan chan amqp.Delivery
+	wg      sync.WaitGroup
+}
+
+// NewConsumer creates a consumer with at most prefetch messages
+// unacknowledged across all of its queues
+func NewConsumer(ch *amqp.Channel, prefetch int) (*Consumer, error) {
+	// RabbitMQ applies a non-global prefetch to each consumer, so
+	// it'd be per queue rather than shared across all of them
+	err := ch.Qos(prefetch, 0, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set Qos: %w", err)
+	}
+	return &Consumer{
+		ch:      ch,
+		queues:  make(map[string]bool),
+		msgChan: make(chan amqp.Delivery),
+	}, nil
+}
+
+// Deliveries returns the messages from every queue, it's closed
+// once the consumer has been stopped
+func (c *Consumer) Deliveries() <-chan amqp.Delivery {
+	return c.msgChan
+}
+
+// Listen starts consuming a queue, declaring it if it doesn't exist
+func (c *Consumer) Listen(queue string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return errors.New("consumer has stopped")
+	}
+	if c.queues[queue] {
+		return nil
+	}
+
+	q, err := declareQueue(c.ch, queue)
+	if err != nil {
+		return fmt.Errorf("failed to declare queue \"%s\"", queue)
+	}
+	deliveries, err := c.ch.Consume(
+		q.Name,             // queue
+		consumerTag(queue), // consumer
+		false,              // autoAck
+		false,              // exclusive
+		false,              // noLocal
+		false,              // noWait
+		nil,                // args
+	)
+	if err != nil {
+		return fmt.Errorf("Listen: failed to consume queue: %w", err)
+	}
+	c.queues[queue] = true
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		for d := range deliveries {
+			c.msgChan <- d
 		}
-		msgChan, err = ch.Consume(
-			q.Name, // queue
-			"",     // consumer
-			false,  // autoAck
-			false,  // exclusive
-			false,  // noLocal
-			false,  // noWait
-			nil,    // args
-		)
-		if err != nil {
-			return nil, fmt.Errorf("Listen: failed to consume queue: %w", err)
+	}()
+	log.Println("listening to: " + queue)
+	return nil
+}
+
+// Queues returns the queues being consumed
+func (c *Consumer) Queues() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	queues := make([]string, 0, len(c.queues))
+	for q := range c.queues {
+		queues = append(queues, q)
+	}
+	return queues
+}
+
+// Stop stops consuming from the queues, messages which have been
+// delivered can still be acknowledged. Deliveries is closed once the
+// messages already delivered have been read.
+func (c *Consumer) Stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return nil
+	}
+	c.stopped = true
+	var err error
+	for queue := range c.queues {
+		if cerr := c.ch.Cancel(consumerTag(queue), false); cerr != nil {
+			err = fmt.Errorf("failed to stop consuming \"%s\": %w", queue, cerr)
 		}
-		log.Println("listening to: " + queue)
 	}
-	return msgChan, nil
+	go func() {
+		c.wg.Wait()
+		close(c.msgChan)
+	}()
+	return err
+}
+
+func consumerTag(queue string) string {
+	return "vt-" + queue
 }
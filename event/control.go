@@ -0,0 +1,85 @@
+package event
+
+import (
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// controlExchange carries commands from the manager to workers,
+// routed by the worker's ID
+const controlExchange = "encode-control"
+
+func declareControlExchange(ch *amqp.Channel) error {
+	return ch.ExchangeDeclare(
+		controlExchange,     // name
+		amqp.ExchangeDirect, // type
+		true,                // durable
+		false,               // auto-deleted
+		false,               // internal
+		false,               // no-wait
+		nil,                 // arguments
+	)
+}
+
+// SendControl publishes a command to a worker
+func (e *Eventer) SendControl(workerID string, reqJSON []byte) error {
+	ch, err := e.conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open a channel: %w", err)
+	}
+	defer ch.Close()
+
+	err = ch.Publish(
+		controlExchange, // exchange
+		workerID,        // key
+		false,           // mandatory
+		false,           // immediate
+		amqp.Publishing{
+			ContentType: "application/json",
+			Body:        reqJSON,
+		})
+	if err != nil {
+		return fmt.Errorf("failed to send control message: %w", err)
+	}
+	return nil
+}
+
+// ListenControl consumes the commands sent to a worker
+func (e *Eventer) ListenControl(ch *amqp.Channel, workerID string) (<-chan amqp.Delivery, error) {
+	q, err := ch.QueueDeclare(
+		"",    // name
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to declare control queue: %w", err)
+	}
+	err = ch.QueueBind(
+		q.Name,          // queue name
+		workerID,        // routing key
+		controlExchange, // exchange
+		false,           // no-wait
+		nil,             // arguments
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind control queue: %w", err)
+	}
+
+	msgChan, err := ch.Consume(
+		q.Name, // queue
+		"",     // consumer
+		true,   // autoAck
+		true,   // exclusive
+		false,  // noLocal
+		false,  // noWait
+		nil,    // args
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume control queue: %w", err)
+	}
+	return msgChan, nil
+}
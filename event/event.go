@@ -22,6 +22,10 @@ func NewEventer(conn *amqp.Connection) (*Eventer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to declare encode exchange: %w", err)
 	}
+	err = declareControlExchange(ch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to declare encode-control exchange: %w", err)
+	}
 	p.statusQueueName, err = p.newPubSubExchange("encode-status")
 	if err != nil {
 		return nil, fmt.Errorf("failed to declare encode-status exchange: %w", err)
@@ -45,10 +49,6 @@ func declareQueue(ch *amqp.Channel, queueName string) (amqp.Queue, error) {
 	if err != nil {
 		return q, fmt.Errorf("failed to declare queue: %w", err)
 	}
-	err = ch.Qos(1, 0, false)
-	if err != nil {
-		return q, fmt.Errorf("failed to set Qos: %w", err)
-	}
 	return q, nil
 }
 
@@ -63,3 +63,17 @@ func declareExchange(ch *amqp.Channel) error {
 		nil,                // arguments
 	)
 }
+
+// QueueDepth returns the number of messages waiting in a queue
+func (e *Eventer) QueueDepth(queueName string) (int, error) {
+	ch, err := e.conn.Channel()
+	if err != nil {
+		return 0, fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer ch.Close()
+	q, err := ch.QueueInspect(queueName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to inspect queue: %w", err)
+	}
+	return q.Messages, nil
+}
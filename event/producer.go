@@ -8,8 +8,9 @@ import (
 	"github.com/ystv/video-transcode/task"
 )
 
-// Push (publish) a specified message to the AMQP exchange
-func (e *Eventer) Push(request task.Task, taskType string) error {
+// Push (publish) a specified message to the AMQP exchange, queued on
+// the task type's queue or the queue for the job's requirements
+func (e *Eventer) Push(request task.Task, queueName string) error {
 	reqJSON, err := json.Marshal(request)
 	if err != nil {
 		return fmt.Errorf("failed to marshal: %w", err)
@@ -20,7 +21,7 @@ func (e *Eventer) Push(request task.Task, taskType string) error {
 		return fmt.Errorf("failed to open channel: %w", err)
 	}
 	defer ch.Close()
-	q, err := declareQueue(ch, taskType)
+	q, err := declareQueue(ch, queueName)
 	if err != nil {
 		return fmt.Errorf("failed to declare queue: %w", err)
 	}
@@ -34,24 +34,48 @@ func (e *Eventer) newPubSubExchange(exchangeName string) (string, error) {
 		false, // no-wait
 		nil,   // arguments
 	)
+	if err != nil {
+		return "", fmt.Errorf("failed to declare queue: %w", err)
+	}
 
 	return q.Name, nil
 }
 
-func (e *Eventer) SendStatus(exchangeName string, reqJSON []byte) error {
-	ch, err := e.conn.Channel()
-	if err != nil {
-		return fmt.Errorf("failed to open a channel: %w", err)
-	}
-	defer ch.Close()
-
-	err = ch.QueueBind(
+// ListenStatus binds the eventer's status queue to the encode-status
+// exchange and consumes the worker status snapshots published to it
+func (e *Eventer) ListenStatus(ch *amqp.Channel) (<-chan amqp.Delivery, error) {
+	err := ch.QueueBind(
 		e.statusQueueName, // queue name
 		"",                // routing key
 		"encode-status",   // exchange
 		false,             // no-wait
 		nil,               // arguments
 	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind status queue: %w", err)
+	}
+
+	msgChan, err := ch.Consume(
+		e.statusQueueName, // queue
+		"",                // consumer
+		true,              // autoAck
+		true,              // exclusive
+		false,             // noLocal
+		false,             // noWait
+		nil,               // args
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume status queue: %w", err)
+	}
+	return msgChan, nil
+}
+
+func (e *Eventer) SendStatus(exchangeName string, reqJSON []byte) error {
+	ch, err := e.conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open a channel: %w", err)
+	}
+	defer ch.Close()
 
 	err = ch.Publish(
 		exchangeName, // exchange
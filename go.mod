@@ -3,10 +3,15 @@ module github.com/ystv/video-transcode
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/aws/aws-sdk-go v1.40.12
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.4.2
 	github.com/joho/godotenv v1.3.0
+	github.com/pkg/sftp v1.13.4
+	github.com/prometheus/client_golang v1.11.1
 	github.com/streadway/amqp v1.0.0
+	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b
+	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac
 )
@@ -0,0 +1,375 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ystv/video-transcode/state"
+	"github.com/ystv/video-transcode/task"
+)
+
+type (
+	// chunker tracks the chunked VOD jobs being run, each goes through
+	// a split task, a segment task per part of the source and a mux task
+	chunker struct {
+		mu       sync.Mutex
+		jobs     map[string]*chunkedJob
+		children map[string]string // Task ID to the job it's part of
+		// Segment tasks still running when their job ended, to where
+		// they upload, so their segment can be removed once they finish
+		orphans map[string]string
+	}
+	// chunkedJob is a chunked VOD job's progress
+	chunkedJob struct {
+		vod      task.VOD
+		segments []task.Span
+		urls     []string // Where each segment is uploaded to
+		// Segment tasks which haven't finished, to where they upload
+		pending map[string]string
+		encoded int
+	}
+)
+
+func newChunker() *chunker {
+	return &chunker{
+		jobs:     make(map[string]*chunkedJob),
+		children: make(map[string]string),
+		orphans:  make(map[string]string),
+	}
+}
+
+// submitChunked starts a chunked VOD job by splitting its source,
+// the rest of it is run as the split task's children finish
+func (m *Manager) submitChunked(w http.ResponseWriter, r *http.Request, t *task.VOD) {
+	// Checked now so the client hears about it rather than
+	// the job failing once it's split
+	_, err := m.routeJob(task.TypeSegment, t.Requires)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	release, ok := m.admitJob(w, r)
+	if !ok {
+		return
+	}
+
+	jobsSubmitted.WithLabelValues(t.GetType()).Inc()
+	m.state.SetJob(state.FullStatusIndicator{
+		JobID:       t.GetID(),
+		Type:        t.GetType(),
+		ClientID:    clientID(r),
+		FailureMode: "IN-PROGRESS",
+		Summary:     "Starting",
+		Detail:      "Chunked VOD Job Sent to Processing",
+		Time:        time.Now(),
+		Submitted:   time.Now(),
+	})
+	release(true)
+
+	m.chunks.mu.Lock()
+	defer m.chunks.mu.Unlock()
+	m.chunks.jobs[t.GetID()] = &chunkedJob{vod: *t, pending: make(map[string]string)}
+	split := task.Split{
+		SrcURL:   t.SrcURL,
+		Options:  *t.Chunked,
+		Download: t.Download,
+		LogURL:   t.DstURL + ".chunks/split.log",
+	}
+	err = split.ValidateRequest()
+	if err == nil {
+		err = m.dispatchChild(t.GetID(), &split, nil)
+	}
+	if err != nil {
+		m.failChunked(t.GetID(), task.AsError(err), nil, "")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	m.writeSubmitted(w, t.GetID())
+}
+
+// dispatchChild queues a task which is part of a chunked job, must hold
+// the chunker's lock
+func (m *Manager) dispatchChild(parentID string, t task.Task, requires []string) error {
+	queue, err := m.routeJob(t.GetType(), requires)
+	if err != nil {
+		return err
+	}
+	m.chunks.children[t.GetID()] = parentID
+	// Recorded first so its statuses are applied once it's picked up
+	m.state.SetJob(state.FullStatusIndicator{
+		JobID:       t.GetID(),
+		Type:        t.GetType(),
+		ParentID:    parentID,
+		FailureMode: "IN-PROGRESS",
+		Summary:     "Starting",
+		Detail:      fmt.Sprintf("Part of chunked job %s", parentID),
+		Time:        time.Now(),
+		Submitted:   time.Now(),
+	})
+	err = m.mq.Push(t, queue)
+	if err != nil {
+		return fmt.Errorf("failed to push %s: %w", t.GetType(), err)
+	}
+	jobsSubmitted.WithLabelValues(t.GetType()).Inc()
+	return nil
+}
+
+// childUpdated moves a chunked job on when one of its tasks
+// has changed, the child's status has already been recorded
+func (m *Manager) childUpdated(child state.FullStatusIndicator) {
+	m.chunks.mu.Lock()
+	defer m.chunks.mu.Unlock()
+	if segURL, ok := m.chunks.orphans[child.JobID]; ok {
+		if child.Done() {
+			delete(m.chunks.orphans, child.JobID)
+			m.deleteObjects([]string{segURL})
+		}
+		return
+	}
+	parentID, ok := m.chunks.children[child.JobID]
+	if !ok {
+		return
+	}
+	job, ok := m.chunks.jobs[parentID]
+	if !ok {
+		return
+	}
+
+	if child.Done() {
+		delete(m.chunks.children, child.JobID)
+		delete(job.pending, child.JobID)
+	}
+	if child.Failure() {
+		m.failChunked(parentID, child.Error, child.LogTail, child.Log)
+		return
+	}
+	if !child.Done() {
+		m.setChunkedProgress(parentID, job, child)
+		return
+	}
+
+	var err error
+	switch child.Type {
+	case task.TypeSplit:
+		err = m.dispatchSegments(parentID, job, child.Result)
+	case task.TypeSegment:
+		job.encoded++
+		if job.encoded == len(job.segments) {
+			err = m.dispatchMux(parentID, job)
+		}
+	case task.TypeMux:
+		m.completeChunked(parentID, job, child)
+		return
+	}
+	if err != nil {
+		m.failChunked(parentID, task.AsError(err), nil, "")
+		return
+	}
+	m.setChunkedProgress(parentID, job, child)
+}
+
+// dispatchSegments queues a segment task for each part of the
+// source the split task found
+func (m *Manager) dispatchSegments(parentID string, job *chunkedJob, result *task.Result) error {
+	if result == nil || len(result.Segments) == 0 {
+		return fmt.Errorf("split found no segments")
+	}
+	job.segments = result.Segments
+	for i, span := range job.segments {
+		// Intermediate segments go next to the encode until they're muxed
+		seg := task.Segment{
+			ParentID: parentID,
+			Index:    i,
+			SrcURL:   job.vod.SrcURL,
+			Span:     span,
+			DstArgs:  job.vod.DstArgs,
+			DstURL:   job.vod.DstURL + fmt.Sprintf(".chunks/%04d.mkv", i),
+			Download: job.vod.Download,
+			Requires: job.vod.Requires,
+			Timeout:  job.vod.Timeout,
+		}
+		err := seg.ValidateRequest()
+		if err != nil {
+			return err
+		}
+		job.urls = append(job.urls, seg.DstURL)
+		err = m.dispatchChild(parentID, &seg, seg.Requires)
+		if err != nil {
+			return err
+		}
+		job.pending[seg.GetID()] = seg.DstURL
+	}
+	log.Printf("chunked job %s split into %d segments", parentID, len(job.segments))
+	return nil
+}
+
+// dispatchMux queues the task joining a job's encoded segments
+func (m *Manager) dispatchMux(parentID string, job *chunkedJob) error {
+	mux := task.Mux{
+		ParentID:    parentID,
+		SrcURL:      job.vod.SrcURL,
+		SegmentURLs: job.urls,
+		AudioArgs:   job.vod.Chunked.AudioArgs,
+		DstURL:      job.vod.DstURL,
+		Download:    job.vod.Download,
+		Verify:      job.vod.Verify,
+		Timeout:     job.vod.Timeout,
+	}
+	err := mux.ValidateRequest()
+	if err != nil {
+		return err
+	}
+	return m.dispatchChild(parentID, &mux, nil)
+}
+
+// setChunkedProgress reports how far through a chunked job is,
+// must hold the chunker's lock
+func (m *Manager) setChunkedProgress(parentID string, job *chunkedJob, child state.FullStatusIndicator) {
+	fsi, ok := m.chunkedStatus(parentID)
+	if !ok {
+		return
+	}
+	switch {
+	case len(job.segments) == 0:
+		fsi.Summary = "Splitting"
+		fsi.Detail = "Finding where to split the source"
+	case job.encoded < len(job.segments):
+		fsi.Summary = "Encoding segments"
+		fsi.Detail = fmt.Sprintf("%d of %d segments encoded", job.encoded, len(job.segments))
+	default:
+		fsi.Summary = "Muxing"
+		fsi.Detail = "Joining the segments"
+	}
+	fsi.Stage = child.Stage
+	stats := task.Stats{}
+	if len(job.segments) > 0 {
+		stats.Percentage = job.encoded * 100 / (len(job.segments) + 1)
+	}
+	fsi.Stats = &stats
+	fsi.Time = time.Now()
+	m.state.SetJob(fsi)
+	m.events.publish(fsi)
+}
+
+// completeChunked finishes a chunked job with what its mux task produced
+func (m *Manager) completeChunked(parentID string, job *chunkedJob, mux state.FullStatusIndicator) {
+	delete(m.chunks.jobs, parentID)
+	fsi, ok := m.chunkedStatus(parentID)
+	if !ok {
+		return
+	}
+	fsi.FailureMode = "COMPLETED-OK"
+	fsi.Summary = "Completed"
+	fsi.Detail = fmt.Sprintf("Job completed in %d segments", len(job.segments))
+	fsi.Stage = task.StageCompleted
+	fsi.Stats = mux.Stats
+	fsi.Result = mux.Result
+	fsi.Log = mux.Log
+	if fsi.Result != nil {
+		fsi.Result.Segments = job.segments
+	}
+	fsi.Time = time.Now()
+	m.endChunked(fsi)
+
+	// The segments are in the encode now, so only it and its log are kept
+	urls := []string{job.vod.DstURL + ".chunks/split.log"}
+	for _, u := range job.urls {
+		urls = append(urls, u, u+".log")
+	}
+	m.deleteObjects(urls)
+}
+
+// failChunked fails a chunked job with the log of the task which failed,
+// tasks of it which are still queued or running are left to finish, must
+// hold the chunker's lock
+func (m *Manager) failChunked(parentID string, err *task.Error, logTail []string, logURL string) {
+	job, ok := m.chunks.jobs[parentID]
+	if ok {
+		// Segments are removed, segments still being encoded once they've
+		// finished, but the logs are kept to find out what went wrong
+		running := make(map[string]bool)
+		for id, u := range job.pending {
+			m.chunks.orphans[id] = u
+			running[u] = true
+		}
+		finished := []string{}
+		for _, u := range job.urls {
+			if !running[u] {
+				finished = append(finished, u)
+			}
+		}
+		m.deleteObjects(finished)
+	}
+	delete(m.chunks.jobs, parentID)
+	fsi, ok := m.chunkedStatus(parentID)
+	if !ok {
+		return
+	}
+	fsi.FailureMode = "FAILED"
+	fsi.Summary = "Failed"
+	fsi.Detail = "Chunked job failed"
+	if err != nil {
+		fsi.Detail += ": " + err.Message
+	}
+	fsi.Stage = task.StageFailed
+	fsi.Error = err
+	fsi.LogTail = logTail
+	fsi.Log = logURL
+	fsi.Time = time.Now()
+	m.endChunked(fsi)
+}
+
+// chunkedStatus returns a chunked job's status, unless it's finished
+func (m *Manager) chunkedStatus(parentID string) (state.FullStatusIndicator, bool) {
+	js, ok := m.state.GetJob(parentID)
+	if !ok || js.Done() {
+		return state.FullStatusIndicator{}, false
+	}
+	fsi, ok := js.(state.FullStatusIndicator)
+	return fsi, ok
+}
+
+// endChunked records a chunked job finishing, forgetting
+// about any of its tasks which haven't
+func (m *Manager) endChunked(fsi state.FullStatusIndicator) {
+	for id, parentID := range m.chunks.children {
+		if parentID == fsi.JobID {
+			delete(m.chunks.children, id)
+		}
+	}
+	m.state.SetJob(fsi)
+	m.events.publish(fsi)
+	observeJobEnd(fsi)
+	m.quotas.jobEnded(fsi)
+}
+
+// deleteObjects removes a chunked job's intermediate objects in
+// the background, failures are only logged
+func (m *Manager) deleteObjects(urls []string) {
+	if len(urls) == 0 {
+		return
+	}
+	if m.store == nil {
+		log.Printf("no storage to delete %d chunked job objects from", len(urls))
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		for _, objURL := range urls {
+			b, u, err := m.store.Resolve(objURL)
+			if err == nil {
+				err = b.Delete(ctx, u)
+			}
+			if err != nil {
+				log.Printf("failed to delete \"%s\": %+v", objURL, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,252 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ystv/video-transcode/state"
+)
+
+type (
+	// jobHub fans out job status changes to anyone watching them
+	jobHub struct {
+		mu   sync.Mutex
+		subs map[string]map[*subscriber]struct{}
+	}
+	// subscriber holds the latest unsent status of each job it
+	// watches, so a slow client only ever misses intermediate updates
+	subscriber struct {
+		mu      sync.Mutex
+		pending map[string]state.JobStatus
+		order   []string
+		notify  chan struct{}
+	}
+	// jobSubscription is sent by websocket clients to choose
+	// which jobs they receive updates for
+	jobSubscription struct {
+		Action string   `json:"action"` // "subscribe" or "unsubscribe"
+		JobIDs []string `json:"jobIDs"`
+	}
+)
+
+// sseKeepAlive is how often an idle event stream is sent a comment
+// so proxies don't close it
+const sseKeepAlive = 15 * time.Second
+
+func newJobHub() *jobHub {
+	return &jobHub{subs: make(map[string]map[*subscriber]struct{})}
+}
+
+func newSubscriber() *subscriber {
+	return &subscriber{
+		pending: make(map[string]state.JobStatus),
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// push queues a job status, replacing any older unsent one
+func (s *subscriber) push(js state.JobStatus) {
+	s.mu.Lock()
+	if _, ok := s.pending[js.GetUUID()]; !ok {
+		s.order = append(s.order, js.GetUUID())
+	}
+	s.pending[js.GetUUID()] = js
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the queued job statuses in the order they arrived
+func (s *subscriber) take() []state.JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]state.JobStatus, 0, len(s.order))
+	for _, id := range s.order {
+		statuses = append(statuses, s.pending[id])
+	}
+	s.pending = make(map[string]state.JobStatus)
+	s.order = nil
+	return statuses
+}
+
+func (h *jobHub) subscribe(jobID string, s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[jobID]; !ok {
+		h.subs[jobID] = make(map[*subscriber]struct{})
+	}
+	h.subs[jobID][s] = struct{}{}
+}
+
+func (h *jobHub) unsubscribe(jobID string, s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs[jobID], s)
+	if len(h.subs[jobID]) == 0 {
+		delete(h.subs, jobID)
+	}
+}
+
+// publish sends a job's status to all of its subscribers
+func (h *jobHub) publish(js state.JobStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs[js.GetUUID()] {
+		s.push(js)
+	}
+}
+
+// jobEventsHandle streams a job's status changes as Server-Sent Events,
+// ending the stream once the job has finished
+func (m *Manager) jobEventsHandle(w http.ResponseWriter, r *http.Request) {
+	uuid := mux.Vars(r)["uuid"]
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := newSubscriber()
+	m.events.subscribe(uuid, sub)
+	defer m.events.unsubscribe(uuid, sub)
+
+	// Subscribing before getting the current state so we can't miss
+	// an update which happens in between
+	jobState, ok := m.state.GetJob(uuid)
+	if !ok {
+		http.Error(w,
+			fmt.Sprintf("Job with UUID %s not found", uuid),
+			http.StatusNotFound)
+		return
+	}
+	sub.push(jobState)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-sub.notify:
+			for _, js := range sub.take() {
+				rtn, err := json.Marshal(js)
+				if err != nil {
+					log.Printf("failed to marshal job status: %+v", err)
+					return
+				}
+				fmt.Fprintf(w, "event: status\ndata: %s\n\n", rtn)
+				flusher.Flush()
+				if js.Done() {
+					return
+				}
+			}
+		}
+	}
+}
+
+// jobsWSHandle upgrades to a websocket which clients can subscribe to
+// updates for multiple jobs on. Clients are unsubscribed from a job
+// after it's finished.
+func (m *Manager) jobsWSHandle(w http.ResponseWriter, r *http.Request) {
+	conn, err := Upgrade(w, r)
+	if err != nil {
+		fmt.Fprintf(w, "%+v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	sub := newSubscriber()
+	subscribed := make(map[string]struct{})
+	mu := sync.Mutex{}
+	defer func() {
+		mu.Lock()
+		for jobID := range subscribed {
+			m.events.unsubscribe(jobID, sub)
+		}
+		mu.Unlock()
+	}()
+
+	// Reading subscription changes
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			var req jobSubscription
+			err := conn.ReadJSON(&req)
+			if err != nil {
+				return
+			}
+			for _, jobID := range req.JobIDs {
+				switch req.Action {
+				case "subscribe":
+					mu.Lock()
+					subscribed[jobID] = struct{}{}
+					mu.Unlock()
+					m.events.subscribe(jobID, sub)
+					// Subscribing before getting the current state so we
+					// can't miss an update which happens in between
+					jobState, ok := m.state.GetJob(jobID)
+					if !ok {
+						mu.Lock()
+						delete(subscribed, jobID)
+						mu.Unlock()
+						m.events.unsubscribe(jobID, sub)
+						continue
+					}
+					sub.push(jobState)
+				case "unsubscribe":
+					mu.Lock()
+					delete(subscribed, jobID)
+					mu.Unlock()
+					m.events.unsubscribe(jobID, sub)
+				}
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-sub.notify:
+			for _, js := range sub.take() {
+				mu.Lock()
+				_, ok := subscribed[js.GetUUID()]
+				if ok && js.Done() {
+					delete(subscribed, js.GetUUID())
+				}
+				mu.Unlock()
+				if !ok {
+					continue
+				}
+				if js.Done() {
+					m.events.unsubscribe(js.GetUUID(), sub)
+				}
+				err := conn.WriteJSON(js)
+				if err != nil {
+					log.Printf("failed to write job status: %+v", err)
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ystv/video-transcode/state"
+	"github.com/ystv/video-transcode/task"
+	"github.com/ystv/video-transcode/worker"
+)
+
+// ListenWorkerStatus consumes the status snapshots workers publish to the
+// encode-status exchange and records them in the state handler. Workers
+// which stop sending them are marked offline by the state's tidier.
+func (m *Manager) ListenWorkerStatus() error {
+	ch, err := m.mq.GetChannel()
+	if err != nil {
+		return fmt.Errorf("failed to get channel: %w", err)
+	}
+	defer ch.Close()
+
+	msgChan, err := m.mq.ListenStatus(ch)
+	if err != nil {
+		return fmt.Errorf("failed to listen to worker status: %w", err)
+	}
+
+	for d := range msgChan {
+		var status worker.Status
+		err := json.Unmarshal(d.Body, &status)
+		if err != nil {
+			log.Printf("failed to unmarshal worker status: %+v", err)
+			continue
+		}
+		if status.WorkerID == "" {
+			log.Println("ignoring worker status without a worker ID")
+			continue
+		}
+		m.state.Heartbeat(status.WorkerID, state.WorkerStatus{
+			State:        status.State,
+			TasksEnabled: status.TasksEnabled,
+			Queues:       status.Queues,
+			CurrentTasks: status.CurrentTasks,
+			Capabilities: status.Capabilities,
+		})
+		for _, t := range status.CurrentTasks {
+			m.updateJob(status.WorkerID, t)
+		}
+		for _, t := range status.FinishedTasks {
+			m.updateJob(status.WorkerID, t)
+		}
+		if status.State == worker.StateEnd {
+			m.workerEnded(status.WorkerID)
+		} else {
+			m.syncWorkerQueues(status.WorkerID)
+		}
+	}
+	return errors.New("worker status channel closed")
+}
+
+// updateJob applies a task status reported by a worker to its job,
+// notifying anyone watching the job if it has changed
+func (m *Manager) updateJob(workerID string, t task.Status) {
+	if t.TaskID == "" {
+		return
+	}
+
+	fsi := state.FullStatusIndicator{JobID: t.TaskID}
+	js, ok := m.state.GetJob(t.TaskID)
+	if ok {
+		if js.Done() {
+			// Late heartbeats shouldn't resurrect a finished job
+			return
+		}
+		if prev, ok := js.(state.FullStatusIndicator); ok {
+			fsi = prev
+		}
+	}
+	if ok && fsi.Stage == t.Stage && fsi.Stats != nil && *fsi.Stats == t.Stats {
+		return
+	}
+
+	stats := t.Stats
+	fsi.WorkerID = workerID
+	fsi.Stage = t.Stage
+	fsi.Stats = &stats
+	if t.Result != nil {
+		fsi.Result = t.Result
+	}
+	if t.Log != "" {
+		fsi.Log = t.Log
+	}
+	if len(t.LogTail) > 0 {
+		fsi.LogTail = t.LogTail
+	}
+	fsi.Time = time.Now()
+	switch t.Stage {
+	case task.StageCompleted:
+		fsi.FailureMode = "COMPLETED-OK"
+		fsi.Summary = "Completed"
+		fsi.Detail = fmt.Sprintf("Job completed on worker %s", workerID)
+	case task.StageFailed:
+		fsi.FailureMode = "FAILED"
+		fsi.Summary = "Failed"
+		fsi.Detail = fmt.Sprintf("Job failed on worker %s", workerID)
+		if t.Error != nil {
+			fsi.Detail += ": " + t.Error.Message
+			fsi.Error = t.Error
+		}
+	default:
+		fsi.FailureMode = "IN-PROGRESS"
+		fsi.Summary = stageSummary(t.Stage)
+		fsi.Detail = fmt.Sprintf("Job %s on worker %s", t.Stage, workerID)
+	}
+
+	m.state.SetJob(fsi)
+	m.events.publish(fsi)
+	if fsi.Done() {
+		observeJobEnd(fsi)
+		m.quotas.jobEnded(fsi)
+	}
+	if fsi.ParentID != "" {
+		m.childUpdated(fsi)
+	}
+}
+
+// workerEnded forgets about a worker which has shut down, any jobs it
+// didn't finish were requeued so they're waiting for a worker again
+func (m *Manager) workerEnded(workerID string) {
+	log.Printf("worker %s has stopped", workerID)
+	m.state.RemoveWorker(workerID)
+	for _, fsi := range m.state.RequeueWorkerJobs(workerID) {
+		m.events.publish(fsi)
+	}
+}
+
+// stageSummary turns a task stage into a job summary
+func stageSummary(stage string) string {
+	if stage == "" {
+		return "Starting"
+	}
+	return strings.ToUpper(stage[:1]) + stage[1:]
+}
@@ -0,0 +1,105 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/ystv/video-transcode/auth"
+)
+
+type (
+	// newKeyRequest is the body to create an API key
+	newKeyRequest struct {
+		Name   string       `json:"name"`
+		Scopes []auth.Scope `json:"scopes"`
+		Quota  *auth.Quota  `json:"quota"`
+	}
+	// newKeyResponse is the only time a key's secret is returned
+	newKeyResponse struct {
+		Key    auth.Key `json:"key"`
+		Secret string   `json:"secret"`
+	}
+)
+
+func (m *Manager) listKeysHandle(w http.ResponseWriter, r *http.Request) {
+	keys := m.keys.List()
+	for i := range keys {
+		keys[i].Hash = ""
+	}
+
+	rtn, err := json.MarshalIndent(keys, "", "    ")
+	if err != nil {
+		http.Error(w,
+			"Error getting keys",
+			http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(rtn)
+}
+
+func (m *Manager) newKeyHandle(w http.ResponseWriter, r *http.Request) {
+	req := newKeyRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !auth.ValidScope(scope) {
+			http.Error(w,
+				fmt.Sprintf("invalid scope \"%s\"", scope),
+				http.StatusBadRequest)
+			return
+		}
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "missing scopes", http.StatusBadRequest)
+		return
+	}
+
+	key, secret, err := m.keys.Create(req.Name, req.Scopes, req.Quota)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	key.Hash = ""
+
+	rtn, err := json.MarshalIndent(newKeyResponse{
+		Key:    key,
+		Secret: secret,
+	}, "", "    ")
+	if err != nil {
+		http.Error(w,
+			"Error creating key",
+			http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(rtn)
+}
+
+func (m *Manager) deleteKeyHandle(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	err := m.keys.Delete(id)
+	if err != nil {
+		if errors.Is(err, auth.ErrNotFound) {
+			http.Error(w,
+				fmt.Sprintf("Key with ID %s not found", id),
+				http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,25 +1,40 @@
 package manager
 
 import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ystv/video-transcode/auth"
 	"github.com/ystv/video-transcode/event"
 	"github.com/ystv/video-transcode/state"
+	"github.com/ystv/video-transcode/task"
 )
 
 // Manager provides workers with jobs and offers REST
 // endpoints for 3rd party applications
 type Manager struct {
-	user  string
-	pass  string
-	mq    *event.Eventer
-	state *state.StateHandler
+	keys    *auth.Store
+	mq      *event.Eventer
+	state   *state.StateHandler
+	events  *jobHub
+	metrics *prometheus.Registry
+	quotas  *quotas
+	routes  *routes
+	chunks  *chunker
+	store   *task.Storage // Reads the logs workers upload
 }
 
-// New creates a new manager
-func New(mq *event.Eventer, user, pass string) *Manager {
-	return &Manager{
-		mq:    mq,
-		user:  user,
-		pass:  pass,
-		state: state.NewStateHandler(),
+// New creates a new manager, quota is applied to API
+// keys which don't have their own
+func New(mq *event.Eventer, keys *auth.Store, quota auth.Quota, store *task.Storage) *Manager {
+	m := &Manager{
+		mq:     mq,
+		keys:   keys,
+		state:  state.NewStateHandler(),
+		events: newJobHub(),
+		quotas: newQuotas(quota),
+		routes: newRoutes(),
+		chunks: newChunker(),
+		store:  store,
 	}
+	m.metrics = m.newMetrics()
+	return m
 }
@@ -0,0 +1,127 @@
+package manager
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/ystv/video-transcode/state"
+	"github.com/ystv/video-transcode/task"
+)
+
+// taskTypes are the queues the manager pushes jobs to
+var taskTypes = []string{task.TypeSimpleVideo, task.TypeVOD, task.TypeQuality, task.TypeClip, task.TypeConcat,
+	task.TypeSplit, task.TypeSegment, task.TypeMux,
+	task.TypeSubtitleConvert, task.TypeSubtitleExtract, task.TypeSubtitleMux,
+	task.TypeAudioExtract, task.TypeWaveform}
+
+var (
+	jobsSubmitted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vt",
+		Subsystem: "manager",
+		Name:      "jobs_submitted_total",
+		Help:      "Jobs submitted by type.",
+	}, []string{"type"})
+	jobsCompleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vt",
+		Subsystem: "manager",
+		Name:      "jobs_completed_total",
+		Help:      "Jobs completed successfully by type.",
+	}, []string{"type"})
+	jobsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vt",
+		Subsystem: "manager",
+		Name:      "jobs_failed_total",
+		Help:      "Jobs failed by type.",
+	}, []string{"type"})
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "vt",
+		Subsystem: "manager",
+		Name:      "job_duration_seconds",
+		Help:      "Time from a job being submitted to it finishing.",
+		Buckets:   prometheus.ExponentialBuckets(15, 2, 12), // 15s to ~8.5h
+	}, []string{"type", "result"})
+
+	queueDepthDesc = prometheus.NewDesc(
+		"vt_manager_queue_depth",
+		"Jobs waiting in a task type's queue.",
+		[]string{"type"}, nil)
+	workersDesc = prometheus.NewDesc(
+		"vt_manager_workers",
+		"Workers known to the manager by whether they're online.",
+		[]string{"online"}, nil)
+)
+
+// stateCollector reads gauges from the message queue and
+// state handler when scraped
+type stateCollector struct {
+	m *Manager
+}
+
+func (c stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+	ch <- workersDesc
+}
+
+func (c stateCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, taskType := range taskTypes {
+		depth, err := c.m.mq.QueueDepth(taskType)
+		if err != nil {
+			log.Printf("failed to get queue depth of \"%s\": %+v", taskType, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc,
+			prometheus.GaugeValue, float64(depth), taskType)
+	}
+
+	online, offline := 0, 0
+	for _, w := range c.m.state.GetWorkers() {
+		if w.Online {
+			online++
+		} else {
+			offline++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(workersDesc,
+		prometheus.GaugeValue, float64(online), "true")
+	ch <- prometheus.MustNewConstMetric(workersDesc,
+		prometheus.GaugeValue, float64(offline), "false")
+}
+
+// newMetrics creates the registry exposed on /metrics
+func (m *Manager) newMetrics() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		jobsSubmitted, jobsCompleted, jobsFailed, jobDuration,
+		stateCollector{m: m},
+	)
+	return reg
+}
+
+// metricsHandle serves metrics in the prometheus text format
+func (m *Manager) metricsHandle() http.Handler {
+	return promhttp.HandlerFor(m.metrics, promhttp.HandlerOpts{})
+}
+
+// observeJobEnd records a job reaching a terminal state
+func observeJobEnd(fsi state.FullStatusIndicator) {
+	jobType := fsi.Type
+	if jobType == "" {
+		jobType = "unknown"
+	}
+	result := "completed"
+	if fsi.Failure() {
+		result = "failed"
+		jobsFailed.WithLabelValues(jobType).Inc()
+	} else {
+		jobsCompleted.WithLabelValues(jobType).Inc()
+	}
+	if !fsi.Submitted.IsZero() {
+		jobDuration.WithLabelValues(jobType, result).
+			Observe(time.Since(fsi.Submitted).Seconds())
+	}
+}
@@ -0,0 +1,296 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ystv/video-transcode/auth"
+	"github.com/ystv/video-transcode/state"
+	"golang.org/x/time/rate"
+)
+
+// quotaRetryAfter is suggested to clients which have too many jobs
+// outstanding, since we can't know when one of them will finish
+const quotaRetryAfter = 30 * time.Second
+
+type (
+	// quotas tracks how much each API client has been using the
+	// transcoder and enforces their limits on job submission
+	quotas struct {
+		mu       sync.Mutex
+		defaults auth.Quota
+		limiters map[string]*clientLimiter
+		usage    map[string]*Usage
+		// Jobs admitted but not yet in the state, so concurrent
+		// submissions can't all take the same slot
+		pending map[string]int
+	}
+	// clientLimiter is a client's rate limiter alongside the
+	// quota it was made with, so it can be swapped when that changes
+	clientLimiter struct {
+		quota   auth.Quota
+		limiter *rate.Limiter
+	}
+	// rateToken is what admit took from a client's rate limit, at is
+	// when so it can still be given back once that's passed
+	rateToken struct {
+		res *rate.Reservation
+		at  time.Time
+	}
+	// Usage is what a client has submitted since the manager started
+	Usage struct {
+		ClientID       string    `json:"clientID"`
+		Name           string    `json:"name"`
+		Submitted      int       `json:"submitted"`
+		Completed      int       `json:"completed"`
+		Failed         int       `json:"failed"`
+		Rejected       int       `json:"rejected"`
+		Running        int       `json:"running"`
+		Queued         int       `json:"queued"`
+		EncodedMinutes float64   `json:"encodedMinutes"` // Duration of completed job sources
+		LastSubmitted  time.Time `json:"lastSubmitted"`
+	}
+	// quotaExceeded is returned when a submission is rejected
+	quotaExceeded struct {
+		Error      string `json:"error"`
+		RetryAfter int    `json:"retryAfter"` // Seconds
+	}
+)
+
+func newQuotas(defaults auth.Quota) *quotas {
+	return &quotas{
+		defaults: defaults,
+		limiters: make(map[string]*clientLimiter),
+		usage:    make(map[string]*Usage),
+		pending:  make(map[string]int),
+	}
+}
+
+// quotaFor returns the quota which applies to a key
+func (q *quotas) quotaFor(key auth.Key) auth.Quota {
+	if key.Quota != nil {
+		return *key.Quota
+	}
+	return q.defaults
+}
+
+// getUsage returns a client's usage, must hold the lock
+func (q *quotas) getUsage(key auth.Key) *Usage {
+	u, ok := q.usage[key.ID]
+	if !ok {
+		u = &Usage{ClientID: key.ID}
+		q.usage[key.ID] = u
+	}
+	u.Name = key.Name
+	return u
+}
+
+// admit checks whether a client can submit another job, counting their
+// jobs with clientJobs. When it can, a slot is reserved for the job until
+// release is called with the rate limit token it took, if any. When it
+// can't, the reason and how long they should wait before retrying are
+// returned.
+func (q *quotas) admit(key auth.Key, clientJobs func(clientID string) (queued, running int)) (bool, *rateToken, string, time.Duration) {
+	quota := q.quotaFor(key)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.getUsage(key)
+	queued, running := clientJobs(key.ID)
+	queued += q.pending[key.ID]
+
+	if quota.MaxQueued > 0 && queued >= quota.MaxQueued {
+		u.Rejected++
+		return false, nil, fmt.Sprintf("too many queued jobs, limit is %d", quota.MaxQueued), quotaRetryAfter
+	}
+	if quota.MaxConcurrent > 0 && queued+running >= quota.MaxConcurrent {
+		u.Rejected++
+		return false, nil, fmt.Sprintf("too many jobs in progress, limit is %d", quota.MaxConcurrent), quotaRetryAfter
+	}
+
+	var token *rateToken
+	if quota.RatePerMinute > 0 {
+		l, ok := q.limiters[key.ID]
+		if !ok || l.quota != quota {
+			burst := quota.Burst
+			if burst < 1 {
+				burst = 1
+			}
+			l = &clientLimiter{
+				quota:   quota,
+				limiter: rate.NewLimiter(rate.Limit(quota.RatePerMinute/60), burst),
+			}
+			q.limiters[key.ID] = l
+		}
+		now := time.Now()
+		res := l.limiter.ReserveN(now, 1)
+		if delay := res.DelayFrom(now); delay > 0 {
+			res.CancelAt(now)
+			u.Rejected++
+			return false, nil, fmt.Sprintf("rate limit of %g jobs per minute exceeded", quota.RatePerMinute), delay
+		}
+		token = &rateToken{res: res, at: now}
+	}
+
+	q.pending[key.ID]++
+	u.Submitted++
+	u.LastSubmitted = time.Now()
+	return true, token, "", 0
+}
+
+// release frees a slot reserved by admit, once the job is in the state
+// or it couldn't be submitted after all, in which case it isn't counted
+func (q *quotas) release(key auth.Key, token *rateToken, submitted bool) {
+	if !submitted && token != nil {
+		// Cancelled as of when it was taken, since Cancel does
+		// nothing for reservations which were due in the past
+		token.res.CancelAt(token.at)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending[key.ID] > 0 {
+		q.pending[key.ID]--
+	}
+	if q.pending[key.ID] == 0 {
+		delete(q.pending, key.ID)
+	}
+	if !submitted {
+		q.getUsage(key).Submitted--
+	}
+}
+
+// jobEnded records a client's job finishing
+func (q *quotas) jobEnded(fsi state.FullStatusIndicator) {
+	if fsi.ClientID == "" {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u, ok := q.usage[fsi.ClientID]
+	if !ok {
+		u = &Usage{ClientID: fsi.ClientID}
+		q.usage[fsi.ClientID] = u
+	}
+	if fsi.Failure() {
+		u.Failed++
+		return
+	}
+	u.Completed++
+	if fsi.Stats != nil && fsi.Stats.Duration > 0 {
+		u.EncodedMinutes += float64(fsi.Stats.Duration) / 60
+	}
+}
+
+// admitJob enforces the requesting client's quota, writing a 429 response
+// and returning false when they're over it. Otherwise release has to be
+// called once the job is in the state, or when it failed to be pushed.
+func (m *Manager) admitJob(w http.ResponseWriter, r *http.Request) (release func(submitted bool), ok bool) {
+	key, ok := keyFromContext(r.Context())
+	if !ok {
+		return func(bool) {}, true
+	}
+	ok, token, reason, retryAfter := m.quotas.admit(key, m.state.ClientJobs)
+	if ok {
+		return func(submitted bool) { m.quotas.release(key, token, submitted) }, true
+	}
+
+	secs := int(math.Ceil(retryAfter.Seconds()))
+	rtn, _ := json.MarshalIndent(quotaExceeded{
+		Error:      reason,
+		RetryAfter: secs,
+	}, "", "    ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", fmt.Sprint(secs))
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write(rtn)
+	return nil, false
+}
+
+// usageFor returns a copy of a client's usage with their current job counts
+func (m *Manager) usageFor(key auth.Key) Usage {
+	m.quotas.mu.Lock()
+	u := *m.quotas.getUsage(key)
+	m.quotas.mu.Unlock()
+	u.Queued, u.Running = m.state.ClientJobs(key.ID)
+	return u
+}
+
+// usageHandle returns the requesting client's usage
+func (m *Manager) usageHandle(w http.ResponseWriter, r *http.Request) {
+	key, ok := keyFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorised.", http.StatusUnauthorized)
+		return
+	}
+
+	rtn, err := json.MarshalIndent(m.usageFor(key), "", "    ")
+	if err != nil {
+		http.Error(w,
+			"Error getting usage",
+			http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(rtn)
+}
+
+// allUsageHandle returns the usage of every client
+func (m *Manager) allUsageHandle(w http.ResponseWriter, r *http.Request) {
+	usage := []Usage{}
+	for _, key := range m.keys.List() {
+		usage = append(usage, m.usageFor(key))
+	}
+
+	rtn, err := json.MarshalIndent(usage, "", "    ")
+	if err != nil {
+		http.Error(w,
+			"Error getting usage",
+			http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(rtn)
+}
+
+// setQuotaHandle replaces a key's quota, an empty body reverts
+// it to the default
+func (m *Manager) setQuotaHandle(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var quota *auth.Quota
+	err := json.NewDecoder(r.Body).Decode(&quota)
+	if err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key, err := m.keys.SetQuota(id, quota)
+	if err != nil {
+		if errors.Is(err, auth.ErrNotFound) {
+			http.Error(w,
+				fmt.Sprintf("Key with ID %s not found", id),
+				http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	key.Hash = ""
+
+	rtn, err := json.MarshalIndent(key, "", "    ")
+	if err != nil {
+		http.Error(w,
+			"Error setting quota",
+			http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(rtn)
+}
@@ -1,15 +1,17 @@
 package manager
 
 import (
-	"crypto/subtle"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/ystv/video-transcode/auth"
 	"github.com/ystv/video-transcode/state"
 	"github.com/ystv/video-transcode/task"
 )
@@ -19,18 +21,37 @@ func (m *Manager) Router() *mux.Router {
 	r := mux.NewRouter()
 	r.HandleFunc("/", m.indexHandle)
 	r.HandleFunc("/ok", m.healthHandle)
-	r.HandleFunc("/status/job/{uuid}", m.basicAuth(m.jobStateHandle))
-	r.HandleFunc("/status/worker", m.basicAuth(m.allWorkersHandler))
-	r.HandleFunc("/status/worker/{uuid}", m.basicAuth(m.workerStateHandle))
-	r.HandleFunc("/task/image/simple", m.basicAuth(m.newImageSimple))
-	r.HandleFunc("/task/video/simple", m.basicAuth(m.newVideoSimpleHandle))
-	r.HandleFunc("/task/video/vod", m.basicAuth(m.newVideoOnDemandHandle))
-	r.HandleFunc("/task/video/probe", m.basicAuth(m.indexHandle))
-	r.HandleFunc("/ws", m.newWS)
+	r.Handle("/metrics", m.metricsHandle())
+	r.HandleFunc("/status/job/{uuid}", m.requireScope(auth.ScopeRead, m.jobStateHandle))
+	r.HandleFunc("/status/job/{uuid}/events", m.requireScope(auth.ScopeRead, m.jobEventsHandle)).Methods(http.MethodGet)
+	r.HandleFunc("/jobs/{uuid}/log", m.requireScope(auth.ScopeRead, m.jobLogHandle)).Methods(http.MethodGet)
+	r.HandleFunc("/status/jobs/ws", m.requireScope(auth.ScopeRead, m.jobsWSHandle))
+	r.HandleFunc("/status/worker", m.requireScope(auth.ScopeRead, m.allWorkersHandler))
+	r.HandleFunc("/status/worker/{uuid}", m.requireScope(auth.ScopeRead, m.workerStateHandle))
+	r.HandleFunc("/task/image/simple", m.requireScope(auth.ScopeSubmit, m.newImageSimple))
+	r.HandleFunc("/task/video/simple", m.requireScope(auth.ScopeSubmit, m.newVideoSimpleHandle))
+	r.HandleFunc("/task/video/vod", m.requireScope(auth.ScopeSubmit, m.newVideoOnDemandHandle))
+	r.HandleFunc("/task/video/quality", m.requireScope(auth.ScopeSubmit, m.newVideoQualityHandle))
+	r.HandleFunc("/task/video/clip", m.requireScope(auth.ScopeSubmit, m.newVideoClipHandle))
+	r.HandleFunc("/task/video/concat", m.requireScope(auth.ScopeSubmit, m.newVideoConcatHandle))
+	r.HandleFunc("/task/subtitle/convert", m.requireScope(auth.ScopeSubmit, m.newSubtitleConvertHandle))
+	r.HandleFunc("/task/subtitle/extract", m.requireScope(auth.ScopeSubmit, m.newSubtitleExtractHandle))
+	r.HandleFunc("/task/subtitle/mux", m.requireScope(auth.ScopeSubmit, m.newSubtitleMuxHandle))
+	r.HandleFunc("/task/audio/extract", m.requireScope(auth.ScopeSubmit, m.newAudioExtractHandle))
+	r.HandleFunc("/task/audio/waveform", m.requireScope(auth.ScopeSubmit, m.newAudioWaveformHandle))
+	r.HandleFunc("/task/video/probe", m.requireScope(auth.ScopeSubmit, m.indexHandle))
+	r.HandleFunc("/admin/keys", m.requireScope(auth.ScopeAdmin, m.listKeysHandle)).Methods(http.MethodGet)
+	r.HandleFunc("/admin/keys", m.requireScope(auth.ScopeAdmin, m.newKeyHandle)).Methods(http.MethodPost)
+	r.HandleFunc("/admin/keys/{id}", m.requireScope(auth.ScopeAdmin, m.deleteKeyHandle)).Methods(http.MethodDelete)
+	r.HandleFunc("/admin/keys/{id}/quota", m.requireScope(auth.ScopeAdmin, m.setQuotaHandle)).Methods(http.MethodPut)
+	r.HandleFunc("/admin/workers/{uuid}/drain", m.requireScope(auth.ScopeAdmin, m.drainWorkerHandle)).Methods(http.MethodPost)
+	r.HandleFunc("/admin/usage", m.requireScope(auth.ScopeAdmin, m.allUsageHandle)).Methods(http.MethodGet)
+	r.HandleFunc("/usage", m.requireScope(auth.ScopeSubmit, m.usageHandle)).Methods(http.MethodGet)
+	r.HandleFunc("/ws", m.requireScope(auth.ScopeWorker, m.newWS))
 	return r
 }
 
-// indexHandle just shows it's alive, could have metrics?
+// indexHandle just shows it's alive, metrics are on /metrics
 func (m *Manager) indexHandle(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("vt manager (v0.3.0)"))
@@ -63,43 +84,153 @@ func (m *Manager) newVideoOnDemandHandle(w http.ResponseWriter, r *http.Request)
 
 	log.Println(t.GetID())
 
-	err = m.mq.Push(&t, "video/vod")
+	if t.Chunked != nil {
+		m.submitChunked(w, r, &t)
+		return
+	}
+	m.submitJob(w, r, &t, t.Requires, "VOD Job Sent to Proceessing")
+}
+
+// newLiveHandle will stream file to ffmpeg, optional
+// transcode and send to new endpoint
+func (m *Manager) newVideoSimpleHandle(w http.ResponseWriter, r *http.Request) {
+	t := task.SimpleVideo{}
+	err := json.NewDecoder(r.Body).Decode(&t)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	m.state.Jobs[t.GetID()] = state.FullStatusIndicator{
-		JobID:       t.GetID(),
-		FailureMode: "IN-PROGRESS",
-		Summary:     "Starting",
-		Detail:      "VOD Job Sent to Proceessing",
-		Time:        time.Now(),
+	if err = t.ValidateRequest(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	w.Header().Set("Content-Type", "application/json")
+	m.submitJob(w, r, &t, t.Requires, "Simple Video Job Sent to Processing")
+}
 
-	rtn, err := json.MarshalIndent(state.TaskIdentification{
-		State:  "encoding",
-		TaskID: t.GetID(),
-	}, "", "    ")
+// newVideoQualityHandle scores an encode against its source
+func (m *Manager) newVideoQualityHandle(w http.ResponseWriter, r *http.Request) {
+	t := task.Quality{}
+	err := json.NewDecoder(r.Body).Decode(&t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = t.ValidateRequest(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.submitJob(w, r, &t, t.Requires, "Quality Job Sent to Processing")
+}
+
+// newVideoClipHandle cuts ranges out of a source into a clip
+func (m *Manager) newVideoClipHandle(w http.ResponseWriter, r *http.Request) {
+	t := task.Clip{}
+	err := json.NewDecoder(r.Body).Decode(&t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = t.ValidateRequest(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	m.submitJob(w, r, &t, t.Requires, "Clip Job Sent to Processing")
+}
+
+// newVideoConcatHandle joins sources one after another
+func (m *Manager) newVideoConcatHandle(w http.ResponseWriter, r *http.Request) {
+	t := task.Concat{}
+	err := json.NewDecoder(r.Body).Decode(&t)
 	if err != nil {
-		http.Error(w,
-			fmt.Sprintf("Encoding with Error - %v", err.Error()),
-			http.StatusInternalServerError,
-		)
-	} else {
-		w.Write(rtn)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
+	if err = t.ValidateRequest(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.submitJob(w, r, &t, t.Requires, "Concat Job Sent to Processing")
 }
 
-// newLiveHandle will stream file to ffmpeg, optional
-// transcode and send to new endpoint
-func (m *Manager) newVideoSimpleHandle(w http.ResponseWriter, r *http.Request) {
-	t := task.SimpleVideo{}
+// newSubtitleConvertHandle converts a caption file to another format
+func (m *Manager) newSubtitleConvertHandle(w http.ResponseWriter, r *http.Request) {
+	t := task.SubtitleConvert{}
+	err := json.NewDecoder(r.Body).Decode(&t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = t.ValidateRequest(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.submitJob(w, r, &t, t.Requires, "Subtitle Convert Job Sent to Processing")
+}
+
+// newSubtitleExtractHandle pulls the captions embedded in a source out
+func (m *Manager) newSubtitleExtractHandle(w http.ResponseWriter, r *http.Request) {
+	t := task.SubtitleExtract{}
+	err := json.NewDecoder(r.Body).Decode(&t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = t.ValidateRequest(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.submitJob(w, r, &t, t.Requires, "Subtitle Extract Job Sent to Processing")
+}
+
+// newSubtitleMuxHandle adds caption files to a video or HLS playlist
+func (m *Manager) newSubtitleMuxHandle(w http.ResponseWriter, r *http.Request) {
+	t := task.SubtitleMux{}
+	err := json.NewDecoder(r.Body).Decode(&t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = t.ValidateRequest(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.submitJob(w, r, &t, t.Requires, "Subtitle Mux Job Sent to Processing")
+}
+
+// newAudioExtractHandle pulls a source's audio out into renditions
+func (m *Manager) newAudioExtractHandle(w http.ResponseWriter, r *http.Request) {
+	t := task.AudioExtract{}
+	err := json.NewDecoder(r.Body).Decode(&t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = t.ValidateRequest(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.submitJob(w, r, &t, t.Requires, "Audio Extract Job Sent to Processing")
+}
+
+// newAudioWaveformHandle generates the peak data of a source's audio
+func (m *Manager) newAudioWaveformHandle(w http.ResponseWriter, r *http.Request) {
+	t := task.Waveform{}
 	err := json.NewDecoder(r.Body).Decode(&t)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -111,18 +242,65 @@ func (m *Manager) newVideoSimpleHandle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = m.mq.Push(&t, "video/simple")
+	m.submitJob(w, r, &t, t.Requires, "Waveform Job Sent to Processing")
+}
+
+// submitJob routes a validated job to a queue and records it,
+// responding with the job's ID
+func (m *Manager) submitJob(w http.ResponseWriter, r *http.Request, t task.Task, requires []string, detail string) {
+	queue, err := m.routeJob(t.GetType(), requires)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	release, ok := m.admitJob(w, r)
+	if !ok {
+		return
+	}
+
+	// Recorded first so its statuses are applied, a quick task
+	// can report back before Push has returned
+	fsi := state.FullStatusIndicator{
+		JobID:       t.GetID(),
+		Type:        t.GetType(),
+		ClientID:    clientID(r),
+		FailureMode: "IN-PROGRESS",
+		Summary:     "Starting",
+		Detail:      detail,
+		Time:        time.Now(),
+		Submitted:   time.Now(),
+	}
+	m.state.SetJob(fsi)
+	err = m.mq.Push(t, queue)
+	if err != nil {
+		err = fmt.Errorf("failed to push %s: %w", t.GetType(), err)
+		fsi.FailureMode = "FAILED"
+		fsi.Summary = "Failed"
+		fsi.Detail = err.Error()
+		fsi.Stage = task.StageFailed
+		fsi.Error = task.AsError(task.NewError(task.ErrorInternal, true, err))
+		fsi.Time = time.Now()
+		m.state.SetJob(fsi)
+		m.events.publish(fsi)
+		release(false)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	jobsSubmitted.WithLabelValues(t.GetType()).Inc()
+	release(true)
+
+	m.writeSubmitted(w, t.GetID())
+}
 
+// writeSubmitted responds with the ID of a job which has been submitted
+func (m *Manager) writeSubmitted(w http.ResponseWriter, jobID string) {
 	w.WriteHeader(http.StatusCreated)
 	w.Header().Set("Content-Type", "application/json")
 
 	rtn, err := json.MarshalIndent(state.TaskIdentification{
 		State:  "encoding",
-		TaskID: t.GetID(),
+		TaskID: jobID,
 	}, "", "    ")
 
 	if err != nil {
@@ -147,28 +325,55 @@ func (m *Manager) newWS(w http.ResponseWriter, r *http.Request) {
 	m.Reader(conn)
 }
 
-// basicAuth wraps a handler requiring HTTP basic auth for it using the given
-// username and password and the specified realm, which shouldn't contain quotes.
-//
-// Most web browser display a dialog with something like:
-//
-//    The website says: "<realm>"
-//
-// Which is really stupid so you may want to set the realm to a message rather than
-// an actual realm.
-func (m *Manager) basicAuth(handler http.HandlerFunc) http.HandlerFunc {
+// requireScope wraps a handler requiring an API key with the given scope.
+// The key is read from a bearer token, the X-API-Key header or the password
+// of HTTP basic auth, the latter being handy for browsers' EventSource.
+func (m *Manager) requireScope(scope auth.Scope, handler http.HandlerFunc) http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		user, pass, ok := r.BasicAuth()
-
-		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(m.user)) != 1 || subtle.ConstantTimeCompare([]byte(pass), []byte(m.pass)) != 1 {
-			w.Header().Set("WWW-Authenticate", `Basic realm="ystv vt"`)
-			w.WriteHeader(401)
+		key, ok := m.keys.Authenticate(apiKeyFromRequest(r))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ystv vt"`)
+			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte("Unauthorised.\n"))
 			return
 		}
+		if !key.Has(scope) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Forbidden, key is missing scope " + string(scope) + ".\n"))
+			return
+		}
+
+		handler(w, r.WithContext(context.WithValue(r.Context(), keyContextKey{}, key)))
+	}
+}
+
+// keyContextKey stores the authenticated key in a request's context
+type keyContextKey struct{}
+
+// keyFromContext returns the API key a request was authenticated with
+func keyFromContext(ctx context.Context) (auth.Key, bool) {
+	key, ok := ctx.Value(keyContextKey{}).(auth.Key)
+	return key, ok
+}
 
-		handler(w, r)
+// clientID returns the ID of the API key a request was made with
+func clientID(r *http.Request) string {
+	key, _ := keyFromContext(r.Context())
+	return key.ID
+}
+
+func apiKeyFromRequest(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if _, pass, ok := r.BasicAuth(); ok {
+		return pass
 	}
+	return ""
 }
@@ -0,0 +1,115 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/ystv/video-transcode/state"
+	"github.com/ystv/video-transcode/task"
+	"github.com/ystv/video-transcode/worker"
+)
+
+// routes tracks the queues of jobs with requirements, workers which
+// meet them are told to take jobs from them
+type routes struct {
+	mu     sync.Mutex
+	queues map[string]bool
+}
+
+func newRoutes() *routes {
+	return &routes{queues: make(map[string]bool)}
+}
+
+func (r *routes) add(queue string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queues[queue] = true
+}
+
+func (r *routes) list() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	queues := make([]string, 0, len(r.queues))
+	for q := range r.queues {
+		queues = append(queues, q)
+	}
+	sort.Strings(queues)
+	return queues
+}
+
+// canRun returns whether a worker can take jobs from a queue
+func canRun(ws state.WorkerStatus, queue string) bool {
+	if !ws.Online || ws.State == worker.StateDraining || ws.Capabilities == nil {
+		return false
+	}
+	taskType, requires := task.ParseQueueName(queue)
+	enabled := false
+	for _, t := range ws.TasksEnabled {
+		if t == taskType {
+			enabled = true
+		}
+	}
+	return enabled && ws.Capabilities.SatisfiesAll(requires)
+}
+
+// routeJob returns the queue a job should be pushed to. Jobs with
+// requirements get their own queue, which workers that can run them
+// are told to take jobs from. It's an error if no worker can.
+func (m *Manager) routeJob(taskType string, requires []string) (string, error) {
+	queue := task.QueueName(taskType, requires)
+	if len(requires) == 0 {
+		return queue, nil
+	}
+
+	capable := 0
+	for id, ws := range m.state.GetWorkers() {
+		if !canRun(ws, queue) {
+			continue
+		}
+		capable++
+		m.sendListen(id, ws, queue)
+	}
+	if capable == 0 {
+		return "", fmt.Errorf("no online worker meets the job's requirements")
+	}
+	m.routes.add(queue)
+	return queue, nil
+}
+
+// syncWorkerQueues tells a worker about the queues it can take jobs
+// from which it isn't yet, i.e. when it has just started
+func (m *Manager) syncWorkerQueues(workerID string) {
+	ws, ok := m.state.GetWorker(workerID)
+	if !ok {
+		return
+	}
+	for _, queue := range m.routes.list() {
+		if canRun(ws, queue) {
+			m.sendListen(workerID, ws, queue)
+		}
+	}
+}
+
+// sendListen tells a worker to take jobs from a queue,
+// unless it already is
+func (m *Manager) sendListen(workerID string, ws state.WorkerStatus, queue string) {
+	for _, q := range ws.Queues {
+		if q == queue {
+			return
+		}
+	}
+	cmd, err := json.Marshal(worker.Command{
+		Command: worker.CommandListen,
+		Queue:   queue,
+	})
+	if err != nil {
+		return
+	}
+	err = m.mq.SendControl(workerID, cmd)
+	if err != nil {
+		log.Printf("failed to tell worker %s to listen to %s: %+v", workerID, queue, err)
+	}
+}
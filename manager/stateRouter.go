@@ -1,18 +1,24 @@
 package manager
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/ystv/video-transcode/state"
+	"github.com/ystv/video-transcode/worker"
 )
 
 func (m *Manager) jobStateHandle(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	uuid := params["uuid"]
 
-	jobState, ok := m.state.Jobs[uuid]
+	jobState, ok := m.state.GetJob(uuid)
 
 	if !ok {
 		http.Error(w,
@@ -32,11 +38,67 @@ func (m *Manager) jobStateHandle(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// jobLogHandle sends a job's ffmpeg log, read from wherever the worker
+// uploaded it to. It falls back to the end of it we were sent if the full
+// log can't be read.
+func (m *Manager) jobLogHandle(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	uuid := params["uuid"]
+
+	jobState, ok := m.state.GetJob(uuid)
+	if !ok {
+		http.Error(w,
+			fmt.Sprintf("Job with UUID %s not found", uuid),
+			http.StatusNotFound)
+		return
+	}
+	fsi, ok := jobState.(state.FullStatusIndicator)
+	if !ok {
+		http.Error(w, "No log for job", http.StatusNotFound)
+		return
+	}
+
+	if fsi.Log != "" {
+		logFile, err := m.openLog(r.Context(), fsi.Log)
+		if err == nil {
+			defer logFile.Close()
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, err = io.Copy(w, logFile)
+			if err != nil {
+				log.Printf("failed to send log of job %s: %+v", uuid, err)
+			}
+			return
+		}
+		log.Printf("failed to read log of job %s: %+v", uuid, err)
+	}
+	if len(fsi.LogTail) == 0 {
+		http.Error(w, "No log for job", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if fsi.Log != "" {
+		fmt.Fprintf(w, "# full log at %s couldn't be read, this is the end of it\n", fsi.Log)
+	}
+	w.Write([]byte(strings.Join(fsi.LogTail, "\n") + "\n"))
+}
+
+// openLog opens a log a worker uploaded through the storage backends
+func (m *Manager) openLog(ctx context.Context, logURL string) (io.ReadCloser, error) {
+	if m.store == nil {
+		return nil, fmt.Errorf("no storage to read logs from")
+	}
+	b, u, err := m.store.Resolve(logURL)
+	if err != nil {
+		return nil, err
+	}
+	return b.Get(ctx, u, 0)
+}
+
 func (m *Manager) workerStateHandle(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	uuid := params["uuid"]
 
-	workerState, ok := m.state.Workers[uuid]
+	workerState, ok := m.state.GetWorker(uuid)
 
 	if !ok {
 		http.Error(w,
@@ -57,7 +119,7 @@ func (m *Manager) workerStateHandle(w http.ResponseWriter, r *http.Request) {
 }
 
 func (m *Manager) allWorkersHandler(w http.ResponseWriter, r *http.Request) {
-	rtn, err := json.MarshalIndent(m.state.Workers, "", "    ")
+	rtn, err := json.MarshalIndent(m.state.GetWorkers(), "", "    ")
 	if err != nil {
 		http.Error(w,
 			"Error getting all worker statuses",
@@ -66,3 +128,28 @@ func (m *Manager) allWorkersHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write(rtn)
 	}
 }
+
+// drainWorkerHandle asks a worker to stop taking jobs and shut down
+// once its running jobs have finished, for rolling updates
+func (m *Manager) drainWorkerHandle(w http.ResponseWriter, r *http.Request) {
+	uuid := mux.Vars(r)["uuid"]
+
+	if _, ok := m.state.GetWorker(uuid); !ok {
+		http.Error(w,
+			fmt.Sprintf("Worker with UUID %s not found", uuid),
+			http.StatusNotFound)
+		return
+	}
+
+	cmd, err := json.Marshal(worker.Command{Command: worker.CommandDrain})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = m.mq.SendControl(uuid, cmd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -49,20 +49,20 @@ func (m *Manager) Reader(conn *websocket.Conn) {
 
 			switch wStatus.State {
 			case "START":
-				m.state.Workers[wStatus.WorkerID] = &state.WorkerStatus{}
+				m.state.AddWorker(wStatus.WorkerID)
 			case "END":
-				delete(m.state.Workers, wStatus.WorkerID)
+				m.state.RemoveWorker(wStatus.WorkerID)
 			case "ADD JOB":
-				m.state.Workers[wStatus.WorkerID].StartJob()
+				m.state.WorkerStartJob(wStatus.WorkerID)
 			case "END JOB":
-				m.state.Workers[wStatus.WorkerID].EndJob()
+				m.state.WorkerEndJob(wStatus.WorkerID)
 			}
 		case "JOB":
 			var jStatus state.FullStatusIndicator
 			byt, _ := json.Marshal(updateMessage.Body)
 			json.Unmarshal(byt, &jStatus)
 
-			m.state.Jobs[jStatus.GetUUID()] = jStatus
+			m.state.SetJob(jStatus)
 		}
 
 		log.Println(string(p))
@@ -1,6 +1,12 @@
 package state
 
-import "time"
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ystv/video-transcode/task"
+)
 
 // So, in general, all of this stuff could be moved to a new package.
 // Probably a good idea, to create some nice code layout for all
@@ -16,13 +22,22 @@ type JobStatus interface {
 	Get() string
 	GetUUID() string
 	Failure() bool
+	Done() bool
 	DetailedStatus() string
 }
 
 // WorkerStatus is the data related to an individual
 // worker, that we can monitor
 type WorkerStatus struct {
-	JobsCount int `json:"jobsCount"`
+	State        string        `json:"state,omitempty"` // Reported by the worker, i.e. RUNNING or DRAINING
+	JobsCount    int           `json:"jobsCount"`
+	TasksEnabled []string      `json:"tasksEnabled"`
+	Queues       []string      `json:"queues"` // Queues the worker is taking jobs from
+	CurrentTasks []task.Status `json:"currentTasks"`
+	Online       bool          `json:"online"`
+	LastSeen     time.Time     `json:"lastSeen"`
+
+	Capabilities *task.Capabilities `json:"capabilities,omitempty"` // What the worker's ffmpeg supports
 }
 
 // Busy returns whether the worker has any jobs running
@@ -41,7 +56,7 @@ func (w *WorkerStatus) EndJob() {
 // StateHandler is the central place for the systems status
 // for access over HTTP by users
 type StateHandler struct {
-	// TODO: Implement Worker Statuses Here Too
+	mu      sync.RWMutex
 	Jobs    map[string]JobStatus
 	Workers map[string]*WorkerStatus
 }
@@ -52,9 +67,144 @@ func NewStateHandler() *StateHandler {
 		Workers: make(map[string]*WorkerStatus),
 	}
 	go newSH.Tidier() // Henry Hoover
+	go newSH.WorkerTidier()
 	return newSH
 }
 
+// SetJob stores the latest status of a job
+func (h *StateHandler) SetJob(js JobStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Jobs[js.GetUUID()] = js
+}
+
+// GetJob returns the status of a job
+func (h *StateHandler) GetJob(uuid string) (JobStatus, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	js, ok := h.Jobs[uuid]
+	return js, ok
+}
+
+// ClientJobs counts a client's unfinished jobs, split by whether
+// they're waiting for a worker or being processed by one
+func (h *StateHandler) ClientJobs(clientID string) (queued, running int) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, js := range h.Jobs {
+		fsi, ok := js.(FullStatusIndicator)
+		if !ok || fsi.ClientID != clientID || fsi.Done() {
+			continue
+		}
+		if fsi.WorkerID == "" {
+			queued++
+		} else {
+			running++
+		}
+	}
+	return
+}
+
+// AddWorker registers a worker as online
+func (h *StateHandler) AddWorker(workerID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Workers[workerID] = &WorkerStatus{Online: true, LastSeen: time.Now()}
+}
+
+// RemoveWorker forgets about a worker
+func (h *StateHandler) RemoveWorker(workerID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.Workers, workerID)
+}
+
+// RequeueWorkerJobs marks the unfinished jobs a worker was running as
+// waiting for a worker again, returning the jobs which were changed
+func (h *StateHandler) RequeueWorkerJobs(workerID string) []FullStatusIndicator {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	requeued := []FullStatusIndicator{}
+	for id, js := range h.Jobs {
+		fsi, ok := js.(FullStatusIndicator)
+		if !ok || fsi.WorkerID != workerID || fsi.Done() {
+			continue
+		}
+		fsi.WorkerID = ""
+		fsi.Stage = ""
+		fsi.Stats = nil
+		fsi.Summary = "Requeued"
+		fsi.Detail = fmt.Sprintf("Job requeued after worker %s stopped", workerID)
+		fsi.Time = time.Now()
+		h.Jobs[id] = fsi
+		requeued = append(requeued, fsi)
+	}
+	return requeued
+}
+
+// WorkerStartJob increments a worker's job count
+func (h *StateHandler) WorkerStartJob(workerID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if w, ok := h.Workers[workerID]; ok {
+		w.StartJob()
+	}
+}
+
+// WorkerEndJob decrements a worker's job count
+func (h *StateHandler) WorkerEndJob(workerID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if w, ok := h.Workers[workerID]; ok {
+		w.EndJob()
+	}
+}
+
+// Heartbeat records a status snapshot sent by a worker,
+// registering the worker if we haven't seen it before. Capabilities
+// are kept from an earlier snapshot when they're left out.
+func (h *StateHandler) Heartbeat(workerID string, hb WorkerStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w, ok := h.Workers[workerID]
+	if !ok {
+		w = &WorkerStatus{}
+		h.Workers[workerID] = w
+	}
+	w.State = hb.State
+	w.TasksEnabled = hb.TasksEnabled
+	w.Queues = hb.Queues
+	w.CurrentTasks = hb.CurrentTasks
+	w.JobsCount = len(hb.CurrentTasks)
+	if hb.Capabilities != nil {
+		w.Capabilities = hb.Capabilities
+	}
+	w.Online = true
+	w.LastSeen = time.Now()
+}
+
+// GetWorker returns a copy of a worker's status
+func (h *StateHandler) GetWorker(workerID string) (WorkerStatus, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	w, ok := h.Workers[workerID]
+	if !ok {
+		return WorkerStatus{}, false
+	}
+	return *w, true
+}
+
+// GetWorkers returns a copy of every worker's status
+func (h *StateHandler) GetWorkers() map[string]WorkerStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	workers := make(map[string]WorkerStatus, len(h.Workers))
+	for id, w := range h.Workers {
+		workers[id] = *w
+	}
+	return workers
+}
+
 // TaskIdentification is for initially informing the user
 // of their job starting and its given ID for later
 // checking
@@ -67,11 +217,22 @@ type TaskIdentification struct {
 // all available information about a job state, for use
 // before it gets Henry-Hoovered.
 type FullStatusIndicator struct {
-	JobID       string    `json:"jobID"`
-	FailureMode string    `json:"failureMode"`
-	Summary     string    `json:"summary"`
-	Detail      string    `json:"detail"`
-	Time        time.Time `json:"time"`
+	JobID       string       `json:"jobID"`
+	Type        string       `json:"type,omitempty"`
+	ClientID    string       `json:"clientID,omitempty"` // API key which submitted the job
+	ParentID    string       `json:"parentID,omitempty"` // Chunked job the job is part of
+	FailureMode string       `json:"failureMode"`
+	Summary     string       `json:"summary"`
+	Detail      string       `json:"detail"`
+	Time        time.Time    `json:"time"`
+	Submitted   time.Time    `json:"submitted"`
+	WorkerID    string       `json:"workerID,omitempty"` // Worker running the job
+	Stage       string       `json:"stage,omitempty"`    // Stage reported by the worker
+	Stats       *task.Stats  `json:"stats,omitempty"`    // Progress of the encode
+	Result      *task.Result `json:"result,omitempty"`   // What the job produced
+	Error       *task.Error  `json:"error,omitempty"`    // Why the job failed
+	LogTail     []string     `json:"logTail,omitempty"`  // End of ffmpeg's output if the job failed
+	Log         string       `json:"log,omitempty"`      // Where ffmpeg's full output was uploaded to
 }
 
 // Get returns the job status summary.
@@ -101,6 +262,11 @@ func (fsi FullStatusIndicator) Failure() bool {
 	}
 }
 
+// Done returns whether the job has reached a terminal state
+func (fsi FullStatusIndicator) Done() bool {
+	return fsi.FailureMode != "IN-PROGRESS"
+}
+
 // DetailedStatus returns a detailed form of the job
 // status. This only lasts until the first Henry-Hoover
 // process (see top)
@@ -149,6 +315,11 @@ func (ssi ShortStatusIndicator) Failure() bool {
 	}
 }
 
+// Done returns whether the job has reached a terminal state
+func (ssi ShortStatusIndicator) Done() bool {
+	return ssi.FailureMode != "IN-PROGRESS"
+}
+
 // DetailedStatus just says that the detailed status
 // has expired.
 // TODO - Do we include timing information here?
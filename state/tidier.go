@@ -5,11 +5,16 @@ import "time"
 const SHORT_EXPIRY = time.Duration(2*24) * time.Hour
 const LONG_EXPIRY = time.Duration(7*24) * time.Hour
 
+// WORKER_TIMEOUT is how long we wait without a heartbeat
+// before considering a worker offline
+const WORKER_TIMEOUT = time.Duration(10) * time.Second
+
 func (h *StateHandler) Tidier() {
 	// The Previously Mentioned Henry-Hoover Function
 
 	for {
 		// 1. Do a Tidying Pass
+		h.mu.Lock()
 		for key, val := range h.Jobs {
 			if fsi, ok := val.(FullStatusIndicator); ok {
 				if fsi.Time.Add(SHORT_EXPIRY).Before(time.Now()) {
@@ -30,6 +35,7 @@ func (h *StateHandler) Tidier() {
 				}
 			}
 		}
+		h.mu.Unlock()
 
 		// 2. Delay
 		time.Sleep(time.Duration(5) * time.Minute)
@@ -37,3 +43,20 @@ func (h *StateHandler) Tidier() {
 		// TODO: Stopping Call
 	}
 }
+
+// WorkerTidier marks workers as offline when their heartbeats stop
+func (h *StateHandler) WorkerTidier() {
+	for {
+		h.mu.Lock()
+		for _, w := range h.Workers {
+			if w.Online && w.LastSeen.Add(WORKER_TIMEOUT).Before(time.Now()) {
+				w.Online = false
+				w.CurrentTasks = nil
+				w.JobsCount = 0
+			}
+		}
+		h.mu.Unlock()
+
+		time.Sleep(WORKER_TIMEOUT / 2)
+	}
+}
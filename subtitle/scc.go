@@ -0,0 +1,201 @@
+package subtitle
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// CEA-608 limits captions to 4 rows of 32 characters
+const (
+	sccColumns = 32
+	sccRows    = 4
+)
+
+// sccFrameRate is the NTSC frame rate SCC timecodes count in
+const sccFrameRate = 30000.0 / 1001
+
+// Control codes for data channel 1, before parity is added
+var (
+	sccResumeLoading  = [2]byte{0x14, 0x20} // Start a pop-on caption
+	sccEraseHidden    = [2]byte{0x14, 0x2e} // Clear the caption being loaded
+	sccEndOfCaption   = [2]byte{0x14, 0x2f} // Show the loaded caption
+	sccEraseDisplayed = [2]byte{0x14, 0x2c} // Clear the shown caption
+)
+
+// sccRowCodes are the preamble address codes which put
+// the cursor at the start of rows 1 to 15 in white
+var sccRowCodes = [15][2]byte{
+	{0x11, 0x40}, {0x11, 0x60}, {0x12, 0x40}, {0x12, 0x60}, {0x15, 0x40},
+	{0x15, 0x60}, {0x16, 0x40}, {0x16, 0x60}, {0x17, 0x40}, {0x17, 0x60},
+	{0x10, 0x40}, {0x13, 0x40}, {0x13, 0x60}, {0x14, 0x40}, {0x14, 0x60},
+}
+
+// sccBasic are the characters where CEA-608's basic set differs from
+// ASCII, the ASCII characters they replace can't be written
+var sccBasic = map[rune]byte{
+	'á': 0x2a, 'é': 0x5c, 'í': 0x5e, 'ó': 0x5f, 'ú': 0x60,
+	'ç': 0x7b, '÷': 0x7c, 'Ñ': 0x7d, 'ñ': 0x7e, '█': 0x7f,
+}
+
+// sccSpecial are the characters sent as a two byte code
+var sccSpecial = map[rune]byte{
+	'®': 0x30, '°': 0x31, '½': 0x32, '¿': 0x33, '™': 0x34, '¢': 0x35, '£': 0x36, '♪': 0x37,
+	'à': 0x38, 'è': 0x3a, 'â': 0x3b, 'ê': 0x3c, 'î': 0x3d, 'ô': 0x3e, 'û': 0x3f,
+}
+
+// sccLine is a line of an SCC file, codes sent a frame apart from frame
+type sccLine struct {
+	frame int
+	codes [][2]byte
+}
+
+// writeSCC writes the cues as pop-on captions. Each is loaded off
+// screen in the frames before it starts, then shown and cleared at
+// its start and end. Tags are removed, lines longer than 32
+// characters are wrapped and only the last 4 rows are kept.
+// Characters 608 doesn't have are written as "?".
+func writeSCC(w io.Writer, cues []Cue) error {
+	sccLines := []sccLine{}
+	free := 0 // First frame nothing's been sent in yet
+	for _, c := range cues {
+		codes := [][2]byte{sccResumeLoading, sccResumeLoading, sccEraseHidden, sccEraseHidden}
+		rows := sccWrap(plainText(c.Text))
+		for i, row := range rows {
+			pac := sccRowCodes[15-len(rows)+i]
+			codes = append(codes, pac, pac)
+			codes = append(codes, sccText(row)...)
+		}
+		codes = append(codes, sccEndOfCaption, sccEndOfCaption)
+
+		// The caption's shown by the last code, so loading starts early
+		// enough for that to land on the cue's start where it can
+		start := sccFrame(c.Start) - len(codes) + 1
+		if start < free {
+			start = free
+		}
+		sccLines = append(sccLines, sccLine{start, codes})
+		free = start + len(codes)
+
+		end := sccFrame(c.End)
+		if end < free {
+			end = free
+		}
+		sccLines = append(sccLines, sccLine{end, [][2]byte{sccEraseDisplayed, sccEraseDisplayed}})
+		free = end + 2
+	}
+
+	b := bufio.NewWriter(w)
+	b.WriteString("Scenarist_SCC V1.0\n")
+	for _, l := range sccLines {
+		words := make([]string, len(l.codes))
+		for i, code := range l.codes {
+			words[i] = fmt.Sprintf("%02x%02x", parity(code[0]), parity(code[1]))
+		}
+		fmt.Fprintf(b, "\n%s\t%s\n", dropFrameTimecode(l.frame), strings.Join(words, " "))
+	}
+	return b.Flush()
+}
+
+// sccWrap splits text into the rows of a caption
+func sccWrap(text string) []string {
+	rows := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		row := ""
+		for _, word := range strings.Fields(line) {
+			for len([]rune(word)) > sccColumns {
+				if row != "" {
+					rows = append(rows, row)
+					row = ""
+				}
+				r := []rune(word)
+				rows = append(rows, string(r[:sccColumns]))
+				word = string(r[sccColumns:])
+			}
+			switch {
+			case row == "":
+				row = word
+			case len([]rune(row))+1+len([]rune(word)) <= sccColumns:
+				row += " " + word
+			default:
+				rows = append(rows, row)
+				row = word
+			}
+		}
+		if row != "" {
+			rows = append(rows, row)
+		}
+	}
+	if len(rows) > sccRows {
+		rows = rows[len(rows)-sccRows:]
+	}
+	return rows
+}
+
+// sccText encodes a row as byte pairs, special characters take
+// a pair of their own so the pair before is padded if needed
+func sccText(row string) [][2]byte {
+	codes := [][2]byte{}
+	pending := []byte{}
+	flush := func() {
+		for i := 0; i < len(pending); i += 2 {
+			pair := [2]byte{pending[i], 0}
+			if i+1 < len(pending) {
+				pair[1] = pending[i+1]
+			}
+			codes = append(codes, pair)
+		}
+		pending = pending[:0]
+	}
+	for _, r := range row {
+		if b, ok := sccSpecial[r]; ok {
+			flush()
+			codes = append(codes, [2]byte{0x11, b})
+			continue
+		}
+		b, ok := sccBasic[r]
+		if !ok {
+			b = '?'
+			if r >= 0x20 && r < 0x7f && !strings.ContainsRune("*\\^_`{|}~", r) {
+				b = byte(r)
+			}
+		}
+		pending = append(pending, b)
+	}
+	flush()
+	return codes
+}
+
+// sccFrame returns the frame a time falls on
+func sccFrame(d time.Duration) int {
+	return int(math.Round(d.Seconds() * sccFrameRate))
+}
+
+// dropFrameTimecode formats a frame count as a 29.97 drop frame
+// timecode, where 2 frame numbers are skipped each minute
+// except every tenth
+func dropFrameTimecode(frame int) string {
+	tens := frame / 17982
+	rem := frame % 17982
+	skipped := 18 * tens
+	if rem >= 2 {
+		skipped += 2 * ((rem - 2) / 1798)
+	}
+	n := frame + skipped
+	return fmt.Sprintf("%02d:%02d:%02d;%02d", n/108000, n/1800%60, n/30%60, n%30)
+}
+
+// parity sets the top bit of a byte so it has an odd number of ones
+func parity(b byte) byte {
+	ones := 0
+	for v := b; v > 0; v >>= 1 {
+		ones += int(v & 1)
+	}
+	if ones%2 == 0 {
+		return b | 0x80
+	}
+	return b
+}
@@ -0,0 +1,107 @@
+package subtitle
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDropFrameTimecode(t *testing.T) {
+	tests := []struct {
+		frame int
+		want  string
+	}{
+		{0, "00:00:00;00"},
+		{29, "00:00:00;29"},
+		{1799, "00:00:59;29"},
+		// ;00 and ;01 are skipped at the start of each minute
+		{1800, "00:01:00;02"},
+		{3597, "00:01:59;29"},
+		{3598, "00:02:00;02"},
+		// apart from every tenth
+		{17981, "00:09:59;29"},
+		{17982, "00:10:00;00"},
+		{17984, "00:10:00;02"},
+		{19782, "00:11:00;02"},
+		{107892, "01:00:00;00"},
+	}
+	for _, tt := range tests {
+		if got := dropFrameTimecode(tt.frame); got != tt.want {
+			t.Errorf("dropFrameTimecode(%d) = %s, want %s", tt.frame, got, tt.want)
+		}
+	}
+}
+
+func TestParity(t *testing.T) {
+	tests := []struct {
+		b, want byte
+	}{
+		{0x00, 0x80},
+		{0x01, 0x01},
+		{0x03, 0x83},
+		{0x14, 0x94},
+		{0x20, 0x20},
+		{0x2f, 0x2f},
+		{0x2c, 0x2c},
+		{0x41, 0xc1},
+		{0x7f, 0x7f},
+	}
+	for _, tt := range tests {
+		if got := parity(tt.b); got != tt.want {
+			t.Errorf("parity(%#02x) = %#02x, want %#02x", tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSCCWrap(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Hello", []string{"Hello"}},
+		{"Two\nlines", []string{"Two", "lines"}},
+		{"a fairly long line which has to be wrapped onto another row",
+			[]string{"a fairly long line which has to", "be wrapped onto another row"}},
+		{strings.Repeat("x", 40), []string{strings.Repeat("x", 32), strings.Repeat("x", 8)}},
+		{"1\n2\n3\n4\n5", []string{"2", "3", "4", "5"}},
+	}
+	for _, tt := range tests {
+		if got := sccWrap(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sccWrap(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSCCText(t *testing.T) {
+	tests := []struct {
+		row  string
+		want [][2]byte
+	}{
+		{"Hi", [][2]byte{{'H', 'i'}}},
+		{"Odd", [][2]byte{{'O', 'd'}, {'d', 0}}},
+		{"é*", [][2]byte{{0x5c, '?'}}},
+		{"a♪b", [][2]byte{{'a', 0}, {0x11, 0x37}, {'b', 0}}},
+	}
+	for _, tt := range tests {
+		if got := sccText(tt.row); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sccText(%q) = %v, want %v", tt.row, got, tt.want)
+		}
+	}
+}
+
+func TestWriteSCC(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := Write(SCC, buf, []Cue{{Start: 2 * time.Second, End: 3 * time.Second, Text: "<b>Hi</b>"}})
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	// Loaded on row 15 in the 9 frames up to 60 so it's shown on it, then cleared at 90
+	want := "Scenarist_SCC V1.0\n" +
+		"\n00:00:01;22\t9420 9420 94ae 94ae 94e0 94e0 c8e9 942f 942f\n" +
+		"\n00:00:03;00\t942c 942c\n"
+	if buf.String() != want {
+		t.Errorf("Write = %q, want %q", buf.String(), want)
+	}
+}
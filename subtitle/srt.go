@@ -0,0 +1,111 @@
+package subtitle
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseSRT reads SubRip, numbered blocks of a timing line
+// and the text, separated by blank lines
+func parseSRT(data []byte) ([]Cue, error) {
+	cues := []Cue{}
+	ls := lines(data)
+	for i := 0; i < len(ls); i++ {
+		if strings.TrimSpace(ls[i]) == "" {
+			continue
+		}
+		// The number's optional in practice, so it's skipped if it's there
+		start := i + 1
+		if !strings.Contains(ls[i], "-->") {
+			if _, err := strconv.Atoi(strings.TrimSpace(ls[i])); err != nil {
+				return nil, &ParseError{SRT, i + 1, fmt.Sprintf("expected a cue number, got \"%s\"", ls[i])}
+			}
+			i++
+			if i == len(ls) {
+				return nil, &ParseError{SRT, start, "cue has no timing"}
+			}
+		}
+		c, err := parseTiming(SRT, ls[i], i+1, ",")
+		if err != nil {
+			return nil, err
+		}
+		text := []string{}
+		for i+1 < len(ls) && strings.TrimSpace(ls[i+1]) != "" {
+			i++
+			text = append(text, ls[i])
+		}
+		c.Text = strings.Join(text, "\n")
+		cues = append(cues, c)
+	}
+	return cues, nil
+}
+
+// parseTiming reads a "start --> end" line, anything after the end
+// time is ignored, i.e. WebVTT's cue settings
+func parseTiming(format Format, line string, n int, fracSep string) (Cue, error) {
+	parts := strings.SplitN(line, "-->", 2)
+	if len(parts) != 2 {
+		return Cue{}, &ParseError{format, n, fmt.Sprintf("expected a timing line, got \"%s\"", line)}
+	}
+	end := strings.Fields(parts[1])
+	if len(end) == 0 {
+		return Cue{}, &ParseError{format, n, "missing end time"}
+	}
+	var err error
+	c := Cue{}
+	c.Start, err = parseClock(strings.TrimSpace(parts[0]), fracSep)
+	if err != nil {
+		return Cue{}, &ParseError{format, n, err.Error()}
+	}
+	c.End, err = parseClock(end[0], fracSep)
+	if err != nil {
+		return Cue{}, &ParseError{format, n, err.Error()}
+	}
+	if err := checkCue(format, n, c); err != nil {
+		return Cue{}, err
+	}
+	return c, nil
+}
+
+// parseClock reads HH:MM:SS or MM:SS, with milliseconds after fracSep
+func parseClock(s, fracSep string) (time.Duration, error) {
+	whole, frac := s, ""
+	if i := strings.LastIndex(s, fracSep); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	fields := strings.Split(whole, ":")
+	if len(fields) < 2 || len(fields) > 3 || len(frac) > 3 {
+		return 0, fmt.Errorf("invalid time \"%s\"", s)
+	}
+	d := time.Duration(0)
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		// Hours can be any length, minutes and seconds are two digits
+		if err != nil || n < 0 || (i > 0 && (len(f) != 2 || n > 59)) {
+			return 0, fmt.Errorf("invalid time \"%s\"", s)
+		}
+		d = d*60 + time.Duration(n)
+	}
+	d *= time.Second
+	if frac != "" {
+		ms, err := strconv.Atoi(frac + strings.Repeat("0", 3-len(frac)))
+		if err != nil || ms < 0 {
+			return 0, fmt.Errorf("invalid time \"%s\"", s)
+		}
+		d += time.Duration(ms) * time.Millisecond
+	}
+	return d, nil
+}
+
+// writeSRT writes SubRip
+func writeSRT(w io.Writer, cues []Cue) error {
+	b := bufio.NewWriter(w)
+	for i, c := range cues {
+		fmt.Fprintf(b, "%d\n%s --> %s\n%s\n\n", i+1, formatClock(c.Start, ","), formatClock(c.End, ","), c.Text)
+	}
+	return b.Flush()
+}
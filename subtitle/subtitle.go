@@ -0,0 +1,183 @@
+// Package subtitle reads and writes caption files
+package subtitle
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Format is a caption file format
+type Format string
+
+const (
+	SRT    Format = "srt"
+	WebVTT Format = "vtt"
+	TTML   Format = "ttml"
+	SCC    Format = "scc" // Scenarist, CEA-608 captions
+)
+
+// extensions are the file extensions of each format
+var extensions = map[string]Format{
+	".srt":  SRT,
+	".vtt":  WebVTT,
+	".ttml": TTML,
+	".dfxp": TTML,
+	".xml":  TTML,
+	".scc":  SCC,
+}
+
+type (
+	// Cue is a caption shown from Start until End
+	Cue struct {
+		Start time.Duration
+		End   time.Duration
+		Text  string // Lines are separated by \n
+	}
+	// ParseError is why a caption file couldn't be read
+	ParseError struct {
+		Format Format
+		Line   int // 0 when it isn't about a particular line
+		Msg    string
+	}
+)
+
+func (e *ParseError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("invalid %s: %s", e.Format, e.Msg)
+	}
+	return fmt.Sprintf("invalid %s: line %d: %s", e.Format, e.Line, e.Msg)
+}
+
+// ParseFormat checks a format's name, the extensions are accepted too
+func ParseFormat(name string) (Format, error) {
+	f := Format(strings.TrimPrefix(strings.ToLower(name), "."))
+	switch f {
+	case SRT, WebVTT, TTML, SCC:
+		return f, nil
+	case "webvtt":
+		return WebVTT, nil
+	case "dfxp", "xml":
+		return TTML, nil
+	}
+	return "", fmt.Errorf("unknown subtitle format \"%s\"", name)
+}
+
+// FormatOf returns the format of a file going by its extension
+func FormatOf(name string) (Format, bool) {
+	f, ok := extensions[strings.ToLower(path.Ext(name))]
+	return f, ok
+}
+
+// Detect works out the format of a caption file from its contents
+func Detect(data []byte) (Format, bool) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("WEBVTT")):
+		return WebVTT, true
+	case bytes.HasPrefix(trimmed, []byte("Scenarist_SCC")):
+		return SCC, true
+	case bytes.HasPrefix(trimmed, []byte("<")) && bytes.Contains(data, []byte("<tt")):
+		return TTML, true
+	case bytes.Contains(data, []byte("-->")):
+		return SRT, true
+	}
+	return "", false
+}
+
+// Parse reads the cues of a caption file. SCC files hold CEA-608
+// commands rather than text, so have to be decoded by ffmpeg first.
+func Parse(format Format, r io.Reader) ([]Cue, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read captions: %w", err)
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	var cues []Cue
+	switch format {
+	case SRT:
+		cues, err = parseSRT(data)
+	case WebVTT:
+		cues, err = parseVTT(data)
+	case TTML:
+		cues, err = parseTTML(data)
+	default:
+		return nil, fmt.Errorf("can't parse %s captions", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cues, nil
+}
+
+// Write writes cues out as a caption file
+func Write(format Format, w io.Writer, cues []Cue) error {
+	switch format {
+	case SRT:
+		return writeSRT(w, cues)
+	case WebVTT:
+		return writeVTT(w, cues)
+	case TTML:
+		return writeTTML(w, cues)
+	case SCC:
+		return writeSCC(w, cues)
+	}
+	return fmt.Errorf("can't write %s captions", format)
+}
+
+// Shift moves every cue by offset, dropping the ones which
+// would end up before the start
+func Shift(cues []Cue, offset time.Duration) []Cue {
+	shifted := make([]Cue, 0, len(cues))
+	for _, c := range cues {
+		c.Start += offset
+		c.End += offset
+		if c.End <= 0 {
+			continue
+		}
+		if c.Start < 0 {
+			c.Start = 0
+		}
+		shifted = append(shifted, c)
+	}
+	return shifted
+}
+
+// Duration returns when the last cue ends
+func Duration(cues []Cue) time.Duration {
+	end := time.Duration(0)
+	for _, c := range cues {
+		if c.End > end {
+			end = c.End
+		}
+	}
+	return end
+}
+
+// lines splits a file into lines, whatever they end with
+func lines(data []byte) []string {
+	s := strings.ReplaceAll(string(data), "\r\n", "\n")
+	return strings.Split(strings.ReplaceAll(s, "\r", "\n"), "\n")
+}
+
+// checkCue makes sure a cue's timing makes sense
+func checkCue(format Format, line int, c Cue) error {
+	if c.Start < 0 {
+		return &ParseError{format, line, "cue starts before 0"}
+	}
+	if c.End <= c.Start {
+		return &ParseError{format, line, "cue ends before it starts"}
+	}
+	return nil
+}
+
+// formatClock writes a time as HH:MM:SS followed by sep and milliseconds
+func formatClock(d time.Duration, sep string) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
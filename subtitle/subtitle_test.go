@@ -0,0 +1,189 @@
+package subtitle
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cues used for the round trips, with the things each format has to
+// keep: multiple lines, hours and milliseconds
+var roundTripCues = []Cue{
+	{Start: 1 * time.Second, End: 2500 * time.Millisecond, Text: "Hello"},
+	{Start: 3 * time.Second, End: 4 * time.Second, Text: "Two\nlines"},
+	{Start: time.Hour + 2*time.Minute + 3*time.Second + 45*time.Millisecond,
+		End: time.Hour + 2*time.Minute + 5*time.Second, Text: "Fish & chips < 5"},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []Format{SRT, WebVTT, TTML} {
+		buf := &bytes.Buffer{}
+		if err := Write(format, buf, roundTripCues); err != nil {
+			t.Fatalf("%s: Write: %v", format, err)
+		}
+		if got, ok := Detect(buf.Bytes()); !ok || got != format {
+			t.Errorf("%s: Detect = %q, %t", format, got, ok)
+		}
+		cues, err := Parse(format, buf)
+		if err != nil {
+			t.Fatalf("%s: Parse: %v", format, err)
+		}
+		if !reflect.DeepEqual(cues, roundTripCues) {
+			t.Errorf("%s: round trip = %+v, want %+v", format, cues, roundTripCues)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		data   string
+		want   []Cue
+	}{
+		{
+			name:   "srt without numbers and with crlf",
+			format: SRT,
+			data:   "\xef\xbb\xbf00:00:01,000 --> 00:00:02,000\r\n<i>Hi</i>\r\n\r\n00:00:03,5 --> 00:00:04,000\r\nThere\r\n",
+			want: []Cue{
+				{Start: time.Second, End: 2 * time.Second, Text: "<i>Hi</i>"},
+				{Start: 3500 * time.Millisecond, End: 4 * time.Second, Text: "There"},
+			},
+		},
+		{
+			name:   "vtt with a header, notes, identifiers and settings",
+			format: WebVTT,
+			data: "WEBVTT - A title\nKind: captions\n\nNOTE a comment\nover two lines\n\nSTYLE\n::cue { color: red }\n\n" +
+				"intro\n00:01.000 --> 00:02.000 align:start\nHi\n\n01:00:00.000 --> 01:00:01.000\nThere\n",
+			want: []Cue{
+				{Start: time.Second, End: 2 * time.Second, Text: "Hi"},
+				{Start: time.Hour, End: time.Hour + time.Second, Text: "There"},
+			},
+		},
+		{
+			name:   "ttml with frames, ticks, dur and line breaks",
+			format: TTML,
+			data: `<?xml version="1.0" encoding="UTF-8"?>
+<tt xmlns="http://www.w3.org/ns/ttml" xmlns:ttp="http://www.w3.org/ns/ttml#parameter"
+    ttp:frameRate="25" ttp:tickRate="10000000">
+  <body><div>
+    <p begin="00:00:01:05" end="00:00:02.500">Hello
+      <span>there</span><br/>world</p>
+    <p begin="30000000t" dur="1.5s">Ticks</p>
+    <p begin="50f" end="2m">Frames</p>
+  </div></body>
+</tt>`,
+			want: []Cue{
+				{Start: 1200 * time.Millisecond, End: 2500 * time.Millisecond, Text: "Hello there\nworld"},
+				{Start: 3 * time.Second, End: 4500 * time.Millisecond, Text: "Ticks"},
+				{Start: 2 * time.Second, End: 2 * time.Minute, Text: "Frames"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.format, strings.NewReader(tt.data))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		data   string
+		line   int
+		msg    string
+	}{
+		{"srt text without a number", SRT, "1\n00:00:01,000 --> 00:00:02,000\nHi\n\nabc\n", 5, "expected a cue number"},
+		{"srt number without timing", SRT, "1", 1, "cue has no timing"},
+		{"srt bad timing line", SRT, "1\n00:00:01,000\n", 2, "expected a timing line"},
+		{"srt missing end", SRT, "1\n00:00:01,000 -->\n", 2, "missing end time"},
+		{"srt bad seconds", SRT, "1\n00:00:61,000 --> 00:01:02,000\n", 2, "invalid time"},
+		{"srt too many decimals", SRT, "1\n00:00:01,0000 --> 00:00:02,000\n", 2, "invalid time"},
+		{"srt ends before it starts", SRT, "1\n00:00:02,000 --> 00:00:01,000\nHi\n", 2, "cue ends before it starts"},
+		{"vtt missing header", WebVTT, "00:01.000 --> 00:02.000\nHi\n", 1, "missing WEBVTT header"},
+		{"vtt header run on", WebVTT, "WEBVTTX\n", 1, "missing WEBVTT header"},
+		{"vtt identifier without timing", WebVTT, "WEBVTT\n\nintro\n", 3, "cue has no timing"},
+		{"vtt srt style comma", WebVTT, "WEBVTT\n\n\n00:00:01,000 --> 00:00:02,000\n", 4, "invalid time"},
+		{"vtt ends before it starts", WebVTT, "WEBVTT\n\n00:02.000 --> 00:01.000\nHi\n", 3, "cue ends before it starts"},
+		{"ttml missing tt", TTML, "<div><p begin=\"1s\" end=\"2s\">Hi</p></div>", 0, "missing tt element"},
+		{"ttml missing end", TTML, "<tt>\n<body>\n<p begin=\"1s\">Hi</p>\n</body>\n</tt>", 3, "paragraph needs begin"},
+		{"ttml bad time", TTML, "<tt>\n<p begin=\"1s\" end=\"soon\">Hi</p>\n</tt>", 2, "invalid time"},
+		{"ttml nested paragraphs", TTML, "<tt>\n<p begin=\"1s\" end=\"2s\">\n<p begin=\"1s\" end=\"2s\">Hi</p></p>\n</tt>", 3, "can't be nested"},
+		{"ttml ends before it starts", TTML, "<tt>\n\n<p begin=\"2s\" end=\"1s\">Hi</p>\n</tt>", 3, "cue ends before it starts"},
+		{"ttml mismatched tags", TTML, "<tt>\n<p begin=\"1s\" end=\"2s\">Hi</b>\n</tt>", 2, "closed by"},
+		{"ttml bad frame rate", TTML, "<tt xmlns:ttp=\"http://www.w3.org/ns/ttml#parameter\" ttp:frameRate=\"0\">\n</tt>", 1, "have to be positive"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.format, strings.NewReader(tt.data))
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("%s: got %v, want a ParseError", tt.name, err)
+			continue
+		}
+		if perr.Format != tt.format || perr.Line != tt.line || !strings.Contains(perr.Msg, tt.msg) {
+			t.Errorf("%s: got %s line %d %q, want %s line %d containing %q",
+				tt.name, perr.Format, perr.Line, perr.Msg, tt.format, tt.line, tt.msg)
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		data string
+		want Format
+		ok   bool
+	}{
+		{"\xef\xbb\xbfWEBVTT\n\n", WebVTT, true},
+		{"Scenarist_SCC V1.0\n", SCC, true},
+		{"<?xml version=\"1.0\"?>\n<tt xmlns=\"http://www.w3.org/ns/ttml\">", TTML, true},
+		{"1\n00:00:01,000 --> 00:00:02,000\n", SRT, true},
+		{"just some text", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := Detect([]byte(tt.data))
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Detect(%q) = %q, %t, want %q, %t", tt.data, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestShift(t *testing.T) {
+	cues := []Cue{
+		{Start: 1 * time.Second, End: 2 * time.Second, Text: "gone"},
+		{Start: 2 * time.Second, End: 4 * time.Second, Text: "clipped"},
+		{Start: 5 * time.Second, End: 6 * time.Second, Text: "moved"},
+	}
+	want := []Cue{
+		{Start: 0, End: time.Second, Text: "clipped"},
+		{Start: 2 * time.Second, End: 3 * time.Second, Text: "moved"},
+	}
+	if got := Shift(cues, -3*time.Second); !reflect.DeepEqual(got, want) {
+		t.Errorf("Shift = %+v, want %+v", got, want)
+	}
+}
+
+func TestWriteHLSVTT(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := WriteHLSVTT(buf, roundTripCues[:1], 126000); err != nil {
+		t.Fatalf("WriteHLSVTT: %v", err)
+	}
+	want := "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:126000,LOCAL:00:00:00.000\n\n00:00:01.000 --> 00:00:02.500\nHello\n\n"
+	if buf.String() != want {
+		t.Errorf("WriteHLSVTT = %q, want %q", buf.String(), want)
+	}
+	// The map's part of the header so is skipped when it's read back
+	cues, err := Parse(WebVTT, buf)
+	if err != nil || !reflect.DeepEqual(cues, roundTripCues[:1]) {
+		t.Errorf("Parse = %+v, %v, want %+v", cues, err, roundTripCues[:1])
+	}
+}
@@ -0,0 +1,255 @@
+package subtitle
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ttmlParameters is the namespace of TTML's timing parameters
+const ttmlParameters = "http://www.w3.org/ns/ttml#parameter"
+
+var (
+	// ttmlClock matches HH:MM:SS with a fraction or a frame count
+	ttmlClock = regexp.MustCompile(`^(\d{2,}):(\d{2}):(\d{2})(?:(\.\d+)|:(\d{2,})(?:\.\d+)?)?$`)
+	// ttmlOffset matches an offset, i.e. "1.5s" or "40f"
+	ttmlOffset = regexp.MustCompile(`^(\d+(?:\.\d+)?)(h|m|s|ms|f|t)$`)
+	// tagPattern matches the tags of SRT and WebVTT text
+	tagPattern = regexp.MustCompile(`<[^>]*>`)
+	// spacePattern matches the whitespace TTML collapses
+	spacePattern = regexp.MustCompile(`[ \t\n\r]+`)
+)
+
+// ttmlTiming is how a TTML document counts frames and ticks
+type ttmlTiming struct {
+	frameRate float64
+	tickRate  float64
+}
+
+// parseTTML reads the timed paragraphs of a TTML or DFXP document.
+// Timing given on the body or divs rather than the paragraphs
+// isn't supported.
+func parseTTML(data []byte) ([]Cue, error) {
+	lineAt := func(offset int64) int {
+		return bytes.Count(data[:offset], []byte("\n")) + 1
+	}
+	d := xml.NewDecoder(bytes.NewReader(data))
+	timing := ttmlTiming{frameRate: 30, tickRate: 1}
+	cues := []Cue{}
+	var cur *Cue
+	text := &strings.Builder{}
+	sawRoot := false
+	for {
+		offset := d.InputOffset()
+		tok, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			var syntax *xml.SyntaxError
+			if errors.As(err, &syntax) {
+				return nil, &ParseError{TTML, syntax.Line, syntax.Msg}
+			}
+			return nil, &ParseError{TTML, lineAt(offset), err.Error()}
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			switch tok.Name.Local {
+			case "tt":
+				sawRoot = true
+				timing, err = readTTMLTiming(tok.Attr)
+				if err != nil {
+					return nil, &ParseError{TTML, lineAt(offset), err.Error()}
+				}
+			case "p":
+				if cur != nil {
+					return nil, &ParseError{TTML, lineAt(offset), "paragraphs can't be nested"}
+				}
+				c, err := timing.cue(tok.Attr)
+				if err != nil {
+					return nil, &ParseError{TTML, lineAt(offset), err.Error()}
+				}
+				if err := checkCue(TTML, lineAt(offset), c); err != nil {
+					return nil, err
+				}
+				cur = &c
+				text.Reset()
+			case "br":
+				if cur != nil {
+					text.WriteString("\n")
+				}
+			}
+		case xml.EndElement:
+			if tok.Name.Local == "p" && cur != nil {
+				cur.Text = collapseTTML(text.String())
+				cues = append(cues, *cur)
+				cur = nil
+			}
+		case xml.CharData:
+			if cur != nil {
+				// Line breaks in the markup are just whitespace
+				text.WriteString(spacePattern.ReplaceAllString(string(tok), " "))
+			}
+		}
+	}
+	if !sawRoot {
+		return nil, &ParseError{TTML, 0, "missing tt element"}
+	}
+	return cues, nil
+}
+
+// readTTMLTiming reads the frame and tick rates from the tt element
+func readTTMLTiming(attrs []xml.Attr) (ttmlTiming, error) {
+	t := ttmlTiming{frameRate: 30, tickRate: 1}
+	multiplier := 1.0
+	for _, a := range attrs {
+		if a.Name.Space != ttmlParameters {
+			continue
+		}
+		var err error
+		switch a.Name.Local {
+		case "frameRate":
+			t.frameRate, err = strconv.ParseFloat(a.Value, 64)
+		case "tickRate":
+			t.tickRate, err = strconv.ParseFloat(a.Value, 64)
+		case "frameRateMultiplier":
+			// "1000 1001" for 29.97
+			f := strings.Fields(a.Value)
+			if len(f) != 2 {
+				return t, fmt.Errorf("invalid frameRateMultiplier \"%s\"", a.Value)
+			}
+			num, err1 := strconv.ParseFloat(f[0], 64)
+			den, err2 := strconv.ParseFloat(f[1], 64)
+			if err1 != nil || err2 != nil || den == 0 {
+				return t, fmt.Errorf("invalid frameRateMultiplier \"%s\"", a.Value)
+			}
+			multiplier = num / den
+		}
+		if err != nil {
+			return t, fmt.Errorf("invalid %s \"%s\"", a.Name.Local, a.Value)
+		}
+	}
+	if t.frameRate <= 0 || t.tickRate <= 0 {
+		return t, fmt.Errorf("frameRate and tickRate have to be positive")
+	}
+	t.frameRate *= multiplier
+	return t, nil
+}
+
+// cue reads a paragraph's begin, end and dur
+func (t ttmlTiming) cue(attrs []xml.Attr) (Cue, error) {
+	c := Cue{}
+	var begin, end, dur string
+	for _, a := range attrs {
+		switch a.Name.Local {
+		case "begin":
+			begin = a.Value
+		case "end":
+			end = a.Value
+		case "dur":
+			dur = a.Value
+		}
+	}
+	if begin == "" || (end == "" && dur == "") {
+		return c, fmt.Errorf("paragraph needs begin and either end or dur")
+	}
+	var err error
+	c.Start, err = t.parse(begin)
+	if err != nil {
+		return c, err
+	}
+	if end != "" {
+		c.End, err = t.parse(end)
+	} else {
+		c.End, err = t.parse(dur)
+		c.End += c.Start
+	}
+	return c, err
+}
+
+// parse reads a clock time or an offset
+func (t ttmlTiming) parse(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	seconds := 0.0
+	if m := ttmlClock.FindStringSubmatch(s); m != nil {
+		h, _ := strconv.ParseFloat(m[1], 64)
+		mins, _ := strconv.ParseFloat(m[2], 64)
+		sec, _ := strconv.ParseFloat(m[3], 64)
+		if mins > 59 || sec > 60 {
+			return 0, fmt.Errorf("invalid time \"%s\"", s)
+		}
+		seconds = h*3600 + mins*60 + sec
+		if m[4] != "" {
+			frac, _ := strconv.ParseFloat(m[4], 64)
+			seconds += frac
+		}
+		if m[5] != "" {
+			frames, _ := strconv.ParseFloat(m[5], 64)
+			seconds += frames / t.frameRate
+		}
+	} else if m := ttmlOffset.FindStringSubmatch(s); m != nil {
+		n, _ := strconv.ParseFloat(m[1], 64)
+		switch m[2] {
+		case "h":
+			seconds = n * 3600
+		case "m":
+			seconds = n * 60
+		case "s":
+			seconds = n
+		case "ms":
+			seconds = n / 1000
+		case "f":
+			seconds = n / t.frameRate
+		case "t":
+			seconds = n / t.tickRate
+		}
+	} else {
+		return 0, fmt.Errorf("invalid time \"%s\"", s)
+	}
+	return time.Duration(math.Round(seconds*1000)) * time.Millisecond, nil
+}
+
+// collapseTTML collapses whitespace the way TTML displays it,
+// keeping the line breaks from <br/>
+func collapseTTML(s string) string {
+	ls := strings.Split(s, "\n")
+	for i, l := range ls {
+		ls[i] = strings.TrimSpace(spacePattern.ReplaceAllString(l, " "))
+	}
+	return strings.Join(ls, "\n")
+}
+
+// plainText removes the tags and entities from SRT and WebVTT text
+func plainText(s string) string {
+	return html.UnescapeString(tagPattern.ReplaceAllString(s, ""))
+}
+
+// writeTTML writes a TTML document, the text is written without
+// the formatting tags SRT and WebVTT might have
+func writeTTML(w io.Writer, cues []Cue) error {
+	b := bufio.NewWriter(w)
+	b.WriteString(xml.Header)
+	b.WriteString("<tt xmlns=\"http://www.w3.org/ns/ttml\" xml:lang=\"\">\n  <body>\n    <div>\n")
+	for _, c := range cues {
+		ls := strings.Split(plainText(c.Text), "\n")
+		for i, l := range ls {
+			e := &strings.Builder{}
+			xml.EscapeText(e, []byte(l))
+			ls[i] = e.String()
+		}
+		fmt.Fprintf(b, "      <p begin=\"%s\" end=\"%s\">%s</p>\n",
+			formatClock(c.Start, "."), formatClock(c.End, "."), strings.Join(ls, "<br/>"))
+	}
+	b.WriteString("    </div>\n  </body>\n</tt>\n")
+	return b.Flush()
+}
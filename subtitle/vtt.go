@@ -0,0 +1,74 @@
+package subtitle
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// parseVTT reads WebVTT, cues with an optional identifier
+// before their timing. Notes, styles and regions are skipped.
+func parseVTT(data []byte) ([]Cue, error) {
+	ls := lines(data)
+	if !strings.HasPrefix(ls[0], "WEBVTT") || (len(ls[0]) > 6 && ls[0][6] != ' ' && ls[0][6] != '\t') {
+		return nil, &ParseError{WebVTT, 1, "missing WEBVTT header"}
+	}
+	// The header can run on until the first blank line
+	i := 1
+	for i < len(ls) && strings.TrimSpace(ls[i]) != "" {
+		i++
+	}
+
+	cues := []Cue{}
+	for ; i < len(ls); i++ {
+		if strings.TrimSpace(ls[i]) == "" {
+			continue
+		}
+		block := i
+		for i+1 < len(ls) && strings.TrimSpace(ls[i+1]) != "" {
+			i++
+		}
+		first := ls[block]
+		if first == "NOTE" || strings.HasPrefix(first, "NOTE ") || strings.HasPrefix(first, "NOTE\t") ||
+			first == "STYLE" || first == "REGION" {
+			continue
+		}
+		timing := block
+		if !strings.Contains(first, "-->") {
+			timing++
+			if timing > i {
+				return nil, &ParseError{WebVTT, block + 1, "cue has no timing"}
+			}
+		}
+		c, err := parseTiming(WebVTT, ls[timing], timing+1, ".")
+		if err != nil {
+			return nil, err
+		}
+		c.Text = strings.Join(ls[timing+1:i+1], "\n")
+		cues = append(cues, c)
+	}
+	return cues, nil
+}
+
+// writeVTT writes WebVTT
+func writeVTT(w io.Writer, cues []Cue) error {
+	return writeVTTWithHeader(w, "WEBVTT", cues)
+}
+
+// WriteHLSVTT writes WebVTT for an HLS rendition, with an X-TIMESTAMP-MAP
+// putting the cues' 0 at mpegts, the first timestamp of the video's
+// segments in 90kHz ticks
+func WriteHLSVTT(w io.Writer, cues []Cue, mpegts int64) error {
+	return writeVTTWithHeader(w, fmt.Sprintf("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000", mpegts), cues)
+}
+
+// writeVTTWithHeader writes WebVTT with the header it's given
+func writeVTTWithHeader(w io.Writer, header string, cues []Cue) error {
+	b := bufio.NewWriter(w)
+	b.WriteString(header + "\n\n")
+	for _, c := range cues {
+		fmt.Fprintf(b, "%s --> %s\n%s\n\n", formatClock(c.Start, "."), formatClock(c.End, "."), c.Text)
+	}
+	return b.Flush()
+}
@@ -0,0 +1,470 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const TypeAudioExtract string = "audio/extract"
+
+// Defaults for loudness normalisation, the usual targets for podcasts
+const (
+	defaultIntegratedLoudness = -16.0 // LUFS
+	defaultTruePeak           = -1.5  // dBTP
+	defaultLoudnessRange      = 11.0  // LU
+)
+
+// audioCodec is how an audio rendition's encoded
+type audioCodec struct {
+	encoder string
+	bitrate string // Default
+}
+
+var (
+	audioCodecs = map[string]audioCodec{
+		"mp3":  {"libmp3lame", "128k"},
+		"aac":  {"aac", "128k"},
+		"opus": {"libopus", "96k"},
+	}
+	// audioExtensions are the codecs renditions default to
+	audioExtensions = map[string]string{
+		".mp3":  "mp3",
+		".m4a":  "aac",
+		".mp4":  "aac",
+		".aac":  "aac",
+		".opus": "opus",
+		".ogg":  "opus",
+	}
+	// coverExtensions are the containers which can hold cover art
+	coverExtensions = map[string]bool{".mp3": true, ".m4a": true, ".mp4": true}
+	// channelLayouts are what audio can be downmixed to
+	channelLayouts = map[int]string{1: "mono", 2: "stereo"}
+
+	// audioBitratePattern matches a bitrate, i.e. "128k"
+	audioBitratePattern = regexp.MustCompile(`^\d+(\.\d+)?[kKmM]?$`)
+	// metadataKeyPattern matches the names of tags, i.e. "title"
+	metadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+	// metadataEscapes are the characters escaped in ffmetadata files
+	metadataEscapes = strings.NewReplacer(`\`, `\\`, `=`, `\=`, `;`, `\;`, `#`, `\#`, "\n", "\\\n")
+)
+
+var _ Task = &AudioExtract{}
+
+type (
+	// AudioRendition is an encode of the extracted audio
+	AudioRendition struct {
+		DstURL string `json:"dstURL"`
+		// "mp3", "aac" or "opus", defaults to dstURL's extension
+		Codec   string `json:"codec,omitempty"`
+		Bitrate string `json:"bitrate,omitempty"` // i.e. "128k"
+	}
+	// Loudness is what audio is normalised to, following EBU R128
+	Loudness struct {
+		Integrated float64 `json:"integrated,omitempty"` // LUFS, defaults to -16
+		TruePeak   float64 `json:"truePeak,omitempty"`   // dBTP, defaults to -1.5
+		Range      float64 `json:"range,omitempty"`      // LU, defaults to 11
+	}
+	// AudioExtract task pulls the audio out of a source into
+	// renditions with tags and cover art, i.e. for a podcast
+	AudioExtract struct {
+		TaskID string `json:"taskID"`
+		SrcURL string `json:"srcURL"`
+		// Index of the source's audio track, from 0
+		Track      int              `json:"track,omitempty"`
+		Renditions []AudioRendition `json:"renditions"`
+		// Downmixed to 1 or 2 channels, 0 keeps the source's
+		Channels int `json:"channels,omitempty"`
+		// Hz, 0 keeps the source's
+		SampleRate int       `json:"sampleRate,omitempty"`
+		Loudness   *Loudness `json:"loudness,omitempty"`
+		// Tags, i.e. "title", "artist", "album", "date" and "comment"
+		Metadata map[string]string `json:"metadata,omitempty"`
+		// JPEG or PNG added to MP3 and M4A renditions, see Storage
+		CoverURL string `json:"coverURL,omitempty"`
+		Download bool   `json:"download"`
+		// Worker capabilities the job needs
+		Requires []string `json:"requires,omitempty"`
+		// Maximum seconds the job can run for, 0 uses the worker's limit
+		Timeout int `json:"timeout,omitempty"`
+		// Checks each rendition has to pass before it's uploaded
+		Verify VerifyOptions `json:"verify"`
+
+		status    Status
+		stats     *Stats
+		ffmpegLog *FFmpegLog
+
+		// dependencies
+		env *Env
+	}
+	// loudnormStats are what loudnorm measured in its first pass
+	loudnormStats struct {
+		InputI      string `json:"input_i"`
+		InputTP     string `json:"input_tp"`
+		InputLRA    string `json:"input_lra"`
+		InputThresh string `json:"input_thresh"`
+		Offset      string `json:"target_offset"`
+	}
+)
+
+// Validate checks the targets make sense, filling in their defaults
+func (l *Loudness) Validate() error {
+	if l.Integrated == 0 {
+		l.Integrated = defaultIntegratedLoudness
+	}
+	if l.TruePeak == 0 {
+		l.TruePeak = defaultTruePeak
+	}
+	if l.Range == 0 {
+		l.Range = defaultLoudnessRange
+	}
+	// loudnorm's limits
+	if l.Integrated < -70 || l.Integrated > -5 {
+		return fmt.Errorf("loudness integrated has to be between -70 and -5")
+	}
+	if l.TruePeak < -9 || l.TruePeak > 0 {
+		return fmt.Errorf("loudness truePeak has to be between -9 and 0")
+	}
+	if l.Range < 1 || l.Range > 20 {
+		return fmt.Errorf("loudness range has to be between 1 and 20")
+	}
+	return nil
+}
+
+// NewAudioExtract initialises an AudioExtract task object
+// so we can add the tasks dependencies
+func NewAudioExtract(env *Env) AudioExtract {
+	return AudioExtract{
+		stats: &Stats{},
+		env:   env,
+	}
+}
+
+// GetID returns a task ID
+func (t *AudioExtract) GetID() string {
+	return t.TaskID
+}
+
+// GetType returns the task's type
+func (t *AudioExtract) GetType() string {
+	return TypeAudioExtract
+}
+
+// GetTimeout returns the job's maximum runtime
+func (t *AudioExtract) GetTimeout() time.Duration {
+	return time.Duration(t.Timeout) * time.Second
+}
+
+// GetStatus returns the task's status
+func (t *AudioExtract) GetStatus() Status {
+	t.status.TaskID = t.TaskID
+	if t.stats != nil {
+		t.status.Stats = *t.stats
+	}
+	return t.status
+}
+
+// ValidateRequest checks the request, the renditions' encoders
+// are added to the job's requirements
+func (t *AudioExtract) ValidateRequest() error {
+	if t.SrcURL == "" {
+		return fmt.Errorf("missing srcURL")
+	}
+	if len(t.Renditions) == 0 {
+		return fmt.Errorf("missing renditions")
+	}
+	if err := validateStorageURL(t.SrcURL); err != nil {
+		return fmt.Errorf("invalid srcURL: %w", err)
+	}
+	for i := range t.Renditions {
+		r := &t.Renditions[i]
+		if err := validateStorageURL(r.DstURL); err != nil {
+			return fmt.Errorf("invalid renditions[%d] dstURL: %w", i, err)
+		}
+		if r.Codec == "" {
+			r.Codec = audioExtensions[strings.ToLower(path.Ext(r.DstURL))]
+		}
+		codec, ok := audioCodecs[r.Codec]
+		if !ok {
+			return fmt.Errorf("renditions[%d] codec has to be \"mp3\", \"aac\" or \"opus\"", i)
+		}
+		if r.Bitrate == "" {
+			r.Bitrate = codec.bitrate
+		}
+		if !audioBitratePattern.MatchString(r.Bitrate) {
+			return fmt.Errorf("invalid renditions[%d] bitrate \"%s\"", i, r.Bitrate)
+		}
+		t.Requires = addRequirement(t.Requires, RequireEncoder+":"+codec.encoder)
+	}
+	if t.Track < 0 || t.SampleRate < 0 {
+		return fmt.Errorf("track and sampleRate can't be negative")
+	}
+	if _, ok := channelLayouts[t.Channels]; t.Channels != 0 && !ok {
+		return fmt.Errorf("channels has to be 1 or 2")
+	}
+	if t.Loudness != nil {
+		if err := t.Loudness.Validate(); err != nil {
+			return err
+		}
+		t.Requires = addRequirement(t.Requires, RequireFilter+":loudnorm")
+	}
+	for k := range t.Metadata {
+		if !metadataKeyPattern.MatchString(k) {
+			return fmt.Errorf("invalid metadata key \"%s\"", k)
+		}
+	}
+	if t.CoverURL != "" {
+		if err := validateStorageURL(t.CoverURL); err != nil {
+			return fmt.Errorf("invalid coverURL: %w", err)
+		}
+	}
+	if err := t.Verify.Validate(); err != nil {
+		return err
+	}
+	if err := ValidateRequirements(t.Requires); err != nil {
+		return err
+	}
+	t.TaskID = uuid.NewString()
+	return nil
+}
+
+// Start normalises the source's audio, encodes it to every
+// rendition at once, then uploads them
+func (t *AudioExtract) Start(ctx context.Context) error {
+	t.status.Stage = StageStarted
+	t.status.StageStart = time.Now()
+
+	dsts := make([]*url.URL, len(t.Renditions))
+	backends := make([]Backend, len(t.Renditions))
+	for i, r := range t.Renditions {
+		b, dst, err := t.env.Store.Resolve(r.DstURL)
+		if err != nil {
+			return NewError(ErrorInvalidArgs, false, fmt.Errorf("failed to resolve renditions[%d] destination: %w", i, err))
+		}
+		backends[i], dsts[i] = b, dst
+	}
+	ws, err := t.env.Workspaces.Create(t.TaskID)
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer ws.Remove()
+	t.ffmpegLog, err = newFFmpegLog(ws.Path("ffmpeg.log"))
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	// The log goes alongside the first rendition
+	defer finishLog(ctx, t.ffmpegLog, backends[0], withSuffix(dsts[0], ".log"), &t.status)
+
+	input, release, err := openSource(ctx, t.env, t.SrcURL, t.Download, &t.status)
+	if err != nil {
+		return err
+	}
+	defer release()
+	srcInfo, err := probe(ctx, t.env.FFprobe, input)
+	if err != nil {
+		return inputError(err)
+	}
+	audio, ok := srcInfo.NthStream("audio", t.Track)
+	if !ok {
+		return NewError(ErrorInvalidArgs, false, fmt.Errorf("source doesn't have audio track %d", t.Track))
+	}
+
+	filters, err := t.audioFilters(ctx, input, audio)
+	if err != nil {
+		return err
+	}
+
+	// Inputs after the source are the cover and the tags
+	inputArgs := fmt.Sprintf("-i \"%s\" ", input)
+	cover, metadataInput := -1, 1
+	if t.CoverURL != "" {
+		coverPath, release, err := openSource(ctx, t.env, t.CoverURL, true, &t.status)
+		if err != nil {
+			return err
+		}
+		defer release()
+		inputArgs += fmt.Sprintf("-i \"%s\" ", coverPath)
+		cover, metadataInput = 1, 2
+	}
+	metadata := ws.Path("metadata.txt")
+	err = os.WriteFile(metadata, []byte(ffmetadata(t.Metadata)), 0644)
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, fmt.Errorf("failed to write metadata: %w", err))
+	}
+	inputArgs += fmt.Sprintf("-i \"%s\" ", metadata)
+
+	// The filtered audio's split between the renditions
+	audioMap := fmt.Sprintf("0:a:%d", t.Track)
+	graph := ""
+	if len(filters) > 0 {
+		graph = fmt.Sprintf("-filter_complex \"[0:a:%d]%s", t.Track, strings.Join(filters, ","))
+		if len(t.Renditions) > 1 {
+			graph += fmt.Sprintf(",asplit=%d", len(t.Renditions))
+		}
+		for i := range t.Renditions {
+			graph += fmt.Sprintf("[a%d]", i)
+		}
+		graph += "\" "
+	}
+
+	outputs := make([]string, len(t.Renditions))
+	outputArgs := ""
+	for i, r := range t.Renditions {
+		outputs[i] = ws.Path(fmt.Sprintf("%d-%s", i, path.Base(dsts[i].Path)))
+		args := fmt.Sprintf("-map \"%s\" ", audioMap)
+		if graph != "" {
+			args = fmt.Sprintf("-map \"[a%d]\" ", i)
+		}
+		ext := strings.ToLower(path.Ext(dsts[i].Path))
+		if cover >= 0 && coverExtensions[ext] {
+			args += fmt.Sprintf("-map %d:v -c:v copy -disposition:v attached_pic ", cover)
+			if ext == ".mp3" {
+				args += "-metadata:s:v comment=\"Cover (front)\" "
+			}
+		}
+		if ext == ".mp3" {
+			// ID3v2.3 is what most podcast players read
+			args += "-id3v2_version 3 "
+		}
+		args += fmt.Sprintf("-map_metadata %d -c:a %s -b:a %s ", metadataInput, audioCodecs[r.Codec].encoder, r.Bitrate)
+		outputArgs += fmt.Sprintf("%s\"%s\" ", args, outputs[i])
+	}
+
+	log.Printf("extracting audio to %d renditions: %s", len(outputs), t.GetID())
+	startEnc := time.Now()
+	t.status.Stage = StageTranscoding
+	t.status.StageStart = startEnc
+	cmdString := fmt.Sprintf("\"%s\" -y %s%s%s2>&1", t.env.FFmpeg, inputArgs, graph, outputArgs)
+	err = runFFmpeg(ctx, t, t.env, cmdString, t.stats, t.ffmpegLog)
+	if err != nil {
+		return err
+	}
+	log.Printf("finished extracting audio - completed in %s", time.Since(startEnc))
+
+	// Renditions should be as long as the source, with audio
+	extracted := &ProbeInfo{
+		Duration: srcInfo.Duration,
+		Streams:  []ProbeStream{{Type: "audio"}},
+	}
+	t.status.Stage = StageVerifying
+	t.status.StageStart = time.Now()
+	for _, output := range outputs {
+		err = verifyOutput(ctx, t.env, output, extracted, "", t.Verify)
+		if err != nil {
+			return err
+		}
+	}
+
+	t.status.Stage = StageUploading
+	t.status.StageStart = time.Now()
+	t.status.Result = &Result{}
+	for i, output := range outputs {
+		out, err := uploadOutput(ctx, backends[i], dsts[i], output)
+		if err != nil {
+			return err
+		}
+		t.status.Result.Outputs = append(t.status.Result.Outputs, out)
+	}
+	return nil
+}
+
+// LogTail returns the end of ffmpeg's output
+func (t *AudioExtract) LogTail() []string {
+	return t.ffmpegLog.Tail(logTailLines)
+}
+
+// audioFilters returns the filters which downmix, normalise and
+// resample the audio. Normalising measures the audio first so the
+// gain can be applied linearly rather than compressing it.
+func (t *AudioExtract) audioFilters(ctx context.Context, input string, audio ProbeStream) ([]string, error) {
+	filters := []string{}
+	if t.Channels > 0 {
+		filters = append(filters, fmt.Sprintf("aformat=channel_layouts=%s", channelLayouts[t.Channels]))
+	}
+	sampleRate := t.SampleRate
+	if t.Loudness != nil {
+		l := t.Loudness
+		target := fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g", l.Integrated, l.TruePeak, l.Range)
+
+		log.Printf("measuring loudness: %s", t.GetID())
+		t.status.Stage = StageAnalysing
+		t.status.StageStart = time.Now()
+		measureLog, _ := newFFmpegLog("")
+		cmdString := fmt.Sprintf("\"%s\" -hide_banner -i \"%s\" -map 0:a:%d -af \"%s\" -f null - 2>&1",
+			t.env.FFmpeg, input, t.Track, strings.Join(append(filters, target+":print_format=json"), ","))
+		err := runFFmpeg(ctx, t, t.env, cmdString, &Stats{}, measureLog)
+		if err != nil {
+			return nil, fmt.Errorf("failed to measure loudness: %w", err)
+		}
+		measured, err := parseLoudnorm(measureLog.Tail(logRingLines))
+		if err != nil {
+			return nil, NewError(ErrorInternal, false, err)
+		}
+
+		inputI, _ := strconv.ParseFloat(measured.InputI, 64)
+		if math.IsInf(inputI, 0) {
+			// Silence can't be made any louder
+			log.Printf("%s: audio is silent, not normalising", t.GetID())
+		} else {
+			filters = append(filters, fmt.Sprintf(
+				"%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+				target, measured.InputI, measured.InputTP, measured.InputLRA, measured.InputThresh, measured.Offset))
+			// loudnorm works at 192kHz, so it's brought back to the source's rate
+			if sampleRate == 0 {
+				sampleRate = audio.SampleRate
+			}
+		}
+	}
+	if sampleRate > 0 {
+		filters = append(filters, fmt.Sprintf("aresample=%d", sampleRate))
+	}
+	return filters, nil
+}
+
+// parseLoudnorm finds the measurements loudnorm printed as JSON at the
+// end of its first pass
+func parseLoudnorm(lines []string) (loudnormStats, error) {
+	out := strings.Join(lines, "\n")
+	start := strings.LastIndex(out, "{")
+	end := strings.LastIndex(out, "}")
+	stats := loudnormStats{}
+	if start < 0 || end < start {
+		return stats, fmt.Errorf("loudnorm didn't print its measurements")
+	}
+	err := json.Unmarshal([]byte(out[start:end+1]), &stats)
+	if err != nil {
+		return stats, fmt.Errorf("failed to unmarshal loudnorm measurements: %w", err)
+	}
+	if stats.InputI == "" {
+		return stats, fmt.Errorf("loudnorm didn't print its measurements")
+	}
+	return stats, nil
+}
+
+// ffmetadata writes tags as an ffmetadata file, so they
+// don't have to be escaped for the command line
+func ffmetadata(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b := &strings.Builder{}
+	b.WriteString(";FFMETADATA1\n")
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s=%s\n", k, metadataEscapes.Replace(tags[k]))
+	}
+	return b.String()
+}
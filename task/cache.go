@@ -0,0 +1,306 @@
+package task
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// downloadAttempts is how many times a download is tried,
+// each attempt carrying on from where the last one got to
+const downloadAttempts = 5
+
+// md5ETag matches ETags which are the MD5 of the object, as given by
+// S3 for objects which weren't uploaded in parts
+var md5ETag = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+type (
+	// Cache keeps downloaded sources on a worker so jobs using the same
+	// source share one download. The least recently used sources which
+	// aren't in use are removed when it's over its size limit.
+	Cache struct {
+		mu       sync.Mutex
+		dir      string
+		maxBytes int64
+		size     int64
+		entries  map[string]*cacheEntry
+		inflight map[string]chan struct{}
+	}
+	// cacheEntry is a source in the cache, its metadata is
+	// kept alongside it so the cache survives restarts
+	cacheEntry struct {
+		URL      string    `json:"url"`
+		ETag     string    `json:"etag"`
+		Size     int64     `json:"size"`
+		SHA256   string    `json:"sha256"`
+		LastUsed time.Time `json:"lastUsed"`
+
+		key  string
+		refs int
+	}
+)
+
+// NewCache opens the cache in dir, keeping at most maxBytes of
+// sources which aren't being used
+func NewCache(dir string, maxBytes int64) (*Cache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache dir: %w", err)
+	}
+	c := &Cache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*cacheEntry),
+		inflight: make(map[string]chan struct{}),
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cache: %w", err)
+	}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		e := &cacheEntry{key: strings.TrimSuffix(filepath.Base(f), ".json")}
+		err = json.Unmarshal(b, e)
+		if err != nil {
+			log.Printf("removing unreadable cache entry %s: %+v", e.key, err)
+			c.remove(e)
+			continue
+		}
+		fi, err := os.Stat(c.path(e.key))
+		if err != nil || fi.Size() != e.Size {
+			c.remove(e)
+			continue
+		}
+		c.entries[e.key] = e
+		c.size += e.Size
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, key)
+}
+
+// cacheKey identifies a version of a source, credentials
+// are left out since they don't change what's fetched
+func cacheKey(u *url.URL, info ObjectInfo) string {
+	version := info.ETag
+	if version == "" {
+		version = fmt.Sprintf("%d-%d", info.ModTime.UnixNano(), info.Size)
+	}
+	clean := *u
+	clean.User = nil
+	h := sha256.Sum256([]byte(clean.String() + "\n" + version))
+	return hex.EncodeToString(h[:])
+}
+
+// Fetch returns the local path of a source, downloading it if it isn't
+// already cached. The source won't be removed from the cache until
+// release is called.
+func (c *Cache) Fetch(ctx context.Context, b Backend, u *url.URL) (path string, release func(), err error) {
+	info, err := b.Stat(ctx, u)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to stat source: %w", err)
+	}
+	key := cacheKey(u, info)
+
+	for {
+		c.mu.Lock()
+		if e, ok := c.entries[key]; ok {
+			e.refs++
+			e.LastUsed = time.Now()
+			// Saved from a copy since other jobs change it under the lock
+			saved := *e
+			c.mu.Unlock()
+			c.saveEntry(&saved)
+			return c.path(key), c.releaser(e), nil
+		}
+		wait, ok := c.inflight[key]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		// Another job is downloading it, so wait for them then check again
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		}
+	}
+	done := make(chan struct{})
+	c.inflight[key] = done
+	c.mu.Unlock()
+
+	e, err := c.download(ctx, b, u, key, info)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.inflight, key)
+	close(done)
+	if err != nil {
+		return "", nil, err
+	}
+	e.refs++
+	c.entries[key] = e
+	c.size += e.Size
+	c.evict()
+	return c.path(key), c.releaser(e), nil
+}
+
+func (c *Cache) releaser(e *cacheEntry) func() {
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			e.refs--
+			c.evict()
+		})
+	}
+}
+
+// download fetches a source into the cache, resuming a partial
+// download if there is one and verifying it against the ETag
+func (c *Cache) download(ctx context.Context, b Backend, u *url.URL, key string, info ObjectInfo) (*cacheEntry, error) {
+	part := c.path(key) + ".part"
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create download: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat download: %w", err)
+	}
+	have := fi.Size()
+	if info.Size >= 0 && have > info.Size {
+		// Left over from something else, so start again
+		f.Truncate(0)
+		have = 0
+	}
+	if free, err := freeSpace(c.dir); err == nil && free >= 0 && info.Size-have > free {
+		return nil, fmt.Errorf("%w: need %d bytes, %d available", ErrInsufficientSpace, info.Size-have, free)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = c.downloadFrom(ctx, b, u, f)
+		if err == nil || attempt == downloadAttempts || ctx.Err() != nil {
+			break
+		}
+		log.Printf("download attempt %d of %s failed, retrying: %+v", attempt, key, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to download source: %w", err)
+	}
+	err = f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to write download: %w", err)
+	}
+
+	sums, err := checksumFile(part)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size >= 0 && sums.Size != info.Size {
+		os.Remove(part)
+		return nil, fmt.Errorf("downloaded %d bytes, expected %d", sums.Size, info.Size)
+	}
+	if md5ETag.MatchString(info.ETag) && sums.MD5 != info.ETag {
+		os.Remove(part)
+		return nil, fmt.Errorf("downloaded md5 %s doesn't match etag %s", sums.MD5, info.ETag)
+	}
+
+	clean := *u
+	clean.User = nil
+	e := &cacheEntry{
+		URL:      clean.String(),
+		ETag:     info.ETag,
+		Size:     sums.Size,
+		SHA256:   sums.SHA256,
+		LastUsed: time.Now(),
+		key:      key,
+	}
+	err = os.Rename(part, c.path(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to move download into cache: %w", err)
+	}
+	c.saveEntry(e)
+	return e, nil
+}
+
+// downloadFrom appends the rest of the object to the partial download
+func (c *Cache) downloadFrom(ctx context.Context, b Backend, u *url.URL, f *os.File) error {
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to seek download: %w", err)
+	}
+	r, err := b.Get(ctx, u, offset)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(f, &countingReader{r: r, counter: bytesDownloaded})
+	return err
+}
+
+func (c *Cache) saveEntry(e *cacheEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(c.path(e.key)+".json", b, 0644)
+	if err != nil {
+		log.Printf("failed to save cache entry %s: %+v", e.key, err)
+	}
+}
+
+func (c *Cache) remove(e *cacheEntry) {
+	os.Remove(c.path(e.key))
+	os.Remove(c.path(e.key) + ".json")
+}
+
+// evict removes the least recently used sources which aren't in use
+// until the cache fits in its limit, must hold the lock
+func (c *Cache) evict() {
+	if c.size <= c.maxBytes {
+		return
+	}
+	entries := make([]*cacheEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.Before(entries[j].LastUsed)
+	})
+	for _, e := range entries {
+		if c.size <= c.maxBytes {
+			return
+		}
+		if e.refs > 0 {
+			continue
+		}
+		c.remove(e)
+		delete(c.entries, e.key)
+		c.size -= e.Size
+	}
+}
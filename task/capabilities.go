@@ -0,0 +1,245 @@
+package task
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Requirement kinds a job can ask for, written as "kind:name"
+// i.e. "encoder:libsvtav1" or "version:5.1" for at least ffmpeg 5.1
+const (
+	RequireEncoder = "encoder"
+	RequireDecoder = "decoder"
+	RequireFilter  = "filter"
+	RequireVersion = "version"
+)
+
+// queueSeparator splits a task type from the requirements in a
+// queue name, jobs without requirements use the task type alone
+const queueSeparator = "@"
+
+// Capabilities is what a worker's ffmpeg build can do
+type Capabilities struct {
+	Version  string   `json:"version"`
+	Encoders []string `json:"encoders"`
+	Decoders []string `json:"decoders"`
+	Filters  []string `json:"filters"`
+}
+
+// DetectCapabilities asks ffmpeg what it supports
+func DetectCapabilities(ffmpeg string) (Capabilities, error) {
+	c := Capabilities{}
+	out, err := exec.Command(ffmpeg, "-hide_banner", "-version").Output()
+	if err != nil {
+		return c, fmt.Errorf("failed to get ffmpeg version: %w", err)
+	}
+	// "ffmpeg version 4.4.1 Copyright..."
+	fields := strings.Fields(string(out))
+	if len(fields) < 3 {
+		return c, fmt.Errorf("unexpected ffmpeg version output")
+	}
+	c.Version = fields[2]
+
+	c.Encoders, err = listCodecs(ffmpeg, "-encoders")
+	if err != nil {
+		return c, err
+	}
+	c.Decoders, err = listCodecs(ffmpeg, "-decoders")
+	if err != nil {
+		return c, err
+	}
+
+	out, err = exec.Command(ffmpeg, "-hide_banner", "-filters").Output()
+	if err != nil {
+		return c, fmt.Errorf("failed to list filters: %w", err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// " TSC acompressor  A->A  Audio compressor."
+		f := strings.Fields(scanner.Text())
+		if len(f) >= 3 && strings.Contains(f[2], "->") {
+			c.Filters = append(c.Filters, f[1])
+		}
+	}
+	sort.Strings(c.Filters)
+	return c, nil
+}
+
+// listCodecs parses the output of "ffmpeg -encoders" or "-decoders"
+func listCodecs(ffmpeg, flag string) ([]string, error) {
+	out, err := exec.Command(ffmpeg, "-hide_banner", flag).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", strings.TrimPrefix(flag, "-"), err)
+	}
+	codecs := []string{}
+	started := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !started {
+			// The list comes after the legend
+			started = strings.HasPrefix(line, "---")
+			continue
+		}
+		// "V....D libx264  libx264 H.264 / AVC..."
+		f := strings.Fields(line)
+		if len(f) >= 2 {
+			codecs = append(codecs, f[1])
+		}
+	}
+	sort.Strings(codecs)
+	return codecs, nil
+}
+
+// Satisfies returns whether the capabilities meet a requirement
+func (c Capabilities) Satisfies(requirement string) bool {
+	kind, name, ok := splitRequirement(requirement)
+	if !ok {
+		return false
+	}
+	switch kind {
+	case RequireEncoder:
+		return contains(c.Encoders, name)
+	case RequireDecoder:
+		return contains(c.Decoders, name)
+	case RequireFilter:
+		return contains(c.Filters, name)
+	case RequireVersion:
+		return versionAtLeast(c.Version, name)
+	}
+	return false
+}
+
+// SatisfiesAll returns whether the capabilities meet every requirement
+func (c Capabilities) SatisfiesAll(requirements []string) bool {
+	for _, r := range requirements {
+		if !c.Satisfies(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateRequirements checks requirements are ones we understand
+func ValidateRequirements(requirements []string) error {
+	for _, r := range requirements {
+		kind, name, ok := splitRequirement(r)
+		if !ok {
+			return fmt.Errorf("invalid requirement \"%s\", expected \"kind:name\"", r)
+		}
+		switch kind {
+		case RequireEncoder, RequireDecoder, RequireFilter:
+		case RequireVersion:
+			if _, ok := parseVersion(name); !ok {
+				return fmt.Errorf("invalid version requirement \"%s\"", r)
+			}
+		default:
+			return fmt.Errorf("unknown requirement kind \"%s\"", kind)
+		}
+		if strings.ContainsAny(name, ","+queueSeparator) {
+			return fmt.Errorf("invalid requirement \"%s\"", r)
+		}
+	}
+	return nil
+}
+
+// addRequirement adds a requirement a job has unless it's already there
+func addRequirement(requirements []string, need string) []string {
+	for _, r := range requirements {
+		if r == need {
+			return requirements
+		}
+	}
+	return append(requirements, need)
+}
+
+// QueueName returns the queue jobs of a type with the given
+// requirements are routed through
+func QueueName(taskType string, requirements []string) string {
+	if len(requirements) == 0 {
+		return taskType
+	}
+	reqs := append([]string{}, requirements...)
+	sort.Strings(reqs)
+	unique := reqs[:0]
+	for i, r := range reqs {
+		if i == 0 || r != reqs[i-1] {
+			unique = append(unique, r)
+		}
+	}
+	return taskType + queueSeparator + strings.Join(unique, ",")
+}
+
+// ParseQueueName splits a queue name into its task type and requirements
+func ParseQueueName(queue string) (string, []string) {
+	i := strings.Index(queue, queueSeparator)
+	if i < 0 {
+		return queue, nil
+	}
+	return queue[:i], strings.Split(queue[i+1:], ",")
+}
+
+func splitRequirement(r string) (string, string, bool) {
+	i := strings.Index(r, ":")
+	if i <= 0 || i == len(r)-1 {
+		return "", "", false
+	}
+	return r[:i], r[i+1:], true
+}
+
+func contains(list []string, s string) bool {
+	i := sort.SearchStrings(list, s)
+	return i < len(list) && list[i] == s
+}
+
+// parseVersion reads the numeric parts of a version, i.e. "4.4.1"
+func parseVersion(v string) ([]int, bool) {
+	parts := strings.Split(v, ".")
+	nums := make([]int, 0, len(parts))
+	for _, p := range parts {
+		// Builds can have suffixes, i.e. "4.4.1-0ubuntu1"
+		end := strings.IndexFunc(p, func(r rune) bool { return r < '0' || r > '9' })
+		if end == 0 {
+			break
+		}
+		if end > 0 {
+			p = p[:end]
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			break
+		}
+		nums = append(nums, n)
+		if end > 0 {
+			break
+		}
+	}
+	return nums, len(nums) > 0
+}
+
+// versionAtLeast compares ffmpeg versions, builds from git
+// (i.e. "N-104465-g...") don't have a comparable version
+func versionAtLeast(have, want string) bool {
+	h, ok := parseVersion(have)
+	if !ok {
+		return false
+	}
+	w, ok := parseVersion(want)
+	if !ok {
+		return false
+	}
+	for i := range w {
+		if i >= len(h) {
+			return false
+		}
+		if h[i] != w[i] {
+			return h[i] > w[i]
+		}
+	}
+	return true
+}
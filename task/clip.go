@@ -0,0 +1,522 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const TypeClip string = "video/clip"
+
+// keyframeTolerance is how close in seconds a cut has to be to a
+// keyframe to be counted as on it
+const keyframeTolerance = 0.001
+
+// clipEncoders are what boundaries are re-encoded with by default,
+// by the codec of the source's video
+var clipEncoders = map[string]string{
+	"h264":       "libx264",
+	"hevc":       "libx265",
+	"vp9":        "libvpx-vp9",
+	"av1":        "libsvtav1",
+	"mpeg2video": "mpeg2video",
+	"prores":     "prores_ks",
+}
+
+var _ Task = &Clip{}
+
+type (
+	// Clip task cuts ranges out of a source and joins them together.
+	// Video between keyframes is copied, only the GOPs either side
+	// of a cut which isn't on one are re-encoded.
+	Clip struct {
+		TaskID string      `json:"taskID"`
+		SrcURL string      `json:"srcURL"`
+		Ranges []ClipRange `json:"ranges"` // In the order they're joined
+		DstURL string      `json:"dstURL"`
+		// Video options for re-encoded boundaries, defaults to the
+		// encoder for the source's codec
+		EncodeArgs string `json:"encodeArgs,omitempty"`
+		// Options for the audio, which is always re-encoded
+		AudioArgs string `json:"audioArgs,omitempty"`
+		// Re-encode all of the video rather than copying it
+		Reencode bool `json:"reencode"`
+		Download bool `json:"download"`
+		// Worker capabilities the job needs, i.e. "encoder:libx264"
+		Requires []string `json:"requires,omitempty"`
+		// Maximum seconds the job can run for, 0 uses the worker's limit
+		Timeout int `json:"timeout,omitempty"`
+		// Checks the clip has to pass before it's uploaded, its duration
+		// is compared with the ranges'
+		Verify VerifyOptions `json:"verify"`
+
+		status    Status
+		stats     *Stats
+		ffmpegLog *FFmpegLog
+
+		// dependencies
+		env *Env
+	}
+	// ClipRange is a range of the source to keep, in and out are
+	// seconds or timecodes. Out is left out for the end of the source.
+	ClipRange struct {
+		In  Timecode `json:"in"`
+		Out Timecode `json:"out,omitempty"`
+	}
+	// Timecode is a time in a source, either seconds or
+	// "HH:MM:SS.mmm", "MM:SS.mmm" or "HH:MM:SS:FF" with frames
+	Timecode string
+	// clipPiece is part of a range which is either copied or re-encoded
+	clipPiece struct {
+		Span
+		copy bool
+	}
+)
+
+// UnmarshalJSON allows seconds to be given as numbers
+func (tc *Timecode) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*tc = Timecode(s)
+		return nil
+	}
+	var f json.Number
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("timecode has to be a string or seconds: %w", err)
+	}
+	*tc = Timecode(f)
+	return nil
+}
+
+// Seconds converts the timecode to seconds, timecodes with frames
+// need the source's frame rate
+func (tc Timecode) Seconds(fps float64) (float64, error) {
+	s := strings.TrimSpace(string(tc))
+	// Drop frame timecodes separate the frames with a semicolon
+	parts := strings.Split(strings.ReplaceAll(s, ";", ":"), ":")
+	if len(parts) > 4 {
+		return 0, fmt.Errorf("invalid timecode \"%s\"", s)
+	}
+	frames := 0.0
+	if len(parts) == 4 {
+		f, err := strconv.Atoi(parts[3])
+		if err != nil || f < 0 {
+			return 0, fmt.Errorf("invalid frames in timecode \"%s\"", s)
+		}
+		if fps <= 0 {
+			return 0, fmt.Errorf("timecode \"%s\" has frames but the frame rate is unknown", s)
+		}
+		frames = float64(f) / fps
+		parts = parts[:3]
+	}
+	secs := 0.0
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+			return 0, fmt.Errorf("invalid timecode \"%s\"", s)
+		}
+		// Only the last part can be fractional or over 59
+		if i < len(parts)-1 && v != math.Trunc(v) {
+			return 0, fmt.Errorf("invalid timecode \"%s\"", s)
+		}
+		secs = secs*60 + v
+	}
+	return secs + frames, nil
+}
+
+// NewClip initialises a Clip task object so we can
+// add the tasks dependencies
+func NewClip(env *Env) Clip {
+	return Clip{
+		stats: &Stats{},
+		env:   env,
+	}
+}
+
+// GetID returns a task ID
+func (t *Clip) GetID() string {
+	return t.TaskID
+}
+
+// GetType returns the task's type
+func (t *Clip) GetType() string {
+	return TypeClip
+}
+
+// GetTimeout returns the job's maximum runtime
+func (t *Clip) GetTimeout() time.Duration {
+	return time.Duration(t.Timeout) * time.Second
+}
+
+// GetStatus returns the task's status
+func (t *Clip) GetStatus() Status {
+	t.status.TaskID = t.TaskID
+	if t.stats != nil {
+		t.status.Stats = *t.stats
+	}
+	return t.status
+}
+
+// ValidateRequest checks the request, timecodes with frames
+// are only checked once the source's frame rate is known
+func (t *Clip) ValidateRequest() error {
+	if t.SrcURL == "" {
+		return fmt.Errorf("missing srcURL")
+	}
+	if t.DstURL == "" {
+		return fmt.Errorf("missing dstURL")
+	}
+	if err := validateStorageURL(t.SrcURL); err != nil {
+		return fmt.Errorf("invalid srcURL: %w", err)
+	}
+	if err := validateStorageURL(t.DstURL); err != nil {
+		return fmt.Errorf("invalid dstURL: %w", err)
+	}
+	if len(t.Ranges) == 0 {
+		return fmt.Errorf("missing ranges")
+	}
+	for i, r := range t.Ranges {
+		// A nominal frame rate is enough to check the format
+		in, err := r.In.Seconds(1)
+		if err != nil {
+			return fmt.Errorf("range %d: %w", i, err)
+		}
+		if r.Out == "" {
+			continue
+		}
+		out, err := r.Out.Seconds(1)
+		if err != nil {
+			return fmt.Errorf("range %d: %w", i, err)
+		}
+		if !hasFrames(r.In) && !hasFrames(r.Out) && out <= in {
+			return fmt.Errorf("range %d: out has to be after in", i)
+		}
+	}
+	if t.AudioArgs == "" {
+		t.AudioArgs = defaultAudioArgs
+	}
+	if err := t.Verify.Validate(); err != nil {
+		return err
+	}
+	if err := ValidateRequirements(t.Requires); err != nil {
+		return err
+	}
+	t.TaskID = uuid.NewString()
+	return nil
+}
+
+// Start cuts the ranges out of the source, joins them and uploads the clip
+func (t *Clip) Start(ctx context.Context) error {
+	t.status.Stage = StageStarted
+	t.status.StageStart = time.Now()
+
+	b, dst, err := t.env.Store.Resolve(t.DstURL)
+	if err != nil {
+		return NewError(ErrorInvalidArgs, false, fmt.Errorf("failed to resolve destination: %w", err))
+	}
+	ws, err := t.env.Workspaces.Create(t.TaskID)
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer ws.Remove()
+	t.ffmpegLog, err = newFFmpegLog(ws.Path("ffmpeg.log"))
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer finishLog(ctx, t.ffmpegLog, b, withSuffix(dst, ".log"), &t.status)
+
+	input, release, err := openSource(ctx, t.env, t.SrcURL, t.Download, &t.status)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	t.status.Stage = StageAnalysing
+	t.status.StageStart = time.Now()
+	info, err := probe(ctx, t.env.FFprobe, input)
+	if err != nil {
+		return inputError(err)
+	}
+	video, hasVideo := info.Stream("video")
+	_, hasAudio := info.Stream("audio")
+	if !hasVideo {
+		return NewError(ErrorInvalidArgs, false, fmt.Errorf("source has no video"))
+	}
+	spans, err := t.resolveRanges(info.Duration, video.FrameRate)
+	if err != nil {
+		return NewError(ErrorInvalidArgs, false, err)
+	}
+	defaultEncoder := t.EncodeArgs == ""
+	encodeArgs := t.EncodeArgs
+	if defaultEncoder {
+		encoder, ok := clipEncoders[video.Codec]
+		if !ok {
+			return NewError(ErrorInvalidArgs, false,
+				fmt.Errorf("no default encoder for \"%s\" video, set encodeArgs", video.Codec))
+		}
+		encodeArgs = "-c:v " + encoder
+	}
+	keyframes := []float64{}
+	if !t.Reencode {
+		keyframes, err = findKeyframes(ctx, t.env.FFprobe, input, info.StartTime)
+		if err != nil {
+			return err
+		}
+		// The end of the source can be copied up to like a keyframe
+		keyframes = append(keyframes, info.Duration)
+		// Boundaries have to match the video they're joined to
+		encodeArgs = boundaryArgs(video, encodeArgs, defaultEncoder)
+	}
+
+	log.Printf("cutting %d ranges: %s", len(spans), t.GetID())
+	startCut := time.Now()
+	t.status.Stage = StageTranscoding
+	t.status.StageStart = startCut
+	output := ws.Path(path.Base(dst.Path))
+	err = t.cutRanges(ctx, ws, input, spans, keyframes, encodeArgs, hasAudio, output)
+	if err == nil && !t.Reencode {
+		err = t.decodeCheck(ctx, output)
+	}
+	if err != nil && !t.Reencode && ctx.Err() == nil {
+		// Copying can go wrong in ways re-encoding doesn't, i.e. the
+		// boundaries not joining up with the copied video
+		log.Printf("smart cut failed, re-encoding all of it: %+v", err)
+		*t.stats = Stats{}
+		err = t.cutRanges(ctx, ws, input, spans, nil, t.fullArgs(video), hasAudio, output)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("finished cutting - completed in %s", time.Since(startCut))
+
+	total := 0.0
+	for _, span := range spans {
+		total += span.End - span.Start
+	}
+	// The clip should be as long as its ranges
+	clipInfo := info
+	clipInfo.Duration = total
+	t.status.Stage = StageVerifying
+	t.status.StageStart = time.Now()
+	err = verifyOutput(ctx, t.env, output, &clipInfo, "", t.Verify)
+	if err != nil {
+		return err
+	}
+
+	t.status.Stage = StageUploading
+	t.status.StageStart = time.Now()
+	out, err := uploadOutput(ctx, b, dst, output)
+	if err != nil {
+		return err
+	}
+	t.status.Result = &Result{Outputs: []Output{out}}
+	return nil
+}
+
+// LogTail returns the end of ffmpeg's output
+func (t *Clip) LogTail() []string {
+	return t.ffmpegLog.Tail(logTailLines)
+}
+
+// resolveRanges turns the ranges into spans of the source
+func (t *Clip) resolveRanges(duration, fps float64) ([]Span, error) {
+	spans := []Span{}
+	for i, r := range t.Ranges {
+		in, err := r.In.Seconds(fps)
+		if err != nil {
+			return nil, fmt.Errorf("range %d: %w", i, err)
+		}
+		out := duration
+		if r.Out != "" {
+			out, err = r.Out.Seconds(fps)
+			if err != nil {
+				return nil, fmt.Errorf("range %d: %w", i, err)
+			}
+		}
+		if duration > 0 {
+			if in >= duration {
+				return nil, fmt.Errorf("range %d starts after the source's end at %.3fs", i, duration)
+			}
+			out = math.Min(out, duration)
+		}
+		if out <= in {
+			return nil, fmt.Errorf("range %d: out has to be after in", i)
+		}
+		spans = append(spans, Span{Start: in, End: out})
+	}
+	return spans, nil
+}
+
+// cutRanges cuts the spans out of the source and joins them into output,
+// copying the video between keyframes
+func (t *Clip) cutRanges(ctx context.Context, ws *Workspace, input string, spans []Span, keyframes []float64, encodeArgs string, hasAudio bool, output string) error {
+	videoFiles, audioFiles := []string{}, []string{}
+	for i, span := range spans {
+		for _, piece := range planCuts(span, keyframes, len(keyframes) == 0) {
+			piecePath := ws.Path(fmt.Sprintf("video%04d.mkv", len(videoFiles)))
+			err := t.cut(ctx, input, piece, encodeArgs, piecePath)
+			if err != nil {
+				return err
+			}
+			videoFiles = append(videoFiles, piecePath)
+		}
+		if hasAudio {
+			audioPath := ws.Path(fmt.Sprintf("audio%04d.mka", i))
+			cmdString := fmt.Sprintf("\"%s\" -y -ss %.6f -i \"%s\" -t %.6f -map 0:a:0 -vn %s \"%s\" 2>&1",
+				t.env.FFmpeg, span.Start, input, span.End-span.Start, t.AudioArgs, audioPath)
+			err := runFFmpeg(ctx, t, t.env, cmdString, t.stats, t.ffmpegLog)
+			if err != nil {
+				return fmt.Errorf("failed to cut audio: %w", err)
+			}
+			audioFiles = append(audioFiles, audioPath)
+		}
+	}
+
+	// The pieces are joined without re-encoding them
+	err := writeConcatList(ws.Path("video.txt"), videoFiles)
+	if err != nil {
+		return err
+	}
+	inputs := fmt.Sprintf("-f concat -safe 0 -i \"%s\"", ws.Path("video.txt"))
+	maps := "-map 0:v"
+	if hasAudio {
+		err = writeConcatList(ws.Path("audio.txt"), audioFiles)
+		if err != nil {
+			return err
+		}
+		inputs += fmt.Sprintf(" -f concat -safe 0 -i \"%s\"", ws.Path("audio.txt"))
+		maps += " -map 1:a"
+	}
+	cmdString := fmt.Sprintf("\"%s\" -y %s %s -c copy \"%s\" 2>&1", t.env.FFmpeg, inputs, maps, output)
+	err = runFFmpeg(ctx, t, t.env, cmdString, t.stats, t.ffmpegLog)
+	if err != nil {
+		return fmt.Errorf("failed to join ranges: %w", err)
+	}
+	return nil
+}
+
+// decodeCheck decodes the joined video, failing on the first
+// error so a bad join between pieces is caught
+func (t *Clip) decodeCheck(ctx context.Context, output string) error {
+	cmdString := fmt.Sprintf("\"%s\" -hide_banner -xerror -err_detect explode -i \"%s\" -map 0:v:0 -f null - 2>&1",
+		t.env.FFmpeg, output)
+	err := runFFmpeg(ctx, t, t.env, cmdString, &Stats{}, t.ffmpegLog)
+	if err != nil {
+		return fmt.Errorf("joined clip doesn't decode: %w", err)
+	}
+	return nil
+}
+
+// fullArgs are the options for re-encoding all of the video when
+// copying it didn't work, the job's own when it has them
+func (t *Clip) fullArgs(video ProbeStream) string {
+	if t.EncodeArgs != "" {
+		return t.EncodeArgs
+	}
+	return "-c:v " + clipEncoders[video.Codec]
+}
+
+// boundaryArgs adds the source's settings to the options re-encoded
+// boundaries get, so they match the copied video they're joined to. The
+// pixel format and frame rate are always added, the pieces are Matroska
+// so share its timebase. The profile and level are only added for the
+// default encoder since others name them differently. encodeArgs come
+// last so they override any of them.
+func boundaryArgs(video ProbeStream, encodeArgs string, defaultEncoder bool) string {
+	args := []string{}
+	if video.PixFmt != "" {
+		args = append(args, "-pix_fmt "+video.PixFmt)
+	}
+	if video.Rate != "" && video.FrameRate > 0 {
+		args = append(args, "-r "+video.Rate)
+	}
+	if defaultEncoder {
+		profile := strings.ReplaceAll(strings.ToLower(video.Profile), " ", "")
+		switch video.Codec {
+		case "h264":
+			switch profile {
+			case "constrainedbaseline":
+				profile = "baseline"
+			case "high4:2:2":
+				profile = "high422"
+			case "high4:4:4predictive":
+				profile = "high444"
+			}
+			if profile == "baseline" || profile == "main" || profile == "high" ||
+				profile == "high10" || profile == "high422" || profile == "high444" {
+				args = append(args, "-profile:v "+profile)
+			}
+			if video.Level > 0 {
+				args = append(args, fmt.Sprintf("-level:v %.1f", float64(video.Level)/10))
+			}
+		case "hevc":
+			if profile == "main" || profile == "main10" {
+				args = append(args, "-profile:v "+profile)
+			}
+			if video.Level > 0 {
+				args = append(args, fmt.Sprintf("-x265-params level-idc=%.1f", float64(video.Level)/30))
+			}
+		}
+	}
+	return strings.Join(append(args, encodeArgs), " ")
+}
+
+// cut copies or re-encodes a piece of the source's video
+func (t *Clip) cut(ctx context.Context, input string, piece clipPiece, encodeArgs, output string) error {
+	codec := encodeArgs
+	if piece.copy {
+		codec = "-c:v copy"
+	}
+	cmdString := fmt.Sprintf("\"%s\" -y -ss %.6f -i \"%s\" -t %.6f -map 0:v:0 -an -sn %s \"%s\" 2>&1",
+		t.env.FFmpeg, piece.Start, input, piece.End-piece.Start, codec, output)
+	err := runFFmpeg(ctx, t, t.env, cmdString, t.stats, t.ffmpegLog)
+	if err != nil {
+		return fmt.Errorf("failed to cut %.3fs to %.3fs: %w", piece.Start, piece.End, err)
+	}
+	return nil
+}
+
+// planCuts splits a span into the part between its first and last
+// keyframes, which can be copied, and the parts either side of it which
+// have to be re-encoded. Spans without a whole GOP are re-encoded.
+func planCuts(span Span, keyframes []float64, reencode bool) []clipPiece {
+	first, last := -1.0, -1.0
+	for _, kf := range keyframes {
+		if kf < span.Start-keyframeTolerance || kf > span.End+keyframeTolerance {
+			continue
+		}
+		if first < 0 {
+			first = kf
+		}
+		last = kf
+	}
+	if reencode || first < 0 || last-first < keyframeTolerance {
+		return []clipPiece{{Span: span}}
+	}
+
+	pieces := []clipPiece{}
+	if first-span.Start > keyframeTolerance {
+		pieces = append(pieces, clipPiece{Span: Span{Start: span.Start, End: first}})
+	}
+	pieces = append(pieces, clipPiece{Span: Span{Start: first, End: last}, copy: true})
+	if span.End-last > keyframeTolerance {
+		pieces = append(pieces, clipPiece{Span: Span{Start: last, End: span.End}})
+	}
+	return pieces
+}
+
+// hasFrames returns whether a timecode counts frames
+func hasFrames(tc Timecode) bool {
+	return len(strings.Split(strings.ReplaceAll(string(tc), ";", ":"), ":")) == 4
+}
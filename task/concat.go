@@ -0,0 +1,328 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const TypeConcat string = "video/concat"
+
+// Defaults for the audio sources are normalised to
+const (
+	defaultSampleRate    = 48000
+	defaultChannelLayout = "stereo"
+)
+
+var (
+	// transitionPattern matches the names of xfade's transitions
+	transitionPattern = regexp.MustCompile(`^[a-z]+$`)
+	// layoutPattern matches channel layouts, i.e. "stereo" or "5.1(side)"
+	layoutPattern = regexp.MustCompile(`^[a-zA-Z0-9.()+]+$`)
+)
+
+var _ Task = &Concat{}
+
+// Concat task joins sources one after another, i.e. an ident, a programme
+// and an end board. They're normalised to a common resolution, frame rate
+// and audio layout first, so can differ from each other.
+type Concat struct {
+	TaskID  string   `json:"taskID"`
+	SrcURLs []string `json:"srcURLs"` // In the order they're joined
+	DstArgs string   `json:"dstArgs"` // Output file options
+	DstURL  string   `json:"dstURL"`
+	// What the sources are normalised to, the resolution and frame
+	// rate default to the longest source's
+	Width         int     `json:"width,omitempty"`
+	Height        int     `json:"height,omitempty"`
+	FrameRate     float64 `json:"frameRate,omitempty"`
+	SampleRate    int     `json:"sampleRate,omitempty"`
+	ChannelLayout string  `json:"channelLayout,omitempty"`
+	// Seconds each source fades into the next over, 0 cuts between them
+	Crossfade float64 `json:"crossfade,omitempty"`
+	// xfade transition for the video, defaults to "fade"
+	Transition string `json:"transition,omitempty"`
+	Download   bool   `json:"download"`
+	// Worker capabilities the job needs, i.e. "encoder:libsvtav1"
+	Requires []string `json:"requires,omitempty"`
+	// Maximum seconds the job can run for, 0 uses the worker's limit
+	Timeout int `json:"timeout,omitempty"`
+	// Checks the result has to pass before it's uploaded, its
+	// duration is compared with the sources' total
+	Verify VerifyOptions `json:"verify"`
+
+	status    Status
+	stats     *Stats
+	ffmpegLog *FFmpegLog
+
+	// dependencies
+	env *Env
+}
+
+// NewConcat initialises a Concat task object so we can
+// add the tasks dependencies
+func NewConcat(env *Env) Concat {
+	return Concat{
+		stats: &Stats{},
+		env:   env,
+	}
+}
+
+// GetID returns a task ID
+func (t *Concat) GetID() string {
+	return t.TaskID
+}
+
+// GetType returns the task's type
+func (t *Concat) GetType() string {
+	return TypeConcat
+}
+
+// GetTimeout returns the job's maximum runtime
+func (t *Concat) GetTimeout() time.Duration {
+	return time.Duration(t.Timeout) * time.Second
+}
+
+// GetStatus returns the task's status
+func (t *Concat) GetStatus() Status {
+	t.status.TaskID = t.TaskID
+	if t.stats != nil {
+		t.status.Stats = *t.stats
+	}
+	return t.status
+}
+
+// ValidateRequest checks the request, crossfades need a worker
+// with xfade so it's added to the job's requirements
+func (t *Concat) ValidateRequest() error {
+	if len(t.SrcURLs) < 2 {
+		return fmt.Errorf("srcURLs needs at least two sources")
+	}
+	if t.DstURL == "" {
+		return fmt.Errorf("missing dstURL")
+	}
+	for i, u := range t.SrcURLs {
+		if err := validateStorageURL(u); err != nil {
+			return fmt.Errorf("invalid srcURLs[%d]: %w", i, err)
+		}
+	}
+	if err := validateStorageURL(t.DstURL); err != nil {
+		return fmt.Errorf("invalid dstURL: %w", err)
+	}
+	if t.Width < 0 || t.Height < 0 || t.FrameRate < 0 || t.SampleRate < 0 || t.Crossfade < 0 {
+		return fmt.Errorf("width, height, frameRate, sampleRate and crossfade can't be negative")
+	}
+	if t.Width%2 != 0 || t.Height%2 != 0 || (t.Width == 0) != (t.Height == 0) {
+		return fmt.Errorf("width and height have to be even and given together")
+	}
+	if t.SampleRate == 0 {
+		t.SampleRate = defaultSampleRate
+	}
+	if t.ChannelLayout == "" {
+		t.ChannelLayout = defaultChannelLayout
+	}
+	if t.Transition == "" {
+		t.Transition = "fade"
+	}
+	if !transitionPattern.MatchString(t.Transition) {
+		return fmt.Errorf("invalid transition \"%s\"", t.Transition)
+	}
+	if !layoutPattern.MatchString(t.ChannelLayout) {
+		return fmt.Errorf("invalid channelLayout \"%s\"", t.ChannelLayout)
+	}
+	if err := t.Verify.Validate(); err != nil {
+		return err
+	}
+	if t.Crossfade > 0 {
+		t.Requires = addRequirement(t.Requires, RequireFilter+":xfade")
+	}
+	if err := ValidateRequirements(t.Requires); err != nil {
+		return err
+	}
+	t.TaskID = uuid.NewString()
+	return nil
+}
+
+// Start normalises and joins the sources, then uploads the result
+func (t *Concat) Start(ctx context.Context) error {
+	t.status.Stage = StageStarted
+	t.status.StageStart = time.Now()
+
+	b, dst, err := t.env.Store.Resolve(t.DstURL)
+	if err != nil {
+		return NewError(ErrorInvalidArgs, false, fmt.Errorf("failed to resolve destination: %w", err))
+	}
+	ws, err := t.env.Workspaces.Create(t.TaskID)
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer ws.Remove()
+	t.ffmpegLog, err = newFFmpegLog(ws.Path("ffmpeg.log"))
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer finishLog(ctx, t.ffmpegLog, b, withSuffix(dst, ".log"), &t.status)
+
+	inputs := make([]string, len(t.SrcURLs))
+	infos := make([]ProbeInfo, len(t.SrcURLs))
+	for i, u := range t.SrcURLs {
+		input, release, err := openSource(ctx, t.env, u, t.Download, &t.status)
+		if err != nil {
+			return err
+		}
+		defer release()
+		inputs[i] = input
+		infos[i], err = probe(ctx, t.env.FFprobe, input)
+		if err != nil {
+			return inputError(fmt.Errorf("srcURLs[%d]: %w", i, err))
+		}
+	}
+	err = t.normaliseTo(infos)
+	if err != nil {
+		return NewError(ErrorInvalidArgs, false, err)
+	}
+	graph, total, err := t.filterGraph(infos)
+	if err != nil {
+		return NewError(ErrorInvalidArgs, false, err)
+	}
+
+	log.Printf("joining %d sources: %s", len(inputs), t.GetID())
+	startEnc := time.Now()
+	t.status.Stage = StageTranscoding
+	t.status.StageStart = startEnc
+	inputArgs := ""
+	for _, input := range inputs {
+		inputArgs += fmt.Sprintf("-i \"%s\" ", input)
+	}
+	output := ws.Path(path.Base(dst.Path))
+	args := "-map \"[v]\" -map \"[a]\" " + t.DstArgs
+	cmdString := fmt.Sprintf("\"%s\" -y %s-filter_complex \"%s\" %s \"%s\" 2>&1",
+		t.env.FFmpeg, inputArgs, graph, args, output)
+	err = runFFmpeg(ctx, t, t.env, cmdString, t.stats, t.ffmpegLog)
+	if err != nil {
+		return err
+	}
+	log.Printf("finished joining - completed in %s", time.Since(startEnc))
+
+	// The result should be as long as the sources, less the crossfades
+	joined := &ProbeInfo{
+		Duration: total,
+		Streams:  []ProbeStream{{Type: "video"}, {Type: "audio"}},
+	}
+	t.status.Stage = StageVerifying
+	t.status.StageStart = time.Now()
+	err = verifyOutput(ctx, t.env, output, joined, t.DstArgs, t.Verify)
+	if err != nil {
+		return err
+	}
+
+	t.status.Stage = StageUploading
+	t.status.StageStart = time.Now()
+	out, err := uploadOutput(ctx, b, dst, output)
+	if err != nil {
+		return err
+	}
+	t.status.Result = &Result{Outputs: []Output{out}}
+	return nil
+}
+
+// LogTail returns the end of ffmpeg's output
+func (t *Concat) LogTail() []string {
+	return t.ffmpegLog.Tail(logTailLines)
+}
+
+// normaliseTo fills in the resolution and frame rate which
+// weren't given from the longest source's video
+func (t *Concat) normaliseTo(infos []ProbeInfo) error {
+	longest := -1
+	for i, info := range infos {
+		if _, ok := info.Stream("video"); !ok {
+			return fmt.Errorf("srcURLs[%d] has no video", i)
+		}
+		if longest < 0 || info.Duration > infos[longest].Duration {
+			longest = i
+		}
+	}
+	video, _ := infos[longest].Stream("video")
+	if t.Width == 0 {
+		// Scaled sizes have to be even for most pixel formats
+		t.Width, t.Height = video.Width-video.Width%2, video.Height-video.Height%2
+	}
+	if t.FrameRate == 0 {
+		t.FrameRate = video.FrameRate
+	}
+	if t.Width == 0 || t.FrameRate == 0 {
+		return fmt.Errorf("couldn't find the resolution and frame rate of srcURLs[%d], set them", longest)
+	}
+	return nil
+}
+
+// filterGraph builds the graph which normalises each source and joins
+// them, outputting [v] and [a]. Returns the duration of the result.
+func (t *Concat) filterGraph(infos []ProbeInfo) (string, float64, error) {
+	filters := []string{}
+	for i, info := range infos {
+		if info.Duration <= 0 {
+			return "", 0, fmt.Errorf("srcURLs[%d] has no duration", i)
+		}
+		// Letterboxed or pillarboxed into the frame rather than stretched
+		filters = append(filters, fmt.Sprintf(
+			"[%d:v:0]scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,"+
+				"setsar=1,fps=%g,format=yuv420p,setpts=PTS-STARTPTS[v%d]",
+			i, t.Width, t.Height, t.Width, t.Height, t.FrameRate, i))
+		// Silence for sources without audio, and audio is padded or
+		// trimmed to the source's duration so the fades line up
+		audio := fmt.Sprintf("anullsrc=r=%d:cl=%s", t.SampleRate, t.ChannelLayout)
+		if _, ok := info.Stream("audio"); ok {
+			audio = fmt.Sprintf("[%d:a:0]aresample=%d,aformat=sample_fmts=fltp:channel_layouts=%s,apad",
+				i, t.SampleRate, t.ChannelLayout)
+		}
+		filters = append(filters, fmt.Sprintf("%s,atrim=duration=%.6f,asetpts=PTS-STARTPTS[a%d]",
+			audio, info.Duration, i))
+	}
+
+	n := len(infos)
+	total := 0.0
+	for _, info := range infos {
+		total += info.Duration
+	}
+	if t.Crossfade == 0 {
+		streams := ""
+		for i := 0; i < n; i++ {
+			streams += fmt.Sprintf("[v%d][a%d]", i, i)
+		}
+		filters = append(filters, fmt.Sprintf("%sconcat=n=%d:v=1:a=1[v][a]", streams, n))
+		return strings.Join(filters, ";"), total, nil
+	}
+
+	// Each fade starts a crossfade before the end of what's been joined
+	// so far, so has to be done before the next one starts
+	offset := 0.0
+	prevV, prevA := "[v0]", "[a0]"
+	for i := 1; i < n; i++ {
+		need := t.Crossfade
+		if i < n-1 {
+			need *= 2
+		}
+		if infos[i].Duration <= need || infos[0].Duration <= t.Crossfade {
+			return "", 0, fmt.Errorf("srcURLs[%d] is too short for a %gs crossfade", i, t.Crossfade)
+		}
+		offset += infos[i-1].Duration - t.Crossfade
+		outV, outA := fmt.Sprintf("[vx%d]", i), fmt.Sprintf("[ax%d]", i)
+		if i == n-1 {
+			outV, outA = "[v]", "[a]"
+		}
+		filters = append(filters,
+			fmt.Sprintf("%s[v%d]xfade=transition=%s:duration=%g:offset=%.6f%s",
+				prevV, i, t.Transition, t.Crossfade, offset, outV),
+			fmt.Sprintf("%s[a%d]acrossfade=d=%g%s", prevA, i, t.Crossfade, outA))
+		prevV, prevA = outV, outA
+	}
+	return strings.Join(filters, ";"), total - float64(n-1)*t.Crossfade, nil
+}
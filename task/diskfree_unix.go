@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package task
+
+import "syscall"
+
+// freeSpace returns the bytes available to us on path's filesystem
+func freeSpace(path string) (int64, error) {
+	st := syscall.Statfs_t{}
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,6 @@
+package task
+
+// freeSpace returns -1 since free space isn't checked on windows
+func freeSpace(path string) (int64, error) {
+	return -1, nil
+}
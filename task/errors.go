@@ -0,0 +1,140 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Error categories, so clients can tell why a task failed
+// without having to pick apart ffmpeg's output
+const (
+	ErrorInputNotFound  = "input-not-found"
+	ErrorInvalidArgs    = "invalid-args"
+	ErrorEncoderFailure = "encoder-failure"
+	ErrorUploadFailure  = "upload-failure"
+	// The encode finished but isn't what was expected
+	ErrorVerificationFailure = "verification-failure"
+	ErrorTimeout             = "timeout"
+	ErrorWorkerFailure       = "worker-failure" // i.e. the worker ran out of disk
+	ErrorInternal            = "internal"
+)
+
+// Error is why a task failed
+type Error struct {
+	Category  string `json:"category"`
+	Message   string `json:"message"`
+	ExitCode  int    `json:"exitCode,omitempty"` // ffmpeg's, when it exited unsuccessfully
+	Retryable bool   `json:"retryable"`          // Whether running the job again could work
+
+	err error
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// NewError categorises err, errors which have already
+// been categorised are left as they are
+func NewError(category string, retryable bool, err error) error {
+	var te *Error
+	if errors.As(err, &te) || errors.Is(err, ErrInsufficientSpace) {
+		return err
+	}
+	return &Error{
+		Category:  category,
+		Message:   err.Error(),
+		Retryable: retryable,
+		err:       err,
+	}
+}
+
+// inputError categorises a failure to read a task's source,
+// it's only worth retrying if the source might be there
+func inputError(err error) error {
+	return NewError(ErrorInputNotFound, !errors.Is(err, os.ErrNotExist), err)
+}
+
+// AsError returns err as a categorised error, with the
+// message of the whole chain of errors
+func AsError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	te := &Error{}
+	var inner *Error
+	switch {
+	case errors.As(err, &inner):
+		*te = *inner
+	case errors.Is(err, ErrTimeout):
+		te.Category = ErrorTimeout
+	case errors.Is(err, ErrStalled):
+		// Usually a source which has stopped sending
+		te.Category = ErrorEncoderFailure
+		te.Retryable = true
+	case errors.Is(err, ErrInsufficientSpace):
+		te.Category = ErrorWorkerFailure
+		te.Retryable = true
+	default:
+		te.Category = ErrorInternal
+	}
+	te.Message = err.Error()
+	te.err = err
+	return te
+}
+
+// ffmpegErrorPatterns pick out why ffmpeg failed from what it printed
+var ffmpegErrorPatterns = []struct {
+	pattern   string
+	category  string
+	retryable bool
+}{
+	{"No such file or directory", ErrorInputNotFound, false},
+	{"404 Not Found", ErrorInputNotFound, false},
+	{"Server returned 404", ErrorInputNotFound, false},
+	{"Connection refused", ErrorInputNotFound, true},
+	{"Connection timed out", ErrorInputNotFound, true},
+	{"Unrecognized option", ErrorInvalidArgs, false},
+	{"Option not found", ErrorInvalidArgs, false},
+	{"Unknown encoder", ErrorInvalidArgs, false},
+	{"Invalid argument", ErrorInvalidArgs, false},
+	{"Error parsing", ErrorInvalidArgs, false},
+	{"No space left on device", ErrorWorkerFailure, true},
+}
+
+// ffmpegError categorises ffmpeg exiting unsuccessfully by the
+// last lines it printed, falling back to an encoder failure
+func ffmpegError(exitCode int, lines []string) error {
+	last := ""
+	if len(lines) > 0 {
+		last = lines[len(lines)-1]
+	}
+	te := &Error{
+		Category: ErrorEncoderFailure,
+		Message:  fmt.Sprintf("ffmpeg exited with code %d: %s", exitCode, last),
+		ExitCode: exitCode,
+	}
+	if exitCode == 127 {
+		// The shell couldn't find ffmpeg, another worker might have it
+		te.Category = ErrorWorkerFailure
+		te.Retryable = true
+		return te
+	}
+	// Later lines are closer to what actually went wrong
+	for i := len(lines) - 1; i >= 0; i-- {
+		for _, p := range ffmpegErrorPatterns {
+			if strings.Contains(lines[i], p.pattern) {
+				te.Category = p.category
+				te.Retryable = p.retryable
+				te.Message = fmt.Sprintf("ffmpeg exited with code %d: %s", exitCode, lines[i])
+				return te
+			}
+		}
+	}
+	return te
+}
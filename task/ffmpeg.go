@@ -0,0 +1,153 @@
+package task
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrStalled is returned when ffmpeg stops making progress
+	ErrStalled = errors.New("ffmpeg stalled")
+	// ErrTimeout is returned when a task runs for longer than it's allowed
+	ErrTimeout = errors.New("task timed out")
+)
+
+// progressPattern matches the frame count and position in ffmpeg's
+// progress lines, which stop changing when it has stalled. Outputs
+// without video don't have a frame count.
+var progressPattern = regexp.MustCompile(`(?:frame=\s*(\d+).*)?time=\s*(\S+)`)
+
+// ffmpegErrorLines is how many of ffmpeg's last lines
+// are looked at to work out why it failed
+const ffmpegErrorLines = 5
+
+// runFFmpeg runs an ffmpeg command line, parsing its progress into
+// stats and keeping its output in flog. ffmpeg is killed when ctx is done,
+// or when it hasn't made any progress for the stall timeout, in which
+// case it's tried again.
+func runFFmpeg(ctx context.Context, t Task, env *Env, cmdString string, stats *Stats, flog *FFmpegLog) error {
+	for attempt := 0; ; attempt++ {
+		err := runFFmpegOnce(ctx, t, env.StallTimeout, cmdString, stats, flog)
+		if !errors.Is(err, ErrStalled) || attempt >= env.StallRetries || ctx.Err() != nil {
+			return err
+		}
+		log.Printf("%s: %+v, retrying", t.GetID(), err)
+		*stats = Stats{}
+	}
+}
+
+func runFFmpegOnce(ctx context.Context, t Task, stall time.Duration, cmdString string, stats *Stats, flog *FFmpegLog) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// exec so ffmpeg replaces the shell, otherwise killing
+	// the shell would leave ffmpeg running
+	cmd := exec.CommandContext(ctx, "sh", "-c", "exec "+cmdString)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("pipe failed: %w", err)
+	}
+
+	log.Println(cmdString)
+	flog.Write(cmdString)
+
+	err = cmd.Start()
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, fmt.Errorf("failed to start ffmpeg: %w", err))
+	}
+
+	// Watchdog, ffmpeg hanging on a broken source
+	// would otherwise block us forever
+	mu := sync.Mutex{}
+	lastProgress := time.Now()
+	stalled := false
+	if stall > 0 {
+		go func() {
+			tick := time.NewTicker(stall / 4)
+			defer tick.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-tick.C:
+					mu.Lock()
+					stalled = time.Since(lastProgress) > stall
+					mu.Unlock()
+					if stalled {
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Split(scanLines)
+	progress := ""
+	curLine := ""
+	buf := ""
+
+	for scanner.Scan() {
+		curLine = scanner.Text()
+		flog.Write(curLine)
+		if m := progressPattern.FindStringSubmatch(curLine); m != nil && m[1]+m[2] != progress {
+			progress = m[1] + m[2]
+			mu.Lock()
+			lastProgress = time.Now()
+			mu.Unlock()
+		}
+		buf += curLine
+		ok := getStats(stats, buf)
+		if ok {
+			buf = ""
+			observeStats(t, stats)
+			log.Printf("%+v", stats)
+		}
+	}
+
+	err = cmd.Wait()
+	observeExit(cmd)
+	cancel()
+	mu.Lock()
+	defer mu.Unlock()
+	if stalled {
+		return fmt.Errorf("%w: no progress for %s", ErrStalled, stall)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		lines := flog.Tail(ffmpegErrorLines)
+		if len(lines) == 0 {
+			lines = []string{curLine}
+		}
+		return ffmpegError(exitErr.ExitCode(), lines)
+	}
+	if err != nil {
+		return fmt.Errorf("exec failed to wait: %+v: %s", err, curLine)
+	}
+	return nil
+}
+
+// scanLines splits on \r as well as \n, since ffmpeg
+// ends its progress lines with \r
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
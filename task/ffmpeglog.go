@@ -0,0 +1,171 @@
+package task
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// logRingLines is how many lines of ffmpeg's output are kept in memory
+	logRingLines = 200
+	// logTailLines is how many of those are sent with a failed task's status
+	logTailLines = 20
+	// logUploadTimeout limits how long uploading ffmpeg's log can hold up a task
+	logUploadTimeout = time.Minute
+)
+
+// FFmpegLog keeps what ffmpeg printed for a task, the most recent lines
+// in memory and all of it in a file when the task has somewhere to put it.
+// Progress lines only go to the file since they'd drown everything else out.
+type FFmpegLog struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	file  *os.File
+	path  string
+}
+
+// newFFmpegLog creates a log, appending to the file at path
+// if one is given so a retried task keeps its earlier output
+func newFFmpegLog(path string) (*FFmpegLog, error) {
+	l := &FFmpegLog{lines: make([]string, 0, logRingLines), path: path}
+	if path == "" {
+		return l, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ffmpeg log: %w", err)
+	}
+	l.file = f
+	return l, nil
+}
+
+// Write adds a line of ffmpeg's output
+func (l *FFmpegLog) Write(line string) {
+	if l == nil || line == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		fmt.Fprintln(l.file, line)
+	}
+	if progressPattern.MatchString(line) {
+		return
+	}
+	if len(l.lines) < logRingLines {
+		l.lines = append(l.lines, line)
+		return
+	}
+	l.lines[l.next] = line
+	l.next = (l.next + 1) % logRingLines
+}
+
+// Tail returns up to the last n lines kept in memory
+func (l *FFmpegLog) Tail(n int) []string {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ordered := append(append([]string{}, l.lines[l.next:]...), l.lines[:l.next]...)
+	if len(ordered) > n {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return ordered
+}
+
+// Path returns the file the full log is written to, if there is one
+func (l *FFmpegLog) Path() string {
+	if l == nil {
+		return ""
+	}
+	return l.path
+}
+
+// offset returns how much has been written to the log's file, so what
+// a command prints can be read back with scan once it's finished
+func (l *FFmpegLog) offset() (int64, error) {
+	if l == nil || l.file == nil {
+		return 0, fmt.Errorf("ffmpeg log has no file")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	info, err := l.file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat ffmpeg log: %w", err)
+	}
+	return info.Size(), nil
+}
+
+// scan calls fn with every line written to the log's file after offset
+func (l *FFmpegLog) scan(offset int64, fn func(line string)) error {
+	if l == nil || l.file == nil {
+		return fmt.Errorf("ffmpeg log has no file")
+	}
+	f, err := os.Open(l.path)
+	if err != nil {
+		return fmt.Errorf("failed to open ffmpeg log: %w", err)
+	}
+	defer f.Close()
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("failed to seek ffmpeg log: %w", err)
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fn(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read ffmpeg log: %w", err)
+	}
+	return nil
+}
+
+// Close closes the log's file
+func (l *FFmpegLog) Close() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// finishLog closes a task's log and uploads it to u, recording where in
+// the task's status. It's deferred so the log's uploaded whether or not
+// the task worked, so failures can be looked into. The log's only closed
+// when b is nil, since the task has nowhere to put it.
+func finishLog(ctx context.Context, l *FFmpegLog, b Backend, u *url.URL, status *Status) {
+	l.Close()
+	if b == nil || l.Path() == "" {
+		return
+	}
+	if errors.Is(ctx.Err(), context.Canceled) {
+		// The job's being requeued, it'll write its log next time
+		return
+	}
+	// The task's context is done when it's timed out, but that's
+	// exactly when the log's wanted
+	uctx, cancel := context.WithTimeout(context.Background(), logUploadTimeout)
+	defer cancel()
+	_, err := uploadOutput(uctx, b, u, l.Path())
+	if err != nil {
+		log.Printf("failed to upload ffmpeg log: %+v", err)
+		return
+	}
+	// Recorded as a storage URL for the manager to read it from,
+	// without any credentials
+	clean := *u
+	clean.User = nil
+	status.Log = clean.String()
+}
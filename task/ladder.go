@@ -0,0 +1,313 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Defaults for ladders which leave them out
+const (
+	defaultLadderCodec  = "libx264"
+	defaultLadderSample = 30 // seconds
+)
+
+var defaultLadderCRFs = []int{18, 23, 28, 33, 38}
+
+type (
+	// Ladder has a VOD job encode a rendition for each rung of a ladder
+	// picked for the source. Trial encodes of a sample of the source at
+	// each resolution and CRF are scored, and the rungs are the points on
+	// the convex hull of bitrate against quality which reach the targets.
+	Ladder struct {
+		Codec     string    `json:"codec,omitempty"`     // ffmpeg video encoder, defaults to libx264
+		Heights   []int     `json:"heights"`             // Resolutions to try, higher than the source's are skipped
+		CRFs      []int     `json:"crfs,omitempty"`      // Rate factors to try
+		Targets   []float64 `json:"targets"`             // Quality of each rung
+		Metric    string    `json:"metric,omitempty"`    // Quality metric, defaults to vmaf
+		Sample    int       `json:"sample,omitempty"`    // Seconds of the source to trial
+		Args      string    `json:"args,omitempty"`      // Extra video options for every encode
+		TrialArgs string    `json:"trialArgs,omitempty"` // Extra options for the trials, i.e. a faster preset
+	}
+	// LadderPoint is an encode at a resolution and CRF
+	LadderPoint struct {
+		Height  int     `json:"height"`
+		CRF     int     `json:"crf"`
+		Bitrate int64   `json:"bitrate"` // Bits per second, of the trial
+		Quality float64 `json:"quality"` // Mean of the ladder's metric, of the trial
+	}
+	// LadderResult is the ladder picked for a source
+	LadderResult struct {
+		Metric string        `json:"metric"`
+		Rungs  []LadderPoint `json:"rungs"` // Highest bitrate first, in the order of the outputs
+		Hull   []LadderPoint `json:"hull"`  // Trials on the convex hull, lowest bitrate first
+	}
+)
+
+// Validate checks the ladder can be used, filling in its defaults
+func (l *Ladder) Validate() error {
+	if l.Codec == "" {
+		l.Codec = defaultLadderCodec
+	}
+	if len(l.CRFs) == 0 {
+		l.CRFs = defaultLadderCRFs
+	}
+	if l.Metric == "" {
+		l.Metric = MetricVMAF
+	}
+	if l.Sample == 0 {
+		l.Sample = defaultLadderSample
+	}
+	if len(l.Heights) == 0 {
+		return fmt.Errorf("ladder needs heights to try")
+	}
+	if len(l.Targets) == 0 {
+		return fmt.Errorf("ladder needs target qualities")
+	}
+	for _, h := range l.Heights {
+		if h <= 0 || h%2 != 0 {
+			return fmt.Errorf("ladder height %d isn't a positive even number", h)
+		}
+	}
+	for _, crf := range l.CRFs {
+		if crf < 0 {
+			return fmt.Errorf("ladder crf %d can't be negative", crf)
+		}
+	}
+	if l.Sample < 0 {
+		return fmt.Errorf("ladder sample can't be negative")
+	}
+	return validateMetrics([]string{l.Metric})
+}
+
+// requirements adds what a worker needs to build the ladder
+func (l *Ladder) requirements(requires []string) []string {
+	requires = qualityRequirements([]string{l.Metric}, requires)
+	return addRequirement(requires, RequireEncoder+":"+l.Codec)
+}
+
+// trialArgs are the options for trial encodes, defaulting to a
+// faster preset for the encoders we know have them
+func (l *Ladder) trialArgs() string {
+	if l.TrialArgs == "" && (l.Codec == "libx264" || l.Codec == "libx265") {
+		return "-preset veryfast"
+	}
+	return l.TrialArgs
+}
+
+// encodeLadder trials encodes of the source to pick a ladder, then
+// encodes and uploads a rendition for each of its rungs
+func (t *VOD) encodeLadder(ctx context.Context, ws *Workspace, input string, src *ProbeInfo,
+	b Backend, dst *url.URL) (*Result, error) {
+	l := t.Ladder
+	heights := l.Heights
+	if src != nil {
+		if video, ok := src.Stream("video"); ok && video.Height > 0 {
+			heights = nil
+			for _, h := range l.Heights {
+				if h <= video.Height {
+					heights = append(heights, h)
+				}
+			}
+			if len(heights) == 0 {
+				heights = []int{video.Height - video.Height%2}
+			}
+		}
+	}
+
+	log.Printf("trialling ladder: %s", t.GetID())
+	startTrial := time.Now()
+	t.status.Stage = StageAnalysing
+	t.status.StageStart = startTrial
+
+	// The trials are encoded from and scored against a lossless
+	// copy of the sample, so the source is only read once
+	sample := ws.Path("sample.mkv")
+	seek := ""
+	if src != nil && src.Duration > float64(l.Sample) {
+		seek = fmt.Sprintf("-ss %.3f ", (src.Duration-float64(l.Sample))/2)
+	}
+	cmdString := fmt.Sprintf("\"%s\" -y %s-t %d -i \"%s\" -an -sn -c:v ffv1 \"%s\" 2>&1",
+		t.env.FFmpeg, seek, l.Sample, input, sample)
+	err := runFFmpeg(ctx, t, t.env, cmdString, t.stats, t.ffmpegLog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cut sample: %w", err)
+	}
+
+	trials := []LadderPoint{}
+	for _, h := range heights {
+		for _, crf := range l.CRFs {
+			p, err := t.trial(ctx, ws, sample, h, crf)
+			if err != nil {
+				return nil, err
+			}
+			trials = append(trials, p)
+		}
+	}
+	res := &LadderResult{Metric: l.Metric, Hull: convexHull(trials)}
+	res.Rungs = pickRungs(res.Hull, l.Targets)
+	log.Printf("finished trialling ladder - completed in %s, rungs: %+v", time.Since(startTrial), res.Rungs)
+
+	result := &Result{Ladder: res}
+	for _, rung := range res.Rungs {
+		out, err := t.encodeRung(ctx, ws, input, src, rung, b, dst)
+		if err != nil {
+			return nil, err
+		}
+		result.Outputs = append(result.Outputs, out)
+	}
+
+	err = notifyFinished(t.env, t.TaskID)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// trial encodes the sample at a resolution and CRF and scores it
+func (t *VOD) trial(ctx context.Context, ws *Workspace, sample string, height, crf int) (LadderPoint, error) {
+	l := t.Ladder
+	p := LadderPoint{Height: height, CRF: crf}
+	trial := ws.Path("trial.mkv")
+	cmdString := fmt.Sprintf("\"%s\" -y -i \"%s\" -an -vf scale=-2:%d -c:v %s -crf %d %s %s \"%s\" 2>&1",
+		t.env.FFmpeg, sample, height, l.Codec, crf, l.Args, l.trialArgs(), trial)
+	err := runFFmpeg(ctx, t, t.env, cmdString, t.stats, t.ffmpegLog)
+	if err != nil {
+		return p, fmt.Errorf("failed trial encode at %dp crf %d: %w", height, crf, err)
+	}
+
+	info, err := probe(ctx, t.env.FFprobe, trial)
+	if err != nil {
+		return p, fmt.Errorf("failed to probe trial encode: %w", err)
+	}
+	if info.Duration > 0 {
+		p.Bitrate = int64(float64(info.Size) * 8 / info.Duration)
+	}
+
+	scores, _, err := scoreQuality(ctx, t, t.env, t.stats, t.ffmpegLog, trial, sample, ws, []string{l.Metric})
+	if err != nil {
+		return p, fmt.Errorf("failed to score trial encode: %w", err)
+	}
+	p.Quality = scores[l.Metric].Mean
+	log.Printf("ladder trial %dp crf %d: %d b/s, %s %.2f", height, crf, p.Bitrate, l.Metric, p.Quality)
+	return p, nil
+}
+
+// encodeRung encodes, verifies and uploads a rung's rendition
+func (t *VOD) encodeRung(ctx context.Context, ws *Workspace, input string, src *ProbeInfo,
+	rung LadderPoint, b Backend, dst *url.URL) (Output, error) {
+	l := t.Ladder
+	rungDst := rungURL(dst, rung)
+	output := ws.Path(path.Base(rungDst.Path))
+
+	log.Printf("encoding rung %dp crf %d: %s", rung.Height, rung.CRF, t.GetID())
+	t.status.Stage = StageTranscoding
+	t.status.StageStart = time.Now()
+	args := fmt.Sprintf("-vf scale=-2:%d -c:v %s -crf %d %s %s", rung.Height, l.Codec, rung.CRF, l.Args, t.DstArgs)
+	cmdString := fmt.Sprintf("\"%s\" -y -i \"%s\" %s \"%s\" 2>&1", t.env.FFmpeg, input, args, output)
+	err := runFFmpeg(ctx, t, t.env, cmdString, t.stats, t.ffmpegLog)
+	if err != nil {
+		return Output{}, err
+	}
+
+	// The rung's resolution is the ladder's to pick
+	opts := t.Verify
+	opts.Width, opts.Height = 0, 0
+	t.status.Stage = StageVerifying
+	t.status.StageStart = time.Now()
+	err = verifyOutput(ctx, t.env, output, src, args, opts)
+	if err != nil {
+		return Output{}, err
+	}
+
+	t.status.Stage = StageUploading
+	t.status.StageStart = time.Now()
+	out, err := uploadOutput(ctx, b, rungDst, output)
+	if err != nil {
+		return Output{}, err
+	}
+	err = os.Remove(output)
+	if err != nil {
+		return Output{}, fmt.Errorf("failed to delete rung: %w", err)
+	}
+	return out, nil
+}
+
+// rungURL names a rung's rendition after the destination,
+// i.e. "video.mp4" becomes "video_720p_crf28.mp4"
+func rungURL(dst *url.URL, rung LadderPoint) *url.URL {
+	u := *dst
+	ext := path.Ext(u.Path)
+	u.Path = fmt.Sprintf("%s_%dp_crf%d%s", strings.TrimSuffix(u.Path, ext), rung.Height, rung.CRF, ext)
+	return &u
+}
+
+// convexHull finds the trials on the upper convex hull of quality against
+// bitrate, the best quality which can be had for each bitrate
+func convexHull(points []LadderPoint) []LadderPoint {
+	sorted := append([]LadderPoint{}, points...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Bitrate == sorted[j].Bitrate {
+			return sorted[i].Quality > sorted[j].Quality
+		}
+		return sorted[i].Bitrate < sorted[j].Bitrate
+	})
+
+	// A trial is only worth having if it beats every cheaper one
+	frontier := []LadderPoint{}
+	for _, p := range sorted {
+		if len(frontier) == 0 || p.Quality > frontier[len(frontier)-1].Quality {
+			frontier = append(frontier, p)
+		}
+	}
+
+	hull := []LadderPoint{}
+	for _, p := range frontier {
+		// Drop points under the line between their neighbours
+		for len(hull) >= 2 && cross(hull[len(hull)-2], hull[len(hull)-1], p) >= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	return hull
+}
+
+// cross is the z of the cross product of o->a and o->b, it's
+// positive when they turn anticlockwise
+func cross(o, a, b LadderPoint) float64 {
+	return float64(a.Bitrate-o.Bitrate)*(b.Quality-o.Quality) -
+		(a.Quality-o.Quality)*float64(b.Bitrate-o.Bitrate)
+}
+
+// pickRungs picks the cheapest point on the hull reaching each target,
+// or the best there is for targets which can't be reached
+func pickRungs(hull []LadderPoint, targets []float64) []LadderPoint {
+	rungs := []LadderPoint{}
+	picked := make(map[LadderPoint]bool)
+	for _, target := range targets {
+		if len(hull) == 0 {
+			break
+		}
+		rung := hull[len(hull)-1]
+		for _, p := range hull {
+			if p.Quality >= target {
+				rung = p
+				break
+			}
+		}
+		if !picked[rung] {
+			picked[rung] = true
+			rungs = append(rungs, rung)
+		}
+	}
+	sort.Slice(rungs, func(i, j int) bool {
+		return rungs[i].Bitrate > rungs[j].Bitrate
+	})
+	return rungs
+}
@@ -0,0 +1,82 @@
+package task
+
+import (
+	"io"
+	"os/exec"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics describing the tasks running on a worker. They're always
+// updated but only exposed once registered with RegisterMetrics.
+var (
+	activeTasks = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "vt",
+		Subsystem: "worker",
+		Name:      "active_tasks",
+		Help:      "Number of tasks currently running.",
+	}, []string{"type"})
+	encodeSpeed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "vt",
+		Subsystem: "worker",
+		Name:      "encode_speed",
+		Help:      "Current encode speed of a running task relative to realtime.",
+	}, []string{"task_id", "type"})
+	bytesUploaded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "vt",
+		Subsystem: "worker",
+		Name:      "uploaded_bytes_total",
+		Help:      "Bytes of finished encodes uploaded.",
+	})
+	bytesDownloaded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "vt",
+		Subsystem: "worker",
+		Name:      "downloaded_bytes_total",
+		Help:      "Bytes of source files downloaded.",
+	})
+	ffmpegExits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vt",
+		Subsystem: "worker",
+		Name:      "ffmpeg_exits_total",
+		Help:      "ffmpeg process exits by exit code.",
+	}, []string{"code"})
+)
+
+// RegisterMetrics adds the task metrics to a prometheus registry
+func RegisterMetrics(r prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		activeTasks, encodeSpeed, bytesUploaded, bytesDownloaded, ffmpegExits,
+	} {
+		err := r.Register(c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// observeStats records the progress of a running task
+func observeStats(t Task, s *Stats) {
+	encodeSpeed.WithLabelValues(t.GetID(), t.GetType()).Set(s.Speed)
+}
+
+// observeExit records the exit code of a finished ffmpeg process
+func observeExit(cmd *exec.Cmd) {
+	if cmd.ProcessState == nil {
+		return
+	}
+	ffmpegExits.WithLabelValues(strconv.Itoa(cmd.ProcessState.ExitCode())).Inc()
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r       io.Reader
+	counter prometheus.Counter
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.counter.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,194 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const TypeMux string = "video/mux"
+
+var _ Task = &Mux{}
+
+// Mux task joins the segments of a chunked VOD job together with
+// the source's audio, then verifies and uploads the result
+type Mux struct {
+	TaskID      string   `json:"taskID"`
+	ParentID    string   `json:"parentID"` // VOD job being muxed
+	SrcURL      string   `json:"srcURL"`
+	SegmentURLs []string `json:"segmentURLs"` // In the order they're played
+	AudioArgs   string   `json:"audioArgs"`
+	DstURL      string   `json:"dstURL"`
+	Download    bool     `json:"download"`
+	// Checks the result has to pass before it's uploaded
+	Verify  VerifyOptions `json:"verify"`
+	Timeout int           `json:"timeout,omitempty"`
+
+	status    Status
+	stats     *Stats
+	ffmpegLog *FFmpegLog
+
+	// dependencies
+	env *Env
+}
+
+// NewMux initialises a Mux task object so we can
+// add the tasks dependencies
+func NewMux(env *Env) Mux {
+	return Mux{
+		stats: &Stats{},
+		env:   env,
+	}
+}
+
+// GetID returns a task ID
+func (t *Mux) GetID() string {
+	return t.TaskID
+}
+
+// GetType returns the task's type
+func (t *Mux) GetType() string {
+	return TypeMux
+}
+
+// GetTimeout returns the job's maximum runtime
+func (t *Mux) GetTimeout() time.Duration {
+	return time.Duration(t.Timeout) * time.Second
+}
+
+// GetStatus returns the task's status
+func (t *Mux) GetStatus() Status {
+	t.status.TaskID = t.TaskID
+	if t.stats != nil {
+		t.status.Stats = *t.stats
+	}
+	return t.status
+}
+
+// ValidateRequest checks the request
+func (t *Mux) ValidateRequest() error {
+	if t.SrcURL == "" {
+		return fmt.Errorf("missing srcURL")
+	}
+	if t.DstURL == "" {
+		return fmt.Errorf("missing dstURL")
+	}
+	if len(t.SegmentURLs) == 0 {
+		return fmt.Errorf("missing segmentURLs")
+	}
+	if err := t.Verify.Validate(); err != nil {
+		return err
+	}
+	t.TaskID = uuid.NewString()
+	return nil
+}
+
+// Start downloads the segments, joins them and uploads the result
+func (t *Mux) Start(ctx context.Context) error {
+	t.status.Stage = StageStarted
+	t.status.StageStart = time.Now()
+
+	b, dst, err := t.env.Store.Resolve(t.DstURL)
+	if err != nil {
+		return NewError(ErrorInvalidArgs, false, fmt.Errorf("failed to resolve destination: %w", err))
+	}
+	ws, err := t.env.Workspaces.Create(t.TaskID)
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer ws.Remove()
+	t.ffmpegLog, err = newFFmpegLog(ws.Path("ffmpeg.log"))
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer finishLog(ctx, t.ffmpegLog, b, withSuffix(dst, ".log"), &t.status)
+
+	input, release, err := openSource(ctx, t.env, t.SrcURL, t.Download, &t.status)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// The concat demuxer reads the segments from a list of them,
+	// they're always downloaded since it can't read every backend
+	segments := []string{}
+	for _, u := range t.SegmentURLs {
+		segment, release, err := openSource(ctx, t.env, u, true, &t.status)
+		if err != nil {
+			return err
+		}
+		defer release()
+		segments = append(segments, segment)
+	}
+	listPath := ws.Path("segments.txt")
+	err = writeConcatList(listPath, segments)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("muxing %d segments of %s: %s", len(t.SegmentURLs), t.ParentID, t.GetID())
+	startMux := time.Now()
+	t.status.Stage = StageTranscoding
+	t.status.StageStart = startMux
+	output := ws.Path(path.Base(dst.Path))
+	args := "-map 0:v:0 -map \"1:a?\" -c:v copy " + t.AudioArgs
+	cmdString := fmt.Sprintf("\"%s\" -y -f concat -safe 0 -i \"%s\" -i \"%s\" %s \"%s\" 2>&1",
+		t.env.FFmpeg, listPath, input, args, output)
+	err = runFFmpeg(ctx, t, t.env, cmdString, t.stats, t.ffmpegLog)
+	if err != nil {
+		return err
+	}
+	log.Printf("finished muxing - completed in %s", time.Since(startMux))
+
+	// Checks are skipped when the source can't be probed
+	var srcInfo *ProbeInfo
+	if info, perr := probe(ctx, t.env.FFprobe, input); perr == nil {
+		srcInfo = &info
+	} else {
+		log.Printf("skipping checks against source: %+v", perr)
+	}
+	t.status.Stage = StageVerifying
+	t.status.StageStart = time.Now()
+	// Our -map would turn off the checks for the streams the source has
+	err = verifyOutput(ctx, t.env, output, srcInfo, t.AudioArgs, t.Verify)
+	if err != nil {
+		return err
+	}
+
+	t.status.Stage = StageUploading
+	t.status.StageStart = time.Now()
+	out, err := uploadOutput(ctx, b, dst, output)
+	if err != nil {
+		return err
+	}
+	err = notifyFinished(t.env, t.ParentID)
+	if err != nil {
+		return err
+	}
+	t.status.Result = &Result{Outputs: []Output{out}}
+	return nil
+}
+
+// LogTail returns the end of ffmpeg's output
+func (t *Mux) LogTail() []string {
+	return t.ffmpegLog.Tail(logTailLines)
+}
+
+// writeConcatList writes the list of files ffmpeg's concat demuxer reads
+func writeConcatList(listPath string, files []string) error {
+	list := strings.Builder{}
+	for _, f := range files {
+		fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(f, "'", `'\''`))
+	}
+	err := os.WriteFile(listPath, []byte(list.String()), 0644)
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, fmt.Errorf("failed to write concat list: %w", err))
+	}
+	return nil
+}
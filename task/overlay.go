@@ -0,0 +1,244 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Defaults for overlays which leave them out
+const (
+	defaultOverlayPosition = "top-right"
+	defaultFontSize        = 36
+	defaultFontColor       = "white"
+)
+
+// overlayPositions are where an overlay of size w x h can go in a video
+// of W x H, in expressions for ffmpeg with the margin as M
+var overlayPositions = map[string][2]string{
+	"top-left":     {"M", "M"},
+	"top-right":    {"W-w-M", "M"},
+	"bottom-left":  {"M", "H-h-M"},
+	"bottom-right": {"W-w-M", "H-h-M"},
+	"center":       {"(W-w)/2", "(H-h)/2"},
+}
+
+var (
+	// filterArg matches options which set a video filter graph
+	filterArg = regexp.MustCompile(`(^|\s)-(vf|filter:v|filter_complex|lavfi)(\s|$)`)
+	// Fonts, colours and subtitle styles end up in filter graphs, so
+	// they're kept to characters which don't need escaping
+	fontPattern  = regexp.MustCompile(`^[A-Za-z0-9 _-]+$`)
+	colorPattern = regexp.MustCompile(`^[A-Za-z0-9#]+$`)
+	stylePattern = regexp.MustCompile(`^[A-Za-z0-9=,&. ]+$`)
+)
+
+type (
+	// Overlay is an image or text drawn over an encode, i.e. a channel bug
+	Overlay struct {
+		ImageURL string `json:"imageURL,omitempty"` // Image to overlay, see Storage
+		Text     string `json:"text,omitempty"`     // Or text to draw
+		// Where it goes, "top-left", "top-right", "bottom-left",
+		// "bottom-right" or "center", and pixels from the edges
+		Position string `json:"position,omitempty"`
+		Margin   int    `json:"margin,omitempty"`
+		// Image width as a fraction of the video's, 0 keeps its size
+		Scale float64 `json:"scale,omitempty"`
+		// From 0 to 1, defaults to opaque
+		Opacity float64 `json:"opacity,omitempty"`
+		// Seconds it's shown from and until, End is 0 for the end
+		Start float64 `json:"start,omitempty"`
+		End   float64 `json:"end,omitempty"`
+		// Text options, Font is a fontconfig family name
+		Font      string `json:"font,omitempty"`
+		FontSize  int    `json:"fontSize,omitempty"`
+		FontColor string `json:"fontColor,omitempty"`
+	}
+	// Subtitles are burnt into an encode
+	Subtitles struct {
+		URL string `json:"url"` // SRT or ASS file, see Storage
+		// ASS style overrides for SRT, i.e. "FontSize=24,Outline=2"
+		Style string `json:"style,omitempty"`
+	}
+)
+
+// validateOverlays checks the overlays and subtitles make sense,
+// filling in their defaults
+func validateOverlays(overlays []Overlay, subs *Subtitles, dstArgs string) error {
+	if len(overlays) == 0 && subs == nil {
+		return nil
+	}
+	if filterArg.MatchString(dstArgs) {
+		return fmt.Errorf("overlays and subtitles can't be used with video filters in dstArgs")
+	}
+	for i := range overlays {
+		o := &overlays[i]
+		if (o.ImageURL == "") == (o.Text == "") {
+			return fmt.Errorf("overlay %d needs either an imageURL or text", i)
+		}
+		if o.ImageURL != "" {
+			if err := validateStorageURL(o.ImageURL); err != nil {
+				return fmt.Errorf("overlay %d: invalid imageURL: %w", i, err)
+			}
+		}
+		if o.Position == "" {
+			o.Position = defaultOverlayPosition
+		}
+		if _, ok := overlayPositions[o.Position]; !ok {
+			return fmt.Errorf("overlay %d: unknown position \"%s\"", i, o.Position)
+		}
+		if o.Opacity == 0 {
+			o.Opacity = 1
+		}
+		if o.FontSize == 0 {
+			o.FontSize = defaultFontSize
+		}
+		if o.FontColor == "" {
+			o.FontColor = defaultFontColor
+		}
+		if o.Margin < 0 || o.Scale < 0 || o.Opacity < 0 || o.Opacity > 1 || o.FontSize < 0 {
+			return fmt.Errorf("overlay %d: margin, scale and fontSize can't be negative and opacity is from 0 to 1", i)
+		}
+		if o.Start < 0 || (o.End != 0 && o.End <= o.Start) {
+			return fmt.Errorf("overlay %d: end has to be after start", i)
+		}
+		if o.Font != "" && !fontPattern.MatchString(o.Font) {
+			return fmt.Errorf("overlay %d: invalid font \"%s\"", i, o.Font)
+		}
+		if !colorPattern.MatchString(o.FontColor) {
+			return fmt.Errorf("overlay %d: invalid fontColor \"%s\"", i, o.FontColor)
+		}
+	}
+	if subs != nil {
+		if subs.URL == "" {
+			return fmt.Errorf("missing subtitles url")
+		}
+		if err := validateStorageURL(subs.URL); err != nil {
+			return fmt.Errorf("invalid subtitles url: %w", err)
+		}
+		if subs.Style != "" && !stylePattern.MatchString(subs.Style) {
+			return fmt.Errorf("invalid subtitles style \"%s\"", subs.Style)
+		}
+	}
+	return nil
+}
+
+// overlayRequirements adds the filters a worker needs to draw
+// the overlays and subtitles to a job's requirements
+func overlayRequirements(overlays []Overlay, subs *Subtitles, requires []string) []string {
+	for _, o := range overlays {
+		if o.Text != "" {
+			requires = addRequirement(requires, RequireFilter+":drawtext")
+		}
+	}
+	if subs != nil {
+		requires = addRequirement(requires, RequireFilter+":subtitles")
+	}
+	return requires
+}
+
+// overlayArgs fetches the overlays' images and the subtitles, returning
+// the ffmpeg options which draw them over the first input's video. They
+// go between the input and the output options. Only the input's first
+// audio stream is kept alongside the video, like ffmpeg picks without
+// maps. release must be called once ffmpeg's done.
+func overlayArgs(ctx context.Context, env *Env, ws *Workspace, overlays []Overlay, subs *Subtitles,
+	download bool, status *Status) (string, func(), error) {
+	releases := []func(){}
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	if len(overlays) == 0 && subs == nil {
+		return "", release, nil
+	}
+
+	inputs := []string{}
+	filters := []string{}
+	cur := "[0:v]"
+	for i, o := range overlays {
+		next := fmt.Sprintf("[ov%d]", i)
+		enable := ""
+		if o.End > 0 {
+			enable = fmt.Sprintf(":enable='between(t,%g,%g)'", o.Start, o.End)
+		} else if o.Start > 0 {
+			enable = fmt.Sprintf(":enable='gte(t,%g)'", o.Start)
+		}
+
+		if o.Text != "" {
+			// Read from a file so the text doesn't need escaping
+			textPath := ws.Path(fmt.Sprintf("overlay%d.txt", i))
+			err := os.WriteFile(textPath, []byte(o.Text), 0644)
+			if err != nil {
+				release()
+				return "", nil, NewError(ErrorWorkerFailure, true, fmt.Errorf("failed to write overlay text: %w", err))
+			}
+			x, y := overlayPosition(o, "tw", "th")
+			font := ""
+			if o.Font != "" {
+				font = fmt.Sprintf(":font='%s'", o.Font)
+			}
+			filters = append(filters, fmt.Sprintf(
+				"%sdrawtext=textfile='%s':expansion=none:fontsize=%d:fontcolor=%s@%g%s:x=%s:y=%s%s%s",
+				cur, textPath, o.FontSize, o.FontColor, o.Opacity, font, x, y, enable, next))
+			cur = next
+			continue
+		}
+
+		image, r, err := openSource(ctx, env, o.ImageURL, download, status)
+		if err != nil {
+			release()
+			return "", nil, err
+		}
+		releases = append(releases, r)
+		inputs = append(inputs, fmt.Sprintf("-i \"%s\"", image))
+		img := fmt.Sprintf("[%d:v]", len(inputs))
+		if o.Scale > 0 {
+			// Scaled relative to the video, keeping the image's aspect ratio
+			base := fmt.Sprintf("[ovb%d]", i)
+			filters = append(filters, fmt.Sprintf("%s%sscale2ref=w=main_w*%g:h=ow/dar[ovs%d]%s",
+				img, cur, o.Scale, i, base))
+			img, cur = fmt.Sprintf("[ovs%d]", i), base
+		}
+		filters = append(filters, fmt.Sprintf("%sformat=rgba,colorchannelmixer=aa=%g[ovi%d]", img, o.Opacity, i))
+		x, y := overlayPosition(o, "w", "h")
+		filters = append(filters, fmt.Sprintf("%s[ovi%d]overlay=x=%s:y=%s%s%s", cur, i, x, y, enable, next))
+		cur = next
+	}
+
+	// Subtitles go over everything else
+	if subs != nil {
+		path, r, err := openSource(ctx, env, subs.URL, true, status)
+		if err != nil {
+			release()
+			return "", nil, err
+		}
+		releases = append(releases, r)
+		style := ""
+		if subs.Style != "" {
+			style = fmt.Sprintf(":force_style='%s'", subs.Style)
+		}
+		filters = append(filters, fmt.Sprintf("%ssubtitles=filename='%s'%s[subs]", cur, path, style))
+		cur = "[subs]"
+	}
+
+	args := fmt.Sprintf("%s -filter_complex \"%s\" -map \"%s\" -map \"0:a:0?\"",
+		strings.Join(inputs, " "), strings.Join(filters, ";"), cur)
+	return strings.TrimSpace(args), release, nil
+}
+
+// overlayPosition returns where an overlay goes, w and h are the
+// names of its size in the filter drawing it
+func overlayPosition(o Overlay, w, h string) (string, string) {
+	pos := overlayPositions[o.Position]
+	margin := fmt.Sprint(o.Margin)
+	expr := func(e string) string {
+		e = strings.ReplaceAll(e, "M", margin)
+		e = strings.ReplaceAll(e, "w", w)
+		return strings.ReplaceAll(e, "h", h)
+	}
+	return expr(pos[0]), expr(pos[1])
+}
@@ -0,0 +1,180 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// estimateMargin is added on top of size estimates since
+// bitrates are targets rather than limits
+const estimateMargin = 1.25
+
+// bitrateArg matches ffmpeg's bitrate options and their value
+var bitrateArg = regexp.MustCompile(`-(b|b:[va](?::\d+)?|maxrate(?::[va])?)\s+(\d+(?:\.\d+)?)([kKmMgG]?)`)
+
+type (
+	// ProbeInfo is what ffprobe tells us about a file
+	ProbeInfo struct {
+		Duration float64 // Seconds
+		// Seconds the first frame is at, timestamps ffmpeg prints include it
+		StartTime float64
+		Size      int64 // Bytes, 0 when unknown
+		BitRate   int64 // Bits per second, 0 when unknown
+		Streams   []ProbeStream
+	}
+	// ProbeStream is one of the streams in a file
+	ProbeStream struct {
+		Type   string // "video", "audio", "subtitle" or "data"
+		Codec  string
+		Width  int
+		Height int
+		// Frames per second, 0 when unknown
+		FrameRate float64
+		// The frame rate as ffprobe gives it, i.e. "30000/1001"
+		Rate    string
+		PixFmt  string
+		Profile string // i.e. "High" or "Main 10"
+		Level   int    // i.e. 40 for H.264 level 4, -99 when unknown
+		// Audio samples per second, 0 when unknown
+		SampleRate int
+	}
+	ffprobeOutput struct {
+		Format struct {
+			Duration  string `json:"duration"`
+			StartTime string `json:"start_time"`
+			Size      string `json:"size"`
+			BitRate   string `json:"bit_rate"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType  string `json:"codec_type"`
+			CodecName  string `json:"codec_name"`
+			Width      int    `json:"width"`
+			Height     int    `json:"height"`
+			FrameRate  string `json:"r_frame_rate"`
+			PixFmt     string `json:"pix_fmt"`
+			Profile    string `json:"profile"`
+			Level      int    `json:"level"`
+			SampleRate string `json:"sample_rate"`
+		} `json:"streams"`
+	}
+)
+
+// probe runs ffprobe on a file
+func probe(ctx context.Context, ffprobe, input string) (ProbeInfo, error) {
+	out, err := exec.CommandContext(ctx, ffprobe, "-v", "error",
+		"-print_format", "json", "-show_format", "-show_streams", input).Output()
+	if err != nil {
+		return ProbeInfo{}, fmt.Errorf("failed to probe: %w", err)
+	}
+	res := ffprobeOutput{}
+	err = json.Unmarshal(out, &res)
+	if err != nil {
+		return ProbeInfo{}, fmt.Errorf("failed to unmarshal probe: %w", err)
+	}
+	info := ProbeInfo{}
+	info.Duration, _ = strconv.ParseFloat(res.Format.Duration, 64)
+	info.StartTime, _ = strconv.ParseFloat(res.Format.StartTime, 64)
+	info.Size, _ = strconv.ParseInt(res.Format.Size, 10, 64)
+	info.BitRate, _ = strconv.ParseInt(res.Format.BitRate, 10, 64)
+	for _, st := range res.Streams {
+		sampleRate, _ := strconv.Atoi(st.SampleRate)
+		info.Streams = append(info.Streams, ProbeStream{
+			Type:       st.CodecType,
+			Codec:      st.CodecName,
+			Width:      st.Width,
+			Height:     st.Height,
+			FrameRate:  parseRate(st.FrameRate),
+			Rate:       st.FrameRate,
+			PixFmt:     st.PixFmt,
+			Profile:    st.Profile,
+			Level:      st.Level,
+			SampleRate: sampleRate,
+		})
+	}
+	return info, nil
+}
+
+// Stream returns the first stream of a type
+func (p ProbeInfo) Stream(streamType string) (ProbeStream, bool) {
+	return p.NthStream(streamType, 0)
+}
+
+// NthStream returns the stream of a type at an index counted
+// from 0, the way ffmpeg's stream specifiers count them
+func (p ProbeInfo) NthStream(streamType string, n int) (ProbeStream, bool) {
+	for _, st := range p.Streams {
+		if st.Type != streamType {
+			continue
+		}
+		if n == 0 {
+			return st, true
+		}
+		n--
+	}
+	return ProbeStream{}, false
+}
+
+// parseRate parses a rate ffprobe gives as a fraction, i.e. "30000/1001"
+func parseRate(rate string) float64 {
+	num, den := rate, "1"
+	if i := strings.Index(rate, "/"); i >= 0 {
+		num, den = rate[:i], rate[i+1:]
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// hasVideoBitrate returns whether ffmpeg arguments set a video bitrate
+func hasVideoBitrate(args string) bool {
+	for _, m := range bitrateArg.FindAllStringSubmatch(args, -1) {
+		if m[1] == "b" || strings.HasPrefix(m[1], "b:v") {
+			return true
+		}
+	}
+	return false
+}
+
+// estimateOutputSize guesses the size of an encode from the bitrates
+// in its arguments, falling back to the size of the source
+func estimateOutputSize(args string, src ProbeInfo) int64 {
+	rates := make(map[string]float64)
+	for _, m := range bitrateArg.FindAllStringSubmatch(args, -1) {
+		rate, _ := strconv.ParseFloat(m[2], 64)
+		switch strings.ToLower(m[3]) {
+		case "k":
+			rate *= 1e3
+		case "m":
+			rate *= 1e6
+		case "g":
+			rate *= 1e9
+		}
+		// maxrate is the better bound when both are given
+		stream := "v"
+		if strings.HasSuffix(m[1], ":a") || strings.HasPrefix(m[1], "b:a") {
+			stream = "a"
+		}
+		if rate > rates[stream] {
+			rates[stream] = rate
+		}
+	}
+
+	size := float64(src.Size)
+	if rates["v"] > 0 && src.Duration > 0 {
+		size = (rates["v"] + rates["a"]) * src.Duration / 8
+	} else if size == 0 && src.BitRate > 0 {
+		size = float64(src.BitRate) * src.Duration / 8
+	}
+	return int64(size * estimateMargin)
+}
@@ -0,0 +1,388 @@
+package task
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const TypeQuality string = "video/quality"
+
+// Quality metrics an encode can be scored with
+const (
+	MetricVMAF = "vmaf"
+	MetricSSIM = "ssim"
+	MetricPSNR = "psnr"
+)
+
+// psnrMax is the PSNR given to identical frames, which
+// ffmpeg reports as infinite
+const psnrMax = 100
+
+var (
+	ssimPattern = regexp.MustCompile(`All:(\S+)`)
+	psnrPattern = regexp.MustCompile(`psnr_avg:(\S+)`)
+)
+
+var _ Task = &Quality{}
+
+type (
+	// Quality task scores an encode against its source
+	Quality struct {
+		TaskID string `json:"taskID"` // Task UUID
+		SrcURL string `json:"srcURL"` // Location of the source the encode was made from
+		EncURL string `json:"encURL"` // Location of the encode, see Storage
+		// Where the per-frame scores are uploaded to, optional
+		DstURL string `json:"dstURL,omitempty"`
+		// Metrics to score with, defaults to all of them
+		Metrics  []string `json:"metrics,omitempty"`
+		Download bool     `json:"download"`
+		// Worker capabilities the job needs, i.e. "encoder:libsvtav1"
+		Requires []string `json:"requires,omitempty"`
+		// Maximum seconds the job can run for, 0 uses the worker's limit
+		Timeout int `json:"timeout,omitempty"`
+
+		status    Status
+		stats     *Stats
+		ffmpegLog *FFmpegLog
+
+		// dependencies
+		env *Env
+	}
+	// QualityScores are an encode's scores by metric
+	QualityScores map[string]MetricSummary
+	// MetricSummary is a metric's scores across every frame
+	MetricSummary struct {
+		Mean float64 `json:"mean"`
+		Min  float64 `json:"min"`
+		Max  float64 `json:"max"`
+		P1   float64 `json:"p1"` // 1st percentile, the worst frames
+		P5   float64 `json:"p5"`
+		P50  float64 `json:"p50"`
+	}
+	// qualityFrames is the per-frame scores uploaded alongside the summary
+	qualityFrames struct {
+		Metrics []string             `json:"metrics"`
+		Frames  []map[string]float64 `json:"frames"`
+	}
+	vmafLog struct {
+		Frames []struct {
+			Metrics map[string]float64 `json:"metrics"`
+		} `json:"frames"`
+	}
+)
+
+// NewQuality initialises a Quality task object so we can
+// add the tasks dependencies
+func NewQuality(env *Env) Quality {
+	return Quality{
+		stats: &Stats{},
+		env:   env,
+	}
+}
+
+// GetID returns a task ID
+func (t *Quality) GetID() string {
+	return t.TaskID
+}
+
+// GetType returns the task's type
+func (t *Quality) GetType() string {
+	return TypeQuality
+}
+
+// GetTimeout returns the job's maximum runtime
+func (t *Quality) GetTimeout() time.Duration {
+	return time.Duration(t.Timeout) * time.Second
+}
+
+// GetStatus returns the task's status
+func (t *Quality) GetStatus() Status {
+	t.status.TaskID = t.TaskID
+	if t.stats != nil {
+		t.status.Stats = *t.stats
+	}
+	return t.status
+}
+
+// ValidateRequest checks the request, VMAF needs a worker with libvmaf
+// so it's added to the job's requirements
+func (t *Quality) ValidateRequest() error {
+	if t.SrcURL == "" {
+		return fmt.Errorf("missing srcURL")
+	}
+	if t.EncURL == "" {
+		return fmt.Errorf("missing encURL")
+	}
+	if err := validateStorageURL(t.SrcURL); err != nil {
+		return fmt.Errorf("invalid srcURL: %w", err)
+	}
+	if err := validateStorageURL(t.EncURL); err != nil {
+		return fmt.Errorf("invalid encURL: %w", err)
+	}
+	if t.DstURL != "" {
+		if err := validateStorageURL(t.DstURL); err != nil {
+			return fmt.Errorf("invalid dstURL: %w", err)
+		}
+	}
+	if len(t.Metrics) == 0 {
+		t.Metrics = []string{MetricVMAF, MetricSSIM, MetricPSNR}
+	}
+	if err := validateMetrics(t.Metrics); err != nil {
+		return err
+	}
+	t.Requires = qualityRequirements(t.Metrics, t.Requires)
+	if err := ValidateRequirements(t.Requires); err != nil {
+		return err
+	}
+	t.TaskID = uuid.NewString()
+	return nil
+}
+
+// Start scores the encode
+func (t *Quality) Start(ctx context.Context) error {
+	t.status.Stage = StageStarted
+	t.status.StageStart = time.Now()
+	// The log goes alongside the frame scores, or the encode without them
+	logURL := t.DstURL
+	if logURL == "" {
+		logURL = t.EncURL
+	}
+	lb, ldst, err := t.env.Store.Resolve(logURL)
+	if err != nil {
+		return NewError(ErrorInvalidArgs, false, fmt.Errorf("failed to resolve destination: %w", err))
+	}
+	ws, err := t.env.Workspaces.Create(t.TaskID)
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer ws.Remove()
+	t.ffmpegLog, err = newFFmpegLog(ws.Path("ffmpeg.log"))
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer finishLog(ctx, t.ffmpegLog, lb, withSuffix(ldst, ".log"), &t.status)
+
+	ref, release, err := openSource(ctx, t.env, t.SrcURL, t.Download, &t.status)
+	if err != nil {
+		return err
+	}
+	defer release()
+	enc, releaseEnc, err := openSource(ctx, t.env, t.EncURL, t.Download, &t.status)
+	if err != nil {
+		return err
+	}
+	defer releaseEnc()
+
+	t.status.Stage = StageScoring
+	t.status.StageStart = time.Now()
+	scores, frames, err := scoreQuality(ctx, t, t.env, t.stats, t.ffmpegLog, enc, ref, ws, t.Metrics)
+	if err != nil {
+		return err
+	}
+	result := &Result{Quality: scores}
+
+	if t.DstURL != "" {
+		t.status.Stage = StageUploading
+		t.status.StageStart = time.Now()
+		b, dst, err := t.env.Store.Resolve(t.DstURL)
+		if err != nil {
+			return NewError(ErrorInvalidArgs, false, fmt.Errorf("failed to resolve destination: %w", err))
+		}
+		out, err := uploadOutput(ctx, b, dst, frames)
+		if err != nil {
+			return err
+		}
+		result.Outputs = append(result.Outputs, out)
+	}
+	t.status.Result = result
+	return nil
+}
+
+// LogTail returns the end of ffmpeg's output
+func (t *Quality) LogTail() []string {
+	return t.ffmpegLog.Tail(logTailLines)
+}
+
+// validateMetrics checks the metrics are ones we can score with
+func validateMetrics(metrics []string) error {
+	seen := make(map[string]bool)
+	for _, m := range metrics {
+		if seen[m] {
+			return fmt.Errorf("quality metric \"%s\" is repeated", m)
+		}
+		seen[m] = true
+		switch m {
+		case MetricVMAF, MetricSSIM, MetricPSNR:
+		default:
+			return fmt.Errorf("unknown quality metric \"%s\"", m)
+		}
+	}
+	return nil
+}
+
+// qualityRequirements adds what a worker needs to score with
+// the metrics to a job's requirements
+func qualityRequirements(metrics, requires []string) []string {
+	for _, m := range metrics {
+		if m == MetricVMAF {
+			return addRequirement(requires, RequireFilter+":libvmaf")
+		}
+	}
+	return requires
+}
+
+// scoreQuality compares an encode against its reference with ffmpeg,
+// the encode is scaled to the reference's resolution first. Returns
+// the summarised scores and the path of a file with every frame's.
+func scoreQuality(ctx context.Context, t Task, env *Env, stats *Stats, flog *FFmpegLog,
+	encode, reference string, ws *Workspace, metrics []string) (QualityScores, string, error) {
+	n := len(metrics)
+	graph := "[0:v]setpts=PTS-STARTPTS[e];[1:v]setpts=PTS-STARTPTS[r];" +
+		"[e][r]scale2ref=flags=bicubic[dist][ref]"
+	dist := []string{"[dist]"}
+	ref := []string{"[ref]"}
+	if n > 1 {
+		dist, ref = nil, nil
+		for i := 0; i < n; i++ {
+			dist = append(dist, fmt.Sprintf("[d%d]", i))
+			ref = append(ref, fmt.Sprintf("[r%d]", i))
+		}
+		graph += fmt.Sprintf(";[dist]split=%d%s;[ref]split=%d%s",
+			n, strings.Join(dist, ""), n, strings.Join(ref, ""))
+	}
+	logs := make([]string, n)
+	for i, m := range metrics {
+		logs[i] = ws.Path(m + ".log")
+		graph += ";" + dist[i] + ref[i]
+		switch m {
+		case MetricVMAF:
+			graph += fmt.Sprintf("libvmaf=log_fmt=json:log_path='%s'", logs[i])
+		case MetricSSIM:
+			graph += fmt.Sprintf("ssim=stats_file='%s'", logs[i])
+		case MetricPSNR:
+			graph += fmt.Sprintf("psnr=stats_file='%s'", logs[i])
+		}
+	}
+
+	log.Printf("scoring quality: %s", t.GetID())
+	startScore := time.Now()
+	cmdString := fmt.Sprintf("\"%s\" -hide_banner -y -i \"%s\" -i \"%s\" -lavfi \"%s\" -f null - 2>&1",
+		env.FFmpeg, encode, reference, graph)
+	err := runFFmpeg(ctx, t, env, cmdString, stats, flog)
+	if err != nil {
+		return nil, "", err
+	}
+
+	scores := QualityScores{}
+	frames := qualityFrames{Metrics: metrics}
+	for i, m := range metrics {
+		values, err := readMetricLog(m, logs[i])
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read %s scores: %w", m, err)
+		}
+		scores[m] = summariseMetric(values)
+		for f, v := range values {
+			if f == len(frames.Frames) {
+				frames.Frames = append(frames.Frames, map[string]float64{})
+			}
+			frames.Frames[f][m] = v
+		}
+	}
+
+	framesPath := ws.Path("quality.json")
+	b, err := json.Marshal(frames)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal frame scores: %w", err)
+	}
+	err = os.WriteFile(framesPath, b, 0644)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to write frame scores: %w", err)
+	}
+	log.Printf("finished scoring - completed in %s", time.Since(startScore))
+	return scores, framesPath, nil
+}
+
+// readMetricLog reads each frame's score from the file the metric's filter wrote
+func readMetricLog(metric, path string) ([]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := []float64{}
+	if metric == MetricVMAF {
+		vl := vmafLog{}
+		err = json.NewDecoder(f).Decode(&vl)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal vmaf log: %w", err)
+		}
+		for _, frame := range vl.Frames {
+			values = append(values, frame.Metrics["vmaf"])
+		}
+		return values, nil
+	}
+
+	pattern := ssimPattern
+	if metric == MetricPSNR {
+		pattern = psnrPattern
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m := pattern.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		v, err := strconv.ParseFloat(m[1], 64)
+		if metric == MetricPSNR && (err != nil || math.IsInf(v, 1)) {
+			// Identical frames
+			v, err = psnrMax, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse score \"%s\": %w", m[1], err)
+		}
+		values = append(values, v)
+	}
+	return values, scanner.Err()
+}
+
+// summariseMetric finds the mean, range and percentiles of a metric's scores
+func summariseMetric(values []float64) MetricSummary {
+	if len(values) == 0 {
+		return MetricSummary{}
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+	}
+	// Nearest rank
+	percentile := func(p float64) float64 {
+		i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return sorted[i]
+	}
+	return MetricSummary{
+		Mean: sum / float64(len(sorted)),
+		Min:  sorted[0],
+		Max:  sorted[len(sorted)-1],
+		P1:   percentile(1),
+		P5:   percentile(5),
+		P50:  percentile(50),
+	}
+}
@@ -0,0 +1,49 @@
+package task
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+type (
+	// Result is what a finished task produced
+	Result struct {
+		Outputs []Output      `json:"outputs,omitempty"`
+		Quality QualityScores `json:"quality,omitempty"` // Scores of the encode by metric
+		Ladder  *LadderResult `json:"ladder,omitempty"`  // Ladder picked for the source
+		// Where a split task cut the source
+		Segments []Span `json:"segments,omitempty"`
+	}
+	// Output is a file a task uploaded
+	Output struct {
+		Location string `json:"location"`
+		Size     int64  `json:"size"`
+		MD5      string `json:"md5"`    // Hex encoded
+		SHA256   string `json:"sha256"` // Hex encoded
+	}
+)
+
+// checksumFile reads a local file to find its size and checksums
+func checksumFile(path string) (Output, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Output{}, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	m := md5.New()
+	s := sha256.New()
+	size, err := io.Copy(io.MultiWriter(m, s), f)
+	if err != nil {
+		return Output{}, fmt.Errorf("failed to read file: %w", err)
+	}
+	return Output{
+		Size:   size,
+		MD5:    hex.EncodeToString(m.Sum(nil)),
+		SHA256: hex.EncodeToString(s.Sum(nil)),
+	}, nil
+}
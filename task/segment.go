@@ -0,0 +1,148 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const TypeSegment string = "video/segment"
+
+var _ Task = &Segment{}
+
+// Segment task encodes part of a chunked VOD job's source, only
+// its video since the mux task encodes the audio in one go
+type Segment struct {
+	TaskID   string `json:"taskID"`
+	ParentID string `json:"parentID"` // VOD job the segment is part of
+	Index    int    `json:"index"`
+	SrcURL   string `json:"srcURL"`
+	Span     Span   `json:"span"`
+	DstArgs  string `json:"dstArgs"`
+	DstURL   string `json:"dstURL"`
+	Download bool   `json:"download"`
+	// Worker capabilities the job needs, the same as its VOD job's
+	Requires []string `json:"requires,omitempty"`
+	Timeout  int      `json:"timeout,omitempty"`
+
+	status    Status
+	stats     *Stats
+	ffmpegLog *FFmpegLog
+
+	// dependencies
+	env *Env
+}
+
+// NewSegment initialises a Segment task object so we can
+// add the tasks dependencies
+func NewSegment(env *Env) Segment {
+	return Segment{
+		stats: &Stats{},
+		env:   env,
+	}
+}
+
+// GetID returns a task ID
+func (t *Segment) GetID() string {
+	return t.TaskID
+}
+
+// GetType returns the task's type
+func (t *Segment) GetType() string {
+	return TypeSegment
+}
+
+// GetTimeout returns the job's maximum runtime
+func (t *Segment) GetTimeout() time.Duration {
+	return time.Duration(t.Timeout) * time.Second
+}
+
+// GetStatus returns the task's status
+func (t *Segment) GetStatus() Status {
+	t.status.TaskID = t.TaskID
+	if t.stats != nil {
+		t.status.Stats = *t.stats
+	}
+	return t.status
+}
+
+// ValidateRequest checks the request
+func (t *Segment) ValidateRequest() error {
+	if t.SrcURL == "" {
+		return fmt.Errorf("missing srcURL")
+	}
+	if t.DstURL == "" {
+		return fmt.Errorf("missing dstURL")
+	}
+	if t.Span.Start < 0 || (t.Span.End != 0 && t.Span.End <= t.Span.Start) {
+		return fmt.Errorf("invalid span %.3fs to %.3fs", t.Span.Start, t.Span.End)
+	}
+	if err := ValidateRequirements(t.Requires); err != nil {
+		return err
+	}
+	t.TaskID = uuid.NewString()
+	return nil
+}
+
+// Start encodes the segment and uploads it
+func (t *Segment) Start(ctx context.Context) error {
+	t.status.Stage = StageStarted
+	t.status.StageStart = time.Now()
+
+	b, dst, err := t.env.Store.Resolve(t.DstURL)
+	if err != nil {
+		return NewError(ErrorInvalidArgs, false, fmt.Errorf("failed to resolve destination: %w", err))
+	}
+	ws, err := t.env.Workspaces.Create(t.TaskID)
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer ws.Remove()
+	t.ffmpegLog, err = newFFmpegLog(ws.Path("ffmpeg.log"))
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer finishLog(ctx, t.ffmpegLog, b, withSuffix(dst, ".log"), &t.status)
+
+	input, release, err := openSource(ctx, t.env, t.SrcURL, t.Download, &t.status)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	log.Printf("encoding segment %d of %s: %s", t.Index, t.ParentID, t.GetID())
+	startEnc := time.Now()
+	t.status.Stage = StageTranscoding
+	t.status.StageStart = startEnc
+	// Seeking before the input is quick, and exact since we decode
+	span := fmt.Sprintf("-ss %.3f", t.Span.Start)
+	limit := ""
+	if t.Span.End > 0 {
+		limit = fmt.Sprintf("-t %.3f", t.Span.End-t.Span.Start)
+	}
+	output := ws.Path("segment.mkv")
+	cmdString := fmt.Sprintf("\"%s\" -y %s -i \"%s\" %s -map 0:v:0 -an -sn %s \"%s\" 2>&1",
+		t.env.FFmpeg, span, input, limit, t.DstArgs, output)
+	err = runFFmpeg(ctx, t, t.env, cmdString, t.stats, t.ffmpegLog)
+	if err != nil {
+		return err
+	}
+	log.Printf("finished encoding segment - completed in %s", time.Since(startEnc))
+
+	t.status.Stage = StageUploading
+	t.status.StageStart = time.Now()
+	out, err := uploadOutput(ctx, b, dst, output)
+	if err != nil {
+		return err
+	}
+	t.status.Result = &Result{Outputs: []Output{out}}
+	return nil
+}
+
+// LogTail returns the end of ffmpeg's output
+func (t *Segment) LogTail() []string {
+	return t.ffmpegLog.Tail(logTailLines)
+}
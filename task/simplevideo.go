@@ -1,11 +1,10 @@
 package task
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"log"
-	"os/exec"
+	"net/url"
 	"time"
 
 	"github.com/google/uuid"
@@ -22,9 +21,29 @@ type SimpleVideo struct {
 	SrcURL  string `json:"srcURL"`  // Location of source file on CDN
 	DstArgs string `json:"dstArgs"` // Output file options
 	DstURL  string `json:"dstURL"`  // Destination of finished encode on
+	// Worker capabilities the job needs, i.e. "encoder:libsvtav1"
+	Requires []string `json:"requires,omitempty"`
+	// Maximum seconds the job can run for, 0 uses the worker's limit
+	Timeout int `json:"timeout,omitempty"`
+	// Images and text drawn over the encode, and subtitles burnt into it
+	Overlays  []Overlay  `json:"overlays,omitempty"`
+	Subtitles *Subtitles `json:"subtitles,omitempty"`
+	// Where ffmpeg's output is uploaded to, see Storage. dstURL is
+	// ffmpeg's rather than storage, so the log can't go next to it.
+	LogURL string `json:"logURL,omitempty"`
+
+	status    Status
+	stats     *Stats
+	ffmpegLog *FFmpegLog
+
+	// dependencies
+	env *Env
+}
 
-	status Status
-	stats  *Stats
+// NewSimpleVideo initialises a SimpleVideo task object so we can
+// add the tasks dependencies
+func NewSimpleVideo(env *Env) SimpleVideo {
+	return SimpleVideo{env: env}
 }
 
 // GetID retrives the task ID
@@ -32,6 +51,16 @@ func (t *SimpleVideo) GetID() string {
 	return t.TaskID
 }
 
+// GetType returns the task's type
+func (t *SimpleVideo) GetType() string {
+	return TypeSimpleVideo
+}
+
+// GetTimeout returns the job's maximum runtime
+func (t *SimpleVideo) GetTimeout() time.Duration {
+	return time.Duration(t.Timeout) * time.Second
+}
+
 // CheckRequets returns an error describing if the user's request is not
 // formed properly and will stop the job continuing
 func (t *SimpleVideo) ValidateRequest() error {
@@ -41,6 +70,18 @@ func (t *SimpleVideo) ValidateRequest() error {
 	if t.DstURL == "" {
 		return fmt.Errorf("missing dstURL")
 	}
+	if t.LogURL != "" {
+		if err := validateStorageURL(t.LogURL); err != nil {
+			return fmt.Errorf("invalid logURL: %w", err)
+		}
+	}
+	if err := validateOverlays(t.Overlays, t.Subtitles, t.DstArgs); err != nil {
+		return err
+	}
+	t.Requires = overlayRequirements(t.Overlays, t.Subtitles, t.Requires)
+	if err := ValidateRequirements(t.Requires); err != nil {
+		return err
+	}
 
 	// Generating Task ID
 	t.TaskID = uuid.NewString()
@@ -48,11 +89,9 @@ func (t *SimpleVideo) ValidateRequest() error {
 }
 
 func (t *SimpleVideo) GetStatus() Status {
-	t.status = Status{
-		Stage:      StageTranscoding,
-		StageStart: time.Now(),
-		Stats:      *t.stats,
-		Err:        nil,
+	t.status.TaskID = t.TaskID
+	if t.stats != nil {
+		t.status.Stats = *t.stats
 	}
 	return t.status
 }
@@ -62,47 +101,53 @@ func (t *SimpleVideo) Start(ctx context.Context) error {
 	log.Println("starting video!")
 	t.stats = &Stats{}
 	t.status = Status{
+		TaskID:     t.TaskID,
 		Stage:      StageTranscoding,
 		StageStart: time.Now(),
 		Stats:      *t.stats,
-		Err:        nil,
 	}
 
-	// TODO: ffprobe src
-	cmdString := fmt.Sprintf("ffmpeg %s %s -i \"%s\" %s \"%s\" 2>&1",
-		t.Args, t.SrcArgs, t.SrcURL, t.DstArgs, t.DstURL)
-	// ffmpeg {glob args} {src args} -i {src url} {dst args} {dst url} 2>&1
-	cmd := exec.Command("sh", "-c",
-		cmdString)
-
-	stdout, err := cmd.StdoutPipe()
+	var lb Backend
+	var logURL *url.URL
+	if t.LogURL != "" {
+		var err error
+		lb, logURL, err = t.env.Store.Resolve(t.LogURL)
+		if err != nil {
+			return NewError(ErrorInvalidArgs, false, fmt.Errorf("failed to resolve log destination: %w", err))
+		}
+	}
+	ws, err := t.env.Workspaces.Create(t.TaskID)
 	if err != nil {
-		return fmt.Errorf("pipe failed: %w", err)
+		return NewError(ErrorWorkerFailure, true, err)
 	}
-
-	err = cmd.Start()
+	defer ws.Remove()
+	t.ffmpegLog, err = newFFmpegLog(ws.Path("ffmpeg.log"))
 	if err != nil {
-		log.Printf("failed to start ffmpeg: %+v", err)
+		return NewError(ErrorWorkerFailure, true, err)
 	}
-
-	scanner := bufio.NewScanner(stdout)
-	curLine := ""
-	buf := ""
-
-	for scanner.Scan() {
-		curLine = scanner.Text()
-		buf += curLine
-		ok := getStats(t.stats, buf)
-		if ok {
-			buf = ""
-			log.Printf("%+v", t.stats)
+	defer finishLog(ctx, t.ffmpegLog, lb, logURL, &t.status)
+
+	// Overlays' images and subtitles are fetched to the workspace
+	overlays := ""
+	if len(t.Overlays) > 0 || t.Subtitles != nil {
+		var release func()
+		overlays, release, err = overlayArgs(ctx, t.env, ws, t.Overlays, t.Subtitles, true, &t.status)
+		if err != nil {
+			return err
 		}
+		defer release()
+		t.status.Stage = StageTranscoding
+		t.status.StageStart = time.Now()
 	}
 
-	err = cmd.Wait()
-	if err != nil {
-		log.Printf("exec failed to wait: %+v: %s", err, curLine)
-	}
+	// TODO: ffprobe src
+	cmdString := fmt.Sprintf("\"%s\" %s %s -i \"%s\" %s %s \"%s\" 2>&1",
+		t.env.FFmpeg, t.Args, t.SrcArgs, t.SrcURL, overlays, t.DstArgs, t.DstURL)
+	// ffmpeg {glob args} {src args} -i {src url} {dst args} {dst url} 2>&1
+	return runFFmpeg(ctx, t, t.env, cmdString, t.stats, t.ffmpegLog)
+}
 
-	return nil
+// LogTail returns the end of ffmpeg's output
+func (t *SimpleVideo) LogTail() []string {
+	return t.ffmpegLog.Tail(logTailLines)
 }
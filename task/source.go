@@ -0,0 +1,77 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+// uploadAttempts is how many times an upload is tried, backends
+// which support it resume from where the last attempt got to
+const uploadAttempts = 3
+
+// openSource gets a URL or path ffmpeg can read a source from. It's
+// streamed when the backend allows it unless download is set, otherwise
+// it's fetched to the cache. release must be called once ffmpeg's done.
+func openSource(ctx context.Context, env *Env, rawURL string, download bool, status *Status) (string, func(), error) {
+	b, u, err := env.Store.Resolve(rawURL)
+	if err != nil {
+		return "", nil, NewError(ErrorInvalidArgs, false, fmt.Errorf("failed to resolve source: %w", err))
+	}
+	if !download {
+		input, err := b.SourceURL(ctx, u)
+		switch {
+		case err == nil && shellSafe(input):
+			return input, func() {}, nil
+		case err == nil:
+			// i.e. the backend's credentials have a quote in them
+			log.Printf("source can't be streamed safely, downloading it: %s", rawURL)
+		case !errors.Is(err, ErrNotStreamable):
+			return "", nil, inputError(fmt.Errorf("failed to get source: %w", err))
+		}
+	}
+
+	log.Printf("downloading source: %s", rawURL)
+	startDl := time.Now()
+	status.Stage = StageDownloading
+	status.StageStart = startDl
+	path, release, err := env.Cache.Fetch(ctx, b, u)
+	if err != nil {
+		return "", nil, inputError(fmt.Errorf("failed to download source: %w", err))
+	}
+	log.Printf("finished downloading - completed in %s", time.Since(startDl))
+	return path, release, nil
+}
+
+// uploadOutput uploads a file a task produced, retrying if it's
+// interrupted. Returns where it was uploaded to alongside its
+// size and checksums.
+func uploadOutput(ctx context.Context, b Backend, dst *url.URL, path string) (Output, error) {
+	out, err := checksumFile(path)
+	if err != nil {
+		return Output{}, fmt.Errorf("failed to checksum output: %w", err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		out.Location, err = putFile(ctx, b, dst, path, out)
+		if err == nil || attempt == uploadAttempts || ctx.Err() != nil {
+			break
+		}
+		log.Printf("upload attempt %d of %s failed, retrying: %+v", attempt, path, err)
+	}
+	if err != nil {
+		return Output{}, NewError(ErrorUploadFailure, true, fmt.Errorf("failed to upload output: %w", err))
+	}
+	return out, nil
+}
+
+// withSuffix returns a copy of a URL with a suffix added to its path,
+// for files which go alongside an output
+func withSuffix(u *url.URL, suffix string) *url.URL {
+	c := *u
+	c.Path += suffix
+	return &c
+}
@@ -0,0 +1,286 @@
+package task
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const TypeSplit string = "video/split"
+
+// Defaults for chunked jobs which leave them out
+const (
+	defaultSegmentLength  = 120 // seconds
+	defaultSceneThreshold = 0.4
+	defaultAudioArgs      = "-c:a aac -b:a 192k"
+)
+
+// scenePattern matches the time of a frame showinfo printed
+var scenePattern = regexp.MustCompile(`pts_time:\s*(\S+)`)
+
+var _ Task = &Split{}
+
+type (
+	// Chunked is how a VOD job is split to be encoded across workers.
+	// The manager has a split task find where to cut the source, a
+	// segment task encode each part of it, then a mux task join the
+	// segments together with the source's audio.
+	Chunked struct {
+		// Seconds each segment should be around
+		Segment int `json:"segment,omitempty"`
+		// Cut at scene changes where there's one near enough, otherwise
+		// at keyframes. Finding them means decoding the whole source.
+		Scenes         bool    `json:"scenes"`
+		SceneThreshold float64 `json:"sceneThreshold,omitempty"`
+		// Options for the audio, encoded when the segments are joined
+		AudioArgs string `json:"audioArgs,omitempty"`
+	}
+	// Span is part of a source, End is 0 for the end of the source
+	Span struct {
+		Start float64 `json:"start"` // Seconds
+		End   float64 `json:"end"`
+	}
+	// Split task finds where to cut a source into segments
+	Split struct {
+		TaskID   string  `json:"taskID"`
+		SrcURL   string  `json:"srcURL"`
+		Options  Chunked `json:"options"`
+		Download bool    `json:"download"`
+		// Where ffmpeg's output is uploaded to, see Storage
+		LogURL string `json:"logURL,omitempty"`
+
+		status    Status
+		ffmpegLog *FFmpegLog
+
+		// dependencies
+		env *Env
+	}
+)
+
+// Validate checks the options make sense, filling in their defaults
+func (c *Chunked) Validate() error {
+	if c.Segment == 0 {
+		c.Segment = defaultSegmentLength
+	}
+	if c.SceneThreshold == 0 {
+		c.SceneThreshold = defaultSceneThreshold
+	}
+	if c.AudioArgs == "" {
+		c.AudioArgs = defaultAudioArgs
+	}
+	if c.Segment < 10 {
+		return fmt.Errorf("chunked segment has to be at least 10 seconds")
+	}
+	if c.SceneThreshold < 0 || c.SceneThreshold > 1 {
+		return fmt.Errorf("chunked sceneThreshold has to be between 0 and 1")
+	}
+	return nil
+}
+
+// NewSplit initialises a Split task object so we can
+// add the tasks dependencies
+func NewSplit(env *Env) Split {
+	return Split{env: env}
+}
+
+// GetID returns a task ID
+func (t *Split) GetID() string {
+	return t.TaskID
+}
+
+// GetType returns the task's type
+func (t *Split) GetType() string {
+	return TypeSplit
+}
+
+// GetStatus returns the task's status
+func (t *Split) GetStatus() Status {
+	t.status.TaskID = t.TaskID
+	return t.status
+}
+
+// ValidateRequest checks the request
+func (t *Split) ValidateRequest() error {
+	if t.SrcURL == "" {
+		return fmt.Errorf("missing srcURL")
+	}
+	if err := t.Options.Validate(); err != nil {
+		return err
+	}
+	if t.LogURL != "" {
+		if err := validateStorageURL(t.LogURL); err != nil {
+			return fmt.Errorf("invalid logURL: %w", err)
+		}
+	}
+	t.TaskID = uuid.NewString()
+	return nil
+}
+
+// Start finds the keyframes and scene changes of the source
+// and picks the segments from them
+func (t *Split) Start(ctx context.Context) error {
+	t.status.Stage = StageStarted
+	t.status.StageStart = time.Now()
+
+	var lb Backend
+	var logURL *url.URL
+	if t.LogURL != "" {
+		var err error
+		lb, logURL, err = t.env.Store.Resolve(t.LogURL)
+		if err != nil {
+			return NewError(ErrorInvalidArgs, false, fmt.Errorf("failed to resolve log destination: %w", err))
+		}
+	}
+	ws, err := t.env.Workspaces.Create(t.TaskID)
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer ws.Remove()
+	t.ffmpegLog, err = newFFmpegLog(ws.Path("ffmpeg.log"))
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer finishLog(ctx, t.ffmpegLog, lb, logURL, &t.status)
+
+	input, release, err := openSource(ctx, t.env, t.SrcURL, t.Download, &t.status)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	t.status.Stage = StageAnalysing
+	t.status.StageStart = time.Now()
+	info, err := probe(ctx, t.env.FFprobe, input)
+	if err != nil {
+		return inputError(err)
+	}
+	keyframes, err := findKeyframes(ctx, t.env.FFprobe, input, info.StartTime)
+	if err != nil {
+		return err
+	}
+	scenes := []float64{}
+	if t.Options.Scenes {
+		scenes, err = t.findScenes(ctx, input)
+		if err != nil {
+			return err
+		}
+	}
+
+	spans := chooseSpans(info.Duration, float64(t.Options.Segment), keyframes, scenes)
+	log.Printf("split %s into %d segments", t.SrcURL, len(spans))
+	t.status.Result = &Result{Segments: spans}
+	return nil
+}
+
+// LogTail returns the end of ffmpeg's output
+func (t *Split) LogTail() []string {
+	return t.ffmpegLog.Tail(logTailLines)
+}
+
+// findKeyframes lists the times of the keyframes of the first video
+// stream, going by the packets so nothing has to be decoded. They're
+// made relative to startTime, the source's, which is how -ss counts.
+func findKeyframes(ctx context.Context, ffprobe, input string, startTime float64) ([]float64, error) {
+	out, err := exec.CommandContext(ctx, ffprobe, "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "packet=pts_time,flags", "-of", "csv=p=0", input).Output()
+	if err != nil {
+		return nil, inputError(fmt.Errorf("failed to find keyframes: %w", err))
+	}
+	keyframes := []float64{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// "12.345000,K_"
+		f := strings.Split(scanner.Text(), ",")
+		if len(f) < 2 || !strings.Contains(f[1], "K") {
+			continue
+		}
+		if ts, err := strconv.ParseFloat(f[0], 64); err == nil {
+			keyframes = append(keyframes, ts-startTime)
+		}
+	}
+	sort.Float64s(keyframes)
+	return keyframes, nil
+}
+
+// findScenes lists the times of the frames which start a new scene,
+// ffmpeg has already made them relative to the source's start. They're
+// read back from the log's file since there can be far more of them
+// than are kept in memory.
+func (t *Split) findScenes(ctx context.Context, input string) ([]float64, error) {
+	offset, err := t.ffmpegLog.offset()
+	if err != nil {
+		return nil, NewError(ErrorWorkerFailure, true, err)
+	}
+	cmdString := fmt.Sprintf("\"%s\" -hide_banner -i \"%s\" -an -sn -vf \"select='gt(scene,%g)',showinfo\" -f null - 2>&1",
+		t.env.FFmpeg, input, t.Options.SceneThreshold)
+	err = runFFmpeg(ctx, t, t.env, cmdString, &Stats{}, t.ffmpegLog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find scene changes: %w", err)
+	}
+	scenes := []float64{}
+	err = t.ffmpegLog.scan(offset, func(line string) {
+		if m := scenePattern.FindStringSubmatch(line); m != nil {
+			if ts, err := strconv.ParseFloat(m[1], 64); err == nil {
+				scenes = append(scenes, ts)
+			}
+		}
+	})
+	if err != nil {
+		return nil, NewError(ErrorWorkerFailure, true, err)
+	}
+	// A stalled run is retried from the start, printing its scenes again
+	sort.Float64s(scenes)
+	unique := scenes[:0]
+	for i, ts := range scenes {
+		if i == 0 || ts != scenes[i-1] {
+			unique = append(unique, ts)
+		}
+	}
+	return unique, nil
+}
+
+// chooseSpans cuts a source into segments around length seconds long,
+// preferring a scene change near each cut then a keyframe. A short
+// remainder is left on the last segment rather than being its own.
+func chooseSpans(duration, length float64, keyframes, scenes []float64) []Span {
+	spans := []Span{}
+	start := 0.0
+	for duration-start > length*1.5 {
+		target := start + length
+		window := length / 4
+		cut, ok := closest(scenes, target, window)
+		if !ok {
+			cut, ok = closest(keyframes, target, window)
+		}
+		if !ok {
+			// We re-encode, so can cut anywhere
+			cut = target
+		}
+		spans = append(spans, Span{Start: start, End: cut})
+		start = cut
+	}
+	return append(spans, Span{Start: start})
+}
+
+// closest finds the time nearest to target within window of it
+func closest(times []float64, target, window float64) (float64, bool) {
+	best, found := 0.0, false
+	for _, ts := range times {
+		if math.Abs(ts-target) <= window && (!found || math.Abs(ts-target) < math.Abs(best-target)) {
+			best, found = ts, true
+		}
+	}
+	return best, found
+}
@@ -7,13 +7,15 @@ import (
 
 // Stats represents statistics on the current encode job
 type Stats struct {
-	Duration   int    `json:"duration"`
-	Percentage int    `json:"percentage"`
-	Frame      int    `json:"frame"`
-	FPS        int    `json:"fps"`
-	Bitrate    string `json:"bitrate"`
-	Size       string `json:"size"`
-	Time       string `json:"time"`
+	Duration   int     `json:"duration"`
+	Percentage int     `json:"percentage"`
+	Frame      int     `json:"frame"`
+	FPS        int     `json:"fps"`
+	Bitrate    string  `json:"bitrate"`
+	Size       string  `json:"size"`
+	Time       string  `json:"time"`
+	Speed      float64 `json:"speed"` // Encode speed relative to realtime
+	ETA        int     `json:"eta"`   // Seconds until the encode finishes
 }
 
 func getStats(s *Stats, res string) bool {
@@ -45,6 +47,7 @@ func getStats(s *Stats, res string) bool {
 	bitrateIdx := strings.LastIndex(res, "bitrate=")
 	sizeIdx := strings.LastIndex(res, "size=")
 	timeIdx := strings.Index(res, "time=")
+	speedIdx := strings.LastIndex(res, "speed=")
 
 	if timeIdx >= 0 {
 		// From this point on it should be outputting normal encode stdout,
@@ -73,6 +76,15 @@ func getStats(s *Stats, res string) bool {
 				s.Bitrate = bitrate[0]
 				s.Size = size[0]
 				s.Time = time
+				if speedIdx >= 0 {
+					speed := strings.Fields(res[speedIdx+6:])
+					if len(speed) > 0 {
+						s.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(speed[0], "x"), 64)
+					}
+				}
+				if s.Speed > 0 && s.Duration > sec {
+					s.ETA = int(float64(s.Duration-sec) / s.Speed)
+				}
 			}
 			return true
 		}
@@ -0,0 +1,156 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrReadOnly is returned when writing to a backend which can only be read
+	ErrReadOnly = errors.New("storage backend is read only")
+	// ErrNotStreamable is returned by SourceURL when ffmpeg can't read
+	// from a backend directly, so the object has to be fetched first
+	ErrNotStreamable = errors.New("storage backend can't be streamed by ffmpeg")
+)
+
+// shellUnsafe are the characters which could break out of the double
+// quotes paths and URLs are put in on ffmpeg's command line
+const shellUnsafe = "\"$`\\\n\r"
+
+// StorageSchemes are the URL schemes a worker can understand, URLs
+// without a scheme are treated as "bucket/key" on S3
+var StorageSchemes = []string{"s3", "file", "http", "https", "webdav", "webdavs", "sftp"}
+
+type (
+	// Backend reads and writes objects for a URL scheme
+	Backend interface {
+		// SourceURL returns a URL or path ffmpeg can read the object from
+		SourceURL(ctx context.Context, u *url.URL) (string, error)
+		// Stat returns the object's metadata
+		Stat(ctx context.Context, u *url.URL) (ObjectInfo, error)
+		// Get opens the object for reading from offset,
+		// allowing an interrupted download to be resumed
+		Get(ctx context.Context, u *url.URL, offset int64) (io.ReadCloser, error)
+		// Put writes the object, size is -1 when unknown.
+		// Returns the location of the written object.
+		Put(ctx context.Context, u *url.URL, r io.Reader, size int64) (string, error)
+		// Delete removes the object, it's not an error if it doesn't exist
+		Delete(ctx context.Context, u *url.URL) error
+	}
+	// FileUploader is implemented by backends which can upload a local
+	// file better than Put, i.e. in parallel parts which can be resumed
+	// after being interrupted. sums are of the local file and are used
+	// to verify the upload.
+	FileUploader interface {
+		PutFile(ctx context.Context, u *url.URL, path string, sums Output) (string, error)
+	}
+	// ObjectInfo is the metadata of a stored object
+	ObjectInfo struct {
+		Size    int64
+		ETag    string
+		ModTime time.Time
+	}
+	// Storage picks the backend for a URL by its scheme
+	Storage struct {
+		backends map[string]Backend
+	}
+)
+
+// NewStorage creates a storage without any backends
+func NewStorage() *Storage {
+	return &Storage{backends: make(map[string]Backend)}
+}
+
+// Register sets the backend used for a URL scheme
+func (s *Storage) Register(scheme string, b Backend) {
+	s.backends[scheme] = b
+}
+
+// Resolve returns the backend and parsed URL for an object
+func (s *Storage) Resolve(rawURL string) (Backend, *url.URL, error) {
+	u, err := parseStorageURL(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, ok := s.backends[u.Scheme]
+	if !ok {
+		return nil, nil, fmt.Errorf("no storage backend for \"%s\"", u.Scheme)
+	}
+	return b, u, nil
+}
+
+// parseStorageURL parses an object URL, supporting the
+// original "bucket/key" format for S3
+func parseStorageURL(rawURL string) (*url.URL, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "s3://" + strings.TrimPrefix(rawURL, "/")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage url: %w", err)
+	}
+	// Escaped characters are checked too since backends use the decoded path
+	unescaped, _ := url.PathUnescape(rawURL)
+	if !shellSafe(rawURL) || !shellSafe(unescaped) {
+		return nil, fmt.Errorf("invalid storage url: it can't contain any of %q", shellUnsafe)
+	}
+	return u, nil
+}
+
+// shellSafe checks a path or URL can be put on ffmpeg's command line
+func shellSafe(s string) bool {
+	return !strings.ContainsAny(s, shellUnsafe)
+}
+
+// validateStorageURL checks a URL is one a worker should be able to use
+func validateStorageURL(rawURL string) error {
+	u, err := parseStorageURL(rawURL)
+	if err != nil {
+		return err
+	}
+	for _, scheme := range StorageSchemes {
+		if u.Scheme == scheme {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported storage scheme \"%s\"", u.Scheme)
+}
+
+// objectName returns the last element of an object's path
+func objectName(u *url.URL) string {
+	p := strings.TrimSuffix(u.Path, "/")
+	return p[strings.LastIndex(p, "/")+1:]
+}
+
+// putFile uploads a local file, using the backend's FileUploader
+// if it has one. The uploaded object's size is checked against sums.
+func putFile(ctx context.Context, b Backend, u *url.URL, path string, sums Output) (string, error) {
+	if fu, ok := b.(FileUploader); ok {
+		return fu.PutFile(ctx, u, path, sums)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+	location, err := b.Put(ctx, u, &countingReader{r: f, counter: bytesUploaded}, sums.Size)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := b.Stat(ctx, u)
+	if err != nil {
+		return "", fmt.Errorf("failed to verify upload: %w", err)
+	}
+	if info.Size != sums.Size {
+		return "", fmt.Errorf("uploaded object is %d bytes, expected %d", info.Size, sums.Size)
+	}
+	return location, nil
+}
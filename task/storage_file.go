@@ -0,0 +1,120 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var _ Backend = &FileBackend{}
+
+// FileBackend stores objects on a local filesystem such as a NAS
+// mount, URLs are in the form file:///path/to/object
+type FileBackend struct {
+	// Root restricts objects to a directory, so jobs can't read
+	// anything else on the worker. file:// URLs can't be used without it.
+	Root string
+}
+
+// path returns the local path of an object
+func (b *FileBackend) path(u *url.URL) (string, error) {
+	if b.Root == "" {
+		return "", fmt.Errorf("file:// urls can't be used until a root directory is set")
+	}
+	p := filepath.Clean(filepath.FromSlash(u.Path))
+	root := filepath.Clean(b.Root)
+	if p != root && !strings.HasPrefix(p, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("path \"%s\" is outside of %s", p, root)
+	}
+	return p, nil
+}
+
+func (b *FileBackend) SourceURL(ctx context.Context, u *url.URL) (string, error) {
+	return b.path(u)
+}
+
+func (b *FileBackend) Stat(ctx context.Context, u *url.URL) (ObjectInfo, error) {
+	p, err := b.path(u)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to stat file: %w", err)
+	}
+	return ObjectInfo{
+		Size:    fi.Size(),
+		ETag:    fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size()),
+		ModTime: fi.ModTime(),
+	}, nil
+}
+
+func (b *FileBackend) Get(ctx context.Context, u *url.URL, offset int64) (io.ReadCloser, error) {
+	p, err := b.path(u)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to seek file: %w", err)
+	}
+	return f, nil
+}
+
+// Put writes to a temporary file alongside the object then renames
+// it, so nothing sees a partially written object
+func (b *FileBackend) Put(ctx context.Context, u *url.URL, r io.Reader, size int64) (string, error) {
+	p, err := b.path(u)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+"-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to write file: %w", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to write file: %w", err)
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to set file permissions: %w", err)
+	}
+	err = os.Rename(tmp.Name(), p)
+	if err != nil {
+		return "", fmt.Errorf("failed to rename file: %w", err)
+	}
+	return "file://" + filepath.ToSlash(p), nil
+}
+
+func (b *FileBackend) Delete(ctx context.Context, u *url.URL) error {
+	p, err := b.path(u)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var _ Backend = &HTTPBackend{}
+
+// HTTPBackend reads objects from any http(s) server, it can't write
+type HTTPBackend struct {
+	Client *http.Client
+}
+
+func (b *HTTPBackend) client() *http.Client {
+	if b.Client == nil {
+		return http.DefaultClient
+	}
+	return b.Client
+}
+
+func (b *HTTPBackend) SourceURL(ctx context.Context, u *url.URL) (string, error) {
+	return u.String(), nil
+}
+
+func (b *HTTPBackend) Stat(ctx context.Context, u *url.URL) (ObjectInfo, error) {
+	return httpStat(ctx, b.client(), u.String(), nil)
+}
+
+func (b *HTTPBackend) Get(ctx context.Context, u *url.URL, offset int64) (io.ReadCloser, error) {
+	return httpGet(ctx, b.client(), u.String(), offset, nil)
+}
+
+func (b *HTTPBackend) Put(ctx context.Context, u *url.URL, r io.Reader, size int64) (string, error) {
+	return "", ErrReadOnly
+}
+
+func (b *HTTPBackend) Delete(ctx context.Context, u *url.URL) error {
+	return ErrReadOnly
+}
+
+// httpStat makes a HEAD request for an object's metadata
+func httpStat(ctx context.Context, c *http.Client, rawURL string, setAuth func(*http.Request)) (ObjectInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, rawURL, nil)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to create request: %w", err)
+	}
+	if setAuth != nil {
+		setAuth(req)
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to head object: %w", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return ObjectInfo{}, fmt.Errorf("failed to head object: %s", res.Status)
+	}
+	info := ObjectInfo{
+		Size: res.ContentLength,
+		ETag: strings.Trim(res.Header.Get("ETag"), "\""),
+	}
+	info.ModTime, _ = time.Parse(http.TimeFormat, res.Header.Get("Last-Modified"))
+	return info, nil
+}
+
+// httpGet opens an object for reading from offset
+func httpGet(ctx context.Context, c *http.Client, rawURL string, offset int64, setAuth func(*http.Request)) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	if setAuth != nil {
+		setAuth(req)
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object: %w", err)
+	}
+	switch {
+	case offset > 0 && res.StatusCode == http.StatusOK:
+		// The server ignored the range, so skip to the offset ourselves
+		_, err = io.CopyN(ioutil.Discard, res.Body, offset)
+		if err != nil {
+			res.Body.Close()
+			return nil, fmt.Errorf("failed to skip to offset: %w", err)
+		}
+	case res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent:
+		res.Body.Close()
+		return nil, fmt.Errorf("failed to get object: %s", res.Status)
+	}
+	return res.Body, nil
+}
@@ -0,0 +1,100 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+var _ Backend = &S3Backend{}
+
+// S3Backend stores objects on an S3 compatible API,
+// URLs are in the form s3://bucket/key
+type S3Backend struct {
+	cdn  *s3.S3
+	opts S3Options
+}
+
+// NewS3Backend creates an S3 backend
+func NewS3Backend(cdn *s3.S3, opts S3Options) *S3Backend {
+	return &S3Backend{cdn: cdn, opts: opts}
+}
+
+func s3Location(u *url.URL) (*string, *string) {
+	return aws.String(u.Host), aws.String(strings.TrimPrefix(u.Path, "/"))
+}
+
+// SourceURL presigns a download of the object
+func (b *S3Backend) SourceURL(ctx context.Context, u *url.URL) (string, error) {
+	bucket, key := s3Location(u)
+	req, _ := b.cdn.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: bucket,
+		Key:    key,
+	})
+	return req.Presign(6 * time.Hour) // TODO: Look into time
+}
+
+func (b *S3Backend) Stat(ctx context.Context, u *url.URL) (ObjectInfo, error) {
+	bucket, key := s3Location(u)
+	head, err := b.cdn.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: bucket,
+		Key:    key,
+	})
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to head object: %w", err)
+	}
+	return ObjectInfo{
+		Size:    aws.Int64Value(head.ContentLength),
+		ETag:    strings.Trim(aws.StringValue(head.ETag), "\""),
+		ModTime: aws.TimeValue(head.LastModified),
+	}, nil
+}
+
+func (b *S3Backend) Get(ctx context.Context, u *url.URL, offset int64) (io.ReadCloser, error) {
+	bucket, key := s3Location(u)
+	input := &s3.GetObjectInput{
+		Bucket: bucket,
+		Key:    key,
+	}
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	obj, err := b.cdn.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object: %w", err)
+	}
+	return obj.Body, nil
+}
+
+func (b *S3Backend) Put(ctx context.Context, u *url.URL, r io.Reader, size int64) (string, error) {
+	bucket, key := s3Location(u)
+	uploader := s3manager.NewUploaderWithClient(b.cdn)
+	upload, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: bucket,
+		Key:    key,
+		Body:   r,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload object: %w", err)
+	}
+	return upload.Location, nil
+}
+
+func (b *S3Backend) Delete(ctx context.Context, u *url.URL) error {
+	bucket, key := s3Location(u)
+	_, err := b.cdn.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: bucket,
+		Key:    key,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+	return nil
+}
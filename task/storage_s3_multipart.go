@@ -0,0 +1,378 @@
+package task
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	minPartSize     int64 = 5 * 1024 * 1024 // Smallest part S3 accepts
+	maxUploadParts  int64 = 10000           // Most parts S3 accepts
+	defaultPartSize int64 = 16 * 1024 * 1024
+	defaultParallel int   = 4
+)
+
+var _ FileUploader = &S3Backend{}
+
+type (
+	// S3Options configures how files are uploaded to S3
+	S3Options struct {
+		PartSize    int64 // Bytes in each part of a multipart upload
+		Concurrency int   // Parts uploaded at once
+	}
+	// uploadState is persisted next to a file being uploaded,
+	// so an interrupted upload can carry on where it left off
+	uploadState struct {
+		Bucket   string         `json:"bucket"`
+		Key      string         `json:"key"`
+		UploadID string         `json:"uploadID"`
+		PartSize int64          `json:"partSize"`
+		Size     int64          `json:"size"`
+		SHA256   string         `json:"sha256"`
+		Parts    map[int64]part `json:"parts"`
+
+		mu   sync.Mutex
+		path string
+	}
+	part struct {
+		ETag string `json:"etag"`
+		MD5  string `json:"md5"` // Hex encoded
+	}
+)
+
+// uploadStatePath is where the state of a file's upload is kept
+func uploadStatePath(path string) string {
+	return path + ".upload.json"
+}
+
+// hasUploadState returns whether a file has an unfinished upload
+func hasUploadState(path string) bool {
+	_, err := os.Stat(uploadStatePath(path))
+	return err == nil
+}
+
+func loadUploadState(path string) (*uploadState, error) {
+	b, err := ioutil.ReadFile(uploadStatePath(path))
+	if err != nil {
+		return nil, err
+	}
+	state := &uploadState{}
+	err = json.Unmarshal(b, state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal upload state: %w", err)
+	}
+	state.path = uploadStatePath(path)
+	if state.Parts == nil {
+		state.Parts = make(map[int64]part)
+	}
+	return state, nil
+}
+
+// save writes the state, must hold the lock
+func (s *uploadState) save() error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to marshal upload state: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write upload state: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *uploadState) setPart(n int64, p part) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Parts[n] = p
+	return s.save()
+}
+
+// partSize picks a part size which keeps within S3's part limit
+func (o S3Options) partSize(size int64) int64 {
+	ps := o.PartSize
+	if ps < minPartSize {
+		ps = defaultPartSize
+	}
+	for size/ps >= maxUploadParts {
+		ps *= 2
+	}
+	return ps
+}
+
+// PutFile uploads a local file in parallel parts, verifying each part
+// with its MD5 and the whole object against the local checksums. Progress
+// is persisted alongside the file, so calling it again after it's been
+// interrupted resumes the upload.
+func (b *S3Backend) PutFile(ctx context.Context, u *url.URL, path string, sums Output) (string, error) {
+	bucket, key := s3Location(u)
+
+	state, err := b.resumeUpload(ctx, path, *bucket, *key, sums)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	parts := (sums.Size + state.PartSize - 1) / state.PartSize
+	if parts == 0 {
+		parts = 1
+	}
+
+	concurrency := b.opts.Concurrency
+	if concurrency < 1 {
+		concurrency = defaultParallel
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	todo := make(chan int64)
+	errs := make(chan error, concurrency)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range todo {
+				err := b.uploadPart(ctx, f, state, n)
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	for n := int64(1); n <= parts; n++ {
+		state.mu.Lock()
+		_, done := state.Parts[n]
+		state.mu.Unlock()
+		if done {
+			continue
+		}
+		select {
+		case todo <- n:
+		case <-ctx.Done():
+		}
+	}
+	close(todo)
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return "", err
+	}
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+
+	return b.completeUpload(ctx, path, state, parts, sums)
+}
+
+// resumeUpload picks up an unfinished upload of the same file,
+// otherwise it starts a new one
+func (b *S3Backend) resumeUpload(ctx context.Context, path, bucket, key string, sums Output) (*uploadState, error) {
+	state, err := loadUploadState(path)
+	if err == nil {
+		if state.Bucket == bucket && state.Key == key && state.Size == sums.Size && state.SHA256 == sums.SHA256 {
+			err = b.syncParts(ctx, state)
+			if err == nil {
+				log.Printf("resuming upload of %s with %d parts done", path, len(state.Parts))
+				return state, nil
+			}
+			log.Printf("failed to resume upload of %s: %+v", path, err)
+		}
+		// It's a different file or the upload has gone, so start again
+		b.cdn.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(state.Bucket),
+			Key:      aws.String(state.Key),
+			UploadId: aws.String(state.UploadID),
+		})
+	} else if !os.IsNotExist(err) {
+		log.Printf("ignoring unreadable upload state of %s: %+v", path, err)
+	}
+
+	res, err := b.cdn.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		Metadata: map[string]*string{"sha256": aws.String(sums.SHA256)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+	state = &uploadState{
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: aws.StringValue(res.UploadId),
+		PartSize: b.opts.partSize(sums.Size),
+		Size:     sums.Size,
+		SHA256:   sums.SHA256,
+		Parts:    make(map[int64]part),
+		path:     uploadStatePath(path),
+	}
+	err = state.save()
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// syncParts drops any parts from the state which S3 doesn't have
+func (b *S3Backend) syncParts(ctx context.Context, state *uploadState) error {
+	uploaded := make(map[int64]string)
+	err := b.cdn.ListPartsPagesWithContext(ctx, &s3.ListPartsInput{
+		Bucket:   aws.String(state.Bucket),
+		Key:      aws.String(state.Key),
+		UploadId: aws.String(state.UploadID),
+	}, func(page *s3.ListPartsOutput, last bool) bool {
+		for _, p := range page.Parts {
+			uploaded[aws.Int64Value(p.PartNumber)] = aws.StringValue(p.ETag)
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list parts: %w", err)
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for n, p := range state.Parts {
+		if uploaded[n] != p.ETag {
+			delete(state.Parts, n)
+		}
+	}
+	return state.save()
+}
+
+// uploadPart sends one part, S3 rejects it if it doesn't match its MD5
+func (b *S3Backend) uploadPart(ctx context.Context, f *os.File, state *uploadState, n int64) error {
+	offset := (n - 1) * state.PartSize
+	length := state.PartSize
+	if offset+length > state.Size {
+		length = state.Size - offset
+	}
+	section := io.NewSectionReader(f, offset, length)
+
+	m := md5.New()
+	_, err := io.Copy(m, section)
+	if err != nil {
+		return fmt.Errorf("failed to read part %d: %w", n, err)
+	}
+	sum := m.Sum(nil)
+	_, err = section.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("failed to seek part %d: %w", n, err)
+	}
+
+	res, err := b.cdn.UploadPartWithContext(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(state.Bucket),
+		Key:           aws.String(state.Key),
+		UploadId:      aws.String(state.UploadID),
+		PartNumber:    aws.Int64(n),
+		Body:          &countingReadSeeker{ReadSeeker: section, counter: bytesUploaded},
+		ContentLength: aws.Int64(length),
+		ContentMD5:    aws.String(base64.StdEncoding.EncodeToString(sum)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload part %d: %w", n, err)
+	}
+	return state.setPart(n, part{
+		ETag: aws.StringValue(res.ETag),
+		MD5:  hex.EncodeToString(sum),
+	})
+}
+
+// completeUpload joins the parts and checks the object S3 ended up
+// with is the same as the local file
+func (b *S3Backend) completeUpload(ctx context.Context, path string, state *uploadState, parts int64, sums Output) (string, error) {
+	completed := []*s3.CompletedPart{}
+	partSums := []byte{}
+	nums := make([]int64, 0, len(state.Parts))
+	for n := range state.Parts {
+		nums = append(nums, n)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	for _, n := range nums {
+		p := state.Parts[n]
+		completed = append(completed, &s3.CompletedPart{
+			ETag:       aws.String(p.ETag),
+			PartNumber: aws.Int64(n),
+		})
+		sum, _ := hex.DecodeString(p.MD5)
+		partSums = append(partSums, sum...)
+	}
+	if int64(len(completed)) != parts {
+		return "", fmt.Errorf("upload has %d of %d parts", len(completed), parts)
+	}
+
+	res, err := b.cdn.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(state.Bucket),
+		Key:             aws.String(state.Key),
+		UploadId:        aws.String(state.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchUpload {
+			// The upload can't be resumed, so drop our state of it
+			os.Remove(state.path)
+		}
+		return "", fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+	os.Remove(state.path)
+
+	// A multipart ETag is the MD5 of each part's MD5 and the part count
+	composite := md5.Sum(partSums)
+	expected := fmt.Sprintf("%s-%d", hex.EncodeToString(composite[:]), parts)
+	etag := strings.Trim(aws.StringValue(res.ETag), "\"")
+	if etag != expected {
+		return "", fmt.Errorf("uploaded object's etag %s doesn't match %s", etag, expected)
+	}
+
+	head, err := b.cdn.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(state.Bucket),
+		Key:    aws.String(state.Key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to head uploaded object: %w", err)
+	}
+	if aws.Int64Value(head.ContentLength) != sums.Size {
+		return "", fmt.Errorf("uploaded object is %d bytes, expected %d",
+			aws.Int64Value(head.ContentLength), sums.Size)
+	}
+	return aws.StringValue(res.Location), nil
+}
+
+// countingReadSeeker counts the bytes read through it, keeping
+// the ability to seek so the SDK can retry requests
+type countingReadSeeker struct {
+	io.ReadSeeker
+	counter interface{ Add(float64) }
+}
+
+func (c *countingReadSeeker) Read(p []byte) (int, error) {
+	n, err := c.ReadSeeker.Read(p)
+	c.counter.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,213 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var _ Backend = &SFTPBackend{}
+
+// SFTPBackend stores objects on an SFTP server, URLs are in
+// the form sftp://user@host:port/path
+type SFTPBackend struct {
+	Username       string // Used when the URL doesn't have a user
+	Password       string // Used when the URL doesn't have a password
+	KeyFile        string // Private key to authenticate with
+	KnownHostsFile string // Host keys to verify servers against
+	// InsecureIgnoreHostKey skips verifying the server,
+	// only for testing against a local stand-in
+	InsecureIgnoreHostKey bool
+}
+
+// sftpFile is a file which closes its connection when it's closed
+type sftpFile struct {
+	*sftp.File
+	client *sftp.Client
+	conn   *ssh.Client
+}
+
+func (f *sftpFile) Close() error {
+	err := f.File.Close()
+	f.client.Close()
+	f.conn.Close()
+	return err
+}
+
+// dial opens a new SFTP session to the object's server
+func (b *SFTPBackend) dial(ctx context.Context, u *url.URL) (*ssh.Client, *sftp.Client, error) {
+	conf := &ssh.ClientConfig{
+		User:    b.Username,
+		Timeout: 30 * time.Second,
+	}
+	pass := b.Password
+	if u.User != nil {
+		conf.User = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			pass = p
+		}
+	}
+	if pass != "" {
+		conf.Auth = append(conf.Auth, ssh.Password(pass))
+	}
+	if b.KeyFile != "" {
+		key, err := ioutil.ReadFile(b.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read sftp key: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse sftp key: %w", err)
+		}
+		conf.Auth = append(conf.Auth, ssh.PublicKeys(signer))
+	}
+	switch {
+	case b.InsecureIgnoreHostKey:
+		conf.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	case b.KnownHostsFile != "":
+		cb, err := knownhosts.New(b.KnownHostsFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read known hosts: %w", err)
+		}
+		conf.HostKeyCallback = cb
+	default:
+		return nil, nil, errors.New("sftp needs a known hosts file to verify servers")
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "22")
+	}
+	d := net.Dialer{Timeout: conf.Timeout}
+	netConn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to dial sftp server: %w", err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(netConn, host, conf)
+	if err != nil {
+		netConn.Close()
+		return nil, nil, fmt.Errorf("failed to connect to sftp server: %w", err)
+	}
+	conn := ssh.NewClient(c, chans, reqs)
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to start sftp session: %w", err)
+	}
+	return conn, client, nil
+}
+
+// SourceURL isn't supported since most ffmpeg builds lack sftp
+func (b *SFTPBackend) SourceURL(ctx context.Context, u *url.URL) (string, error) {
+	return "", ErrNotStreamable
+}
+
+func (b *SFTPBackend) Stat(ctx context.Context, u *url.URL) (ObjectInfo, error) {
+	conn, client, err := b.dial(ctx, u)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	fi, err := client.Stat(u.Path)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to stat file: %w", err)
+	}
+	return ObjectInfo{
+		Size:    fi.Size(),
+		ETag:    fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size()),
+		ModTime: fi.ModTime(),
+	}, nil
+}
+
+func (b *SFTPBackend) Get(ctx context.Context, u *url.URL, offset int64) (io.ReadCloser, error) {
+	conn, client, err := b.dial(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	f, err := client.Open(u.Path)
+	if err != nil {
+		client.Close()
+		conn.Close()
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		client.Close()
+		conn.Close()
+		return nil, fmt.Errorf("failed to seek file: %w", err)
+	}
+	return &sftpFile{File: f, client: client, conn: conn}, nil
+}
+
+// Put writes to a temporary file alongside the object then renames it
+func (b *SFTPBackend) Put(ctx context.Context, u *url.URL, r io.Reader, size int64) (string, error) {
+	conn, client, err := b.dial(ctx, u)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	err = client.MkdirAll(path.Dir(u.Path))
+	if err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+	tmp := path.Join(path.Dir(u.Path), "."+path.Base(u.Path)+".part")
+	f, err := client.Create(tmp)
+	if err != nil {
+		return "", fmt.Errorf("failed to create file: %w", err)
+	}
+	_, err = f.ReadFrom(r)
+	if err != nil {
+		f.Close()
+		client.Remove(tmp)
+		return "", fmt.Errorf("failed to write file: %w", err)
+	}
+	err = f.Close()
+	if err != nil {
+		client.Remove(tmp)
+		return "", fmt.Errorf("failed to write file: %w", err)
+	}
+	err = client.PosixRename(tmp, u.Path)
+	if err != nil {
+		// Not every server has the posix-rename extension
+		client.Remove(u.Path)
+		err = client.Rename(tmp, u.Path)
+	}
+	if err != nil {
+		client.Remove(tmp)
+		return "", fmt.Errorf("failed to rename file: %w", err)
+	}
+	loc := *u
+	loc.User = nil
+	return loc.String(), nil
+}
+
+func (b *SFTPBackend) Delete(ctx context.Context, u *url.URL) error {
+	conn, client, err := b.dial(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	err = client.Remove(u.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	return nil
+}
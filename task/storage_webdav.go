@@ -0,0 +1,138 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var _ Backend = &WebDAVBackend{}
+
+// WebDAVBackend stores objects on a WebDAV server, URLs are in the
+// form webdav://host/path or webdavs://host/path for https
+type WebDAVBackend struct {
+	Client   *http.Client
+	Username string // Used when the URL doesn't have credentials
+	Password string
+}
+
+func (b *WebDAVBackend) client() *http.Client {
+	if b.Client == nil {
+		return http.DefaultClient
+	}
+	return b.Client
+}
+
+// httpURL converts the object's URL to the http(s) URL it's served on
+func (b *WebDAVBackend) httpURL(u *url.URL) *url.URL {
+	h := *u
+	h.Scheme = "http"
+	if u.Scheme == "webdavs" {
+		h.Scheme = "https"
+	}
+	if h.User == nil && b.Username != "" {
+		h.User = url.UserPassword(b.Username, b.Password)
+	}
+	return &h
+}
+
+// do sends a request with the credentials as basic auth
+func (b *WebDAVBackend) do(req *http.Request) (*http.Response, error) {
+	b.setAuth(req)
+	return b.client().Do(req)
+}
+
+func (b *WebDAVBackend) setAuth(req *http.Request) {
+	if req.URL.User != nil {
+		pass, _ := req.URL.User.Password()
+		req.SetBasicAuth(req.URL.User.Username(), pass)
+		req.URL.User = nil
+	}
+}
+
+// SourceURL returns the http URL with credentials embedded,
+// which ffmpeg uses for basic auth
+func (b *WebDAVBackend) SourceURL(ctx context.Context, u *url.URL) (string, error) {
+	return b.httpURL(u).String(), nil
+}
+
+func (b *WebDAVBackend) Stat(ctx context.Context, u *url.URL) (ObjectInfo, error) {
+	return httpStat(ctx, b.client(), b.httpURL(u).String(), b.setAuth)
+}
+
+func (b *WebDAVBackend) Get(ctx context.Context, u *url.URL, offset int64) (io.ReadCloser, error) {
+	return httpGet(ctx, b.client(), b.httpURL(u).String(), offset, b.setAuth)
+}
+
+// Put creates any missing parent collections then uploads the object
+func (b *WebDAVBackend) Put(ctx context.Context, u *url.URL, r io.Reader, size int64) (string, error) {
+	h := b.httpURL(u)
+
+	err := b.mkcolAll(ctx, h)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, h.String(), r)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	res, err := b.do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to put object: %w", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to put object: %s", res.Status)
+	}
+	h.User = nil
+	return h.String(), nil
+}
+
+func (b *WebDAVBackend) Delete(ctx context.Context, u *url.URL) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, b.httpURL(u).String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	res, err := b.do(req)
+	if err != nil {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent &&
+		res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to delete object: %s", res.Status)
+	}
+	return nil
+}
+
+// mkcolAll creates each parent collection of an object, WebDAV
+// servers won't create them for us
+func (b *WebDAVBackend) mkcolAll(ctx context.Context, h *url.URL) error {
+	dirs := strings.Split(strings.Trim(h.Path, "/"), "/")
+	dir := *h
+	dir.Path = ""
+	for _, d := range dirs[:len(dirs)-1] {
+		dir.Path += "/" + d
+		req, err := http.NewRequestWithContext(ctx, "MKCOL", dir.String()+"/", nil)
+		if err != nil {
+			return fmt.Errorf("failed to create request: %w", err)
+		}
+		res, err := b.do(req)
+		if err != nil {
+			return fmt.Errorf("failed to create collection: %w", err)
+		}
+		res.Body.Close()
+		// 405 is returned when the collection already exists
+		if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusMethodNotAllowed {
+			return fmt.Errorf("failed to create collection \"%s\": %s", dir.Path, res.Status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ystv/video-transcode/subtitle"
+)
+
+const TypeSubtitleConvert string = "subtitle/convert"
+
+var _ Task = &SubtitleConvert{}
+
+// SubtitleConvert task converts a caption file between SRT,
+// WebVTT, TTML and SCC
+type SubtitleConvert struct {
+	TaskID string `json:"taskID"`
+	SrcURL string `json:"srcURL"` // Format's worked out from the contents
+	DstURL string `json:"dstURL"`
+	// "srt", "vtt", "ttml" or "scc", defaults to dstURL's extension
+	Format string `json:"format,omitempty"`
+	// Seconds the cues are moved by, i.e. -36000 for captions
+	// timed from a broadcast master's 10:00:00:00
+	Offset float64 `json:"offset,omitempty"`
+	// Worker capabilities the job needs
+	Requires []string `json:"requires,omitempty"`
+	// Maximum seconds the job can run for, 0 uses the worker's limit
+	Timeout int `json:"timeout,omitempty"`
+
+	status    Status
+	stats     *Stats
+	ffmpegLog *FFmpegLog
+
+	// dependencies
+	env *Env
+}
+
+// NewSubtitleConvert initialises a SubtitleConvert task object
+// so we can add the tasks dependencies
+func NewSubtitleConvert(env *Env) SubtitleConvert {
+	return SubtitleConvert{
+		stats: &Stats{},
+		env:   env,
+	}
+}
+
+// GetID returns a task ID
+func (t *SubtitleConvert) GetID() string {
+	return t.TaskID
+}
+
+// GetType returns the task's type
+func (t *SubtitleConvert) GetType() string {
+	return TypeSubtitleConvert
+}
+
+// GetTimeout returns the job's maximum runtime
+func (t *SubtitleConvert) GetTimeout() time.Duration {
+	return time.Duration(t.Timeout) * time.Second
+}
+
+// GetStatus returns the task's status
+func (t *SubtitleConvert) GetStatus() Status {
+	t.status.TaskID = t.TaskID
+	if t.stats != nil {
+		t.status.Stats = *t.stats
+	}
+	return t.status
+}
+
+// ValidateRequest checks the request
+func (t *SubtitleConvert) ValidateRequest() error {
+	if t.SrcURL == "" {
+		return fmt.Errorf("missing srcURL")
+	}
+	if t.DstURL == "" {
+		return fmt.Errorf("missing dstURL")
+	}
+	if err := validateStorageURL(t.SrcURL); err != nil {
+		return fmt.Errorf("invalid srcURL: %w", err)
+	}
+	if err := validateStorageURL(t.DstURL); err != nil {
+		return fmt.Errorf("invalid dstURL: %w", err)
+	}
+	format, err := captionFormat(t.Format, t.DstURL)
+	if err != nil {
+		return err
+	}
+	t.Format = string(format)
+	if err := ValidateRequirements(t.Requires); err != nil {
+		return err
+	}
+	t.TaskID = uuid.NewString()
+	return nil
+}
+
+// Start reads the captions and writes them out in the new format
+func (t *SubtitleConvert) Start(ctx context.Context) error {
+	t.status.Stage = StageStarted
+	t.status.StageStart = time.Now()
+
+	b, dst, err := t.env.Store.Resolve(t.DstURL)
+	if err != nil {
+		return NewError(ErrorInvalidArgs, false, fmt.Errorf("failed to resolve destination: %w", err))
+	}
+	ws, err := t.env.Workspaces.Create(t.TaskID)
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer ws.Remove()
+	t.ffmpegLog, err = newFFmpegLog(ws.Path("ffmpeg.log"))
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer finishLog(ctx, t.ffmpegLog, b, withSuffix(dst, ".log"), &t.status)
+
+	input, release, err := openSource(ctx, t.env, t.SrcURL, true, &t.status)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	t.status.Stage = StageTranscoding
+	t.status.StageStart = time.Now()
+	cues, err := readCaptions(ctx, t, t.env, ws, input, t.stats, t.ffmpegLog)
+	if err != nil {
+		return err
+	}
+	output := ws.Path(path.Base(dst.Path))
+	err = writeCaptions(output, subtitle.Format(t.Format), subtitle.Shift(cues, seconds(t.Offset)))
+	if err != nil {
+		return err
+	}
+
+	t.status.Stage = StageUploading
+	t.status.StageStart = time.Now()
+	out, err := uploadOutput(ctx, b, dst, output)
+	if err != nil {
+		return err
+	}
+	t.status.Result = &Result{Outputs: []Output{out}}
+	return nil
+}
+
+// LogTail returns the end of ffmpeg's output
+func (t *SubtitleConvert) LogTail() []string {
+	return t.ffmpegLog.Tail(logTailLines)
+}
+
+// captionFormat returns the format captions are written in,
+// from the request or the extension of where they go
+func captionFormat(format, dstURL string) (subtitle.Format, error) {
+	if format != "" {
+		return subtitle.ParseFormat(format)
+	}
+	f, ok := subtitle.FormatOf(dstURL)
+	if !ok {
+		return "", fmt.Errorf("missing format and dstURL doesn't have a caption file extension")
+	}
+	return f, nil
+}
+
+// readCaptions reads the cues of a local caption file, whatever its
+// format. SCC is decoded to SRT by ffmpeg first. Malformed files are
+// invalid-args errors saying where the problem is.
+func readCaptions(ctx context.Context, t Task, env *Env, ws *Workspace, input string,
+	stats *Stats, flog *FFmpegLog) ([]subtitle.Cue, error) {
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return nil, inputError(fmt.Errorf("failed to read captions: %w", err))
+	}
+	format, ok := subtitle.Detect(data)
+	if !ok {
+		return nil, NewError(ErrorInvalidArgs, false, fmt.Errorf("captions aren't SRT, WebVTT, TTML or SCC"))
+	}
+	if format == subtitle.SCC {
+		decoded := ws.Path(fmt.Sprintf("decoded-%s.srt", uuid.NewString()))
+		cmdString := fmt.Sprintf("\"%s\" -y -f scc -i \"%s\" -f srt \"%s\" 2>&1", env.FFmpeg, input, decoded)
+		err = runFFmpeg(ctx, t, env, cmdString, stats, flog)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode SCC: %w", err)
+		}
+		input, format = decoded, subtitle.SRT
+	}
+	return parseCaptions(input, format)
+}
+
+// parseCaptions reads the cues of a local caption file
+// in a format that's already known
+func parseCaptions(input string, format subtitle.Format) ([]subtitle.Cue, error) {
+	f, err := os.Open(input)
+	if err != nil {
+		return nil, NewError(ErrorWorkerFailure, true, fmt.Errorf("failed to open captions: %w", err))
+	}
+	defer f.Close()
+	cues, err := subtitle.Parse(format, f)
+	var parseErr *subtitle.ParseError
+	if errors.As(err, &parseErr) {
+		return nil, NewError(ErrorInvalidArgs, false, err)
+	}
+	if err != nil {
+		return nil, NewError(ErrorWorkerFailure, true, err)
+	}
+	return cues, nil
+}
+
+// writeCaptions writes cues to a local caption file
+func writeCaptions(output string, format subtitle.Format, cues []subtitle.Cue) error {
+	f, err := os.Create(output)
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, fmt.Errorf("failed to create captions: %w", err))
+	}
+	defer f.Close()
+	err = subtitle.Write(format, f, cues)
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, fmt.Errorf("failed to write captions: %w", err))
+	}
+	return f.Close()
+}
+
+// seconds converts a number of seconds to a duration
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,168 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ystv/video-transcode/subtitle"
+)
+
+const TypeSubtitleExtract string = "subtitle/extract"
+
+var _ Task = &SubtitleExtract{}
+
+// SubtitleExtract task pulls the CEA-608 captions embedded in a
+// source's video out into a caption file, i.e. from a broadcast master
+type SubtitleExtract struct {
+	TaskID string `json:"taskID"`
+	SrcURL string `json:"srcURL"`
+	DstURL string `json:"dstURL"`
+	// "srt", "vtt", "ttml" or "scc", defaults to dstURL's extension
+	Format string `json:"format,omitempty"`
+	// Seconds the cues are moved by
+	Offset   float64 `json:"offset,omitempty"`
+	Download bool    `json:"download"`
+	// Worker capabilities the job needs
+	Requires []string `json:"requires,omitempty"`
+	// Maximum seconds the job can run for, 0 uses the worker's limit
+	Timeout int `json:"timeout,omitempty"`
+
+	status    Status
+	stats     *Stats
+	ffmpegLog *FFmpegLog
+
+	// dependencies
+	env *Env
+}
+
+// NewSubtitleExtract initialises a SubtitleExtract task object
+// so we can add the tasks dependencies
+func NewSubtitleExtract(env *Env) SubtitleExtract {
+	return SubtitleExtract{
+		stats: &Stats{},
+		env:   env,
+	}
+}
+
+// GetID returns a task ID
+func (t *SubtitleExtract) GetID() string {
+	return t.TaskID
+}
+
+// GetType returns the task's type
+func (t *SubtitleExtract) GetType() string {
+	return TypeSubtitleExtract
+}
+
+// GetTimeout returns the job's maximum runtime
+func (t *SubtitleExtract) GetTimeout() time.Duration {
+	return time.Duration(t.Timeout) * time.Second
+}
+
+// GetStatus returns the task's status
+func (t *SubtitleExtract) GetStatus() Status {
+	t.status.TaskID = t.TaskID
+	if t.stats != nil {
+		t.status.Stats = *t.stats
+	}
+	return t.status
+}
+
+// ValidateRequest checks the request
+func (t *SubtitleExtract) ValidateRequest() error {
+	if t.SrcURL == "" {
+		return fmt.Errorf("missing srcURL")
+	}
+	if t.DstURL == "" {
+		return fmt.Errorf("missing dstURL")
+	}
+	if err := validateStorageURL(t.SrcURL); err != nil {
+		return fmt.Errorf("invalid srcURL: %w", err)
+	}
+	if err := validateStorageURL(t.DstURL); err != nil {
+		return fmt.Errorf("invalid dstURL: %w", err)
+	}
+	format, err := captionFormat(t.Format, t.DstURL)
+	if err != nil {
+		return err
+	}
+	t.Format = string(format)
+	if err := ValidateRequirements(t.Requires); err != nil {
+		return err
+	}
+	t.TaskID = uuid.NewString()
+	return nil
+}
+
+// Start decodes the source's captions and uploads them
+func (t *SubtitleExtract) Start(ctx context.Context) error {
+	t.status.Stage = StageStarted
+	t.status.StageStart = time.Now()
+
+	b, dst, err := t.env.Store.Resolve(t.DstURL)
+	if err != nil {
+		return NewError(ErrorInvalidArgs, false, fmt.Errorf("failed to resolve destination: %w", err))
+	}
+	ws, err := t.env.Workspaces.Create(t.TaskID)
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer ws.Remove()
+	t.ffmpegLog, err = newFFmpegLog(ws.Path("ffmpeg.log"))
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer finishLog(ctx, t.ffmpegLog, b, withSuffix(dst, ".log"), &t.status)
+
+	input, release, err := openSource(ctx, t.env, t.SrcURL, t.Download, &t.status)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// The movie source's subcc output is the captions carried in
+	// the video, which ffmpeg decodes as it decodes the video
+	log.Printf("extracting captions: %s", t.GetID())
+	startExt := time.Now()
+	t.status.Stage = StageTranscoding
+	t.status.StageStart = startExt
+	extracted := ws.Path("extracted.srt")
+	cmdString := fmt.Sprintf("\"%s\" -y -f lavfi -i \"movie='%s'[out0+subcc]\" -map 0:s -c:s srt \"%s\" 2>&1",
+		t.env.FFmpeg, input, extracted)
+	err = runFFmpeg(ctx, t, t.env, cmdString, t.stats, t.ffmpegLog)
+	if err != nil {
+		return err
+	}
+	log.Printf("finished extracting - completed in %s", time.Since(startExt))
+
+	cues, err := parseCaptions(extracted, subtitle.SRT)
+	if err != nil {
+		return err
+	}
+	if len(cues) == 0 {
+		return NewError(ErrorInvalidArgs, false, fmt.Errorf("source doesn't have any CEA-608 captions"))
+	}
+	output := ws.Path(path.Base(dst.Path))
+	err = writeCaptions(output, subtitle.Format(t.Format), subtitle.Shift(cues, seconds(t.Offset)))
+	if err != nil {
+		return err
+	}
+
+	t.status.Stage = StageUploading
+	t.status.StageStart = time.Now()
+	out, err := uploadOutput(ctx, b, dst, output)
+	if err != nil {
+		return err
+	}
+	t.status.Result = &Result{Outputs: []Output{out}}
+	return nil
+}
+
+// LogTail returns the end of ffmpeg's output
+func (t *SubtitleExtract) LogTail() []string {
+	return t.ffmpegLog.Tail(logTailLines)
+}
@@ -0,0 +1,471 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ystv/video-transcode/subtitle"
+)
+
+const TypeSubtitleMux string = "subtitle/mux"
+
+const (
+	// subtitleGroup is the HLS group ID the renditions are added to
+	subtitleGroup = "subs"
+	// defaultMPEGTSStart is where ffmpeg starts MPEG-TS timestamps,
+	// 1.4 seconds in 90kHz ticks
+	defaultMPEGTSStart = 126000
+)
+
+// subtitleCodecs are the subtitle codecs for the containers
+// tracks can be muxed into
+var subtitleCodecs = map[string]string{
+	".mp4": "mov_text",
+	".m4v": "mov_text",
+	".mov": "mov_text",
+	".mkv": "srt",
+}
+
+var (
+	// languagePattern matches ISO 639 codes, i.e. "en" or "eng",
+	// optionally with a region
+	languagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]+)*$`)
+	// trackNamePattern matches names which can go in both a
+	// command line and a playlist without escaping
+	trackNamePattern = regexp.MustCompile(`^[^"$\x60\\\n\r]*$`)
+	// subtitlesAttr matches a variant's subtitles group
+	subtitlesAttr = regexp.MustCompile(`,?SUBTITLES="[^"]*"`)
+)
+
+var _ Task = &SubtitleMux{}
+
+type (
+	// SubtitleTrack is a caption file added to an output
+	SubtitleTrack struct {
+		URL      string `json:"url"`                // SRT, WebVTT, TTML or SCC, see Storage
+		Language string `json:"language,omitempty"` // ISO 639, i.e. "eng"
+		Name     string `json:"name,omitempty"`     // What players list it as
+		Default  bool   `json:"default"`
+		// Seconds the cues are moved by
+		Offset float64 `json:"offset,omitempty"`
+	}
+	// SubtitleMux task adds sidecar caption files to a video as subtitle
+	// tracks, or to an HLS master playlist as subtitle renditions
+	SubtitleMux struct {
+		TaskID string `json:"taskID"`
+		// Video, or the master playlist when dstURL is an .m3u8
+		SrcURL string          `json:"srcURL"`
+		Tracks []SubtitleTrack `json:"tracks"`
+		// .mp4, .m4v, .mov, .mkv or .m3u8
+		DstURL   string `json:"dstURL"`
+		Download bool   `json:"download"`
+		// Worker capabilities the job needs
+		Requires []string `json:"requires,omitempty"`
+		// Maximum seconds the job can run for, 0 uses the worker's limit
+		Timeout int `json:"timeout,omitempty"`
+
+		status    Status
+		stats     *Stats
+		ffmpegLog *FFmpegLog
+
+		// dependencies
+		env *Env
+	}
+)
+
+// NewSubtitleMux initialises a SubtitleMux task object
+// so we can add the tasks dependencies
+func NewSubtitleMux(env *Env) SubtitleMux {
+	return SubtitleMux{
+		stats: &Stats{},
+		env:   env,
+	}
+}
+
+// GetID returns a task ID
+func (t *SubtitleMux) GetID() string {
+	return t.TaskID
+}
+
+// GetType returns the task's type
+func (t *SubtitleMux) GetType() string {
+	return TypeSubtitleMux
+}
+
+// GetTimeout returns the job's maximum runtime
+func (t *SubtitleMux) GetTimeout() time.Duration {
+	return time.Duration(t.Timeout) * time.Second
+}
+
+// GetStatus returns the task's status
+func (t *SubtitleMux) GetStatus() Status {
+	t.status.TaskID = t.TaskID
+	if t.stats != nil {
+		t.status.Stats = *t.stats
+	}
+	return t.status
+}
+
+// ValidateRequest checks the request
+func (t *SubtitleMux) ValidateRequest() error {
+	if t.SrcURL == "" {
+		return fmt.Errorf("missing srcURL")
+	}
+	if t.DstURL == "" {
+		return fmt.Errorf("missing dstURL")
+	}
+	if len(t.Tracks) == 0 {
+		return fmt.Errorf("missing tracks")
+	}
+	if err := validateStorageURL(t.SrcURL); err != nil {
+		return fmt.Errorf("invalid srcURL: %w", err)
+	}
+	if err := validateStorageURL(t.DstURL); err != nil {
+		return fmt.Errorf("invalid dstURL: %w", err)
+	}
+	ext := strings.ToLower(path.Ext(t.DstURL))
+	if _, ok := subtitleCodecs[ext]; !ok && ext != ".m3u8" {
+		return fmt.Errorf("dstURL has to be an .mp4, .m4v, .mov, .mkv or .m3u8")
+	}
+	defaults := 0
+	for i, tr := range t.Tracks {
+		if err := validateStorageURL(tr.URL); err != nil {
+			return fmt.Errorf("invalid tracks[%d] url: %w", i, err)
+		}
+		if tr.Language != "" && !languagePattern.MatchString(tr.Language) {
+			return fmt.Errorf("invalid tracks[%d] language \"%s\"", i, tr.Language)
+		}
+		if !trackNamePattern.MatchString(tr.Name) {
+			return fmt.Errorf("tracks[%d] name can't have quotes, backslashes or line breaks", i)
+		}
+		if tr.Default {
+			defaults++
+		}
+	}
+	if defaults > 1 {
+		return fmt.Errorf("only one track can be the default")
+	}
+	if err := ValidateRequirements(t.Requires); err != nil {
+		return err
+	}
+	t.TaskID = uuid.NewString()
+	return nil
+}
+
+// Start reads the tracks and adds them to the video or playlist
+func (t *SubtitleMux) Start(ctx context.Context) error {
+	t.status.Stage = StageStarted
+	t.status.StageStart = time.Now()
+
+	b, dst, err := t.env.Store.Resolve(t.DstURL)
+	if err != nil {
+		return NewError(ErrorInvalidArgs, false, fmt.Errorf("failed to resolve destination: %w", err))
+	}
+	ws, err := t.env.Workspaces.Create(t.TaskID)
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer ws.Remove()
+	t.ffmpegLog, err = newFFmpegLog(ws.Path("ffmpeg.log"))
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer finishLog(ctx, t.ffmpegLog, b, withSuffix(dst, ".log"), &t.status)
+
+	tracks := make([][]subtitle.Cue, len(t.Tracks))
+	for i, tr := range t.Tracks {
+		input, release, err := openSource(ctx, t.env, tr.URL, true, &t.status)
+		if err != nil {
+			return err
+		}
+		defer release()
+		cues, err := readCaptions(ctx, t, t.env, ws, input, t.stats, t.ffmpegLog)
+		if err != nil {
+			return fmt.Errorf("tracks[%d]: %w", i, err)
+		}
+		tracks[i] = subtitle.Shift(cues, seconds(tr.Offset))
+	}
+
+	if strings.ToLower(path.Ext(dst.Path)) == ".m3u8" {
+		outputs, err := t.addRenditions(ctx, b, dst, ws, tracks)
+		if err != nil {
+			return err
+		}
+		t.status.Result = &Result{Outputs: outputs}
+		return nil
+	}
+
+	// Tracks are normalised to SRT, which ffmpeg can
+	// convert to whichever codec the container needs
+	inputArgs := ""
+	trackArgs := ""
+	for i, cues := range tracks {
+		srt := ws.Path(fmt.Sprintf("track%d.srt", i))
+		err = writeCaptions(srt, subtitle.SRT, cues)
+		if err != nil {
+			return err
+		}
+		tr := t.Tracks[i]
+		inputArgs += fmt.Sprintf("-i \"%s\" ", srt)
+		trackArgs += fmt.Sprintf("-map %d:0 ", i+1)
+		if tr.Language != "" {
+			trackArgs += fmt.Sprintf("-metadata:s:s:%d language=%s ", i, tr.Language)
+		}
+		if tr.Name != "" {
+			trackArgs += fmt.Sprintf("-metadata:s:s:%d title=\"%s\" ", i, tr.Name)
+		}
+		disposition := "0"
+		if tr.Default {
+			disposition = "default"
+		}
+		trackArgs += fmt.Sprintf("-disposition:s:%d %s ", i, disposition)
+	}
+
+	input, release, err := openSource(ctx, t.env, t.SrcURL, t.Download, &t.status)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	log.Printf("muxing %d subtitle tracks: %s", len(tracks), t.GetID())
+	startMux := time.Now()
+	t.status.Stage = StageTranscoding
+	t.status.StageStart = startMux
+	output := ws.Path(path.Base(dst.Path))
+	codec := subtitleCodecs[strings.ToLower(path.Ext(dst.Path))]
+	cmdString := fmt.Sprintf("\"%s\" -y -i \"%s\" %s-map 0:v -map \"0:a?\" %s-c copy -c:s %s \"%s\" 2>&1",
+		t.env.FFmpeg, input, inputArgs, trackArgs, codec, output)
+	err = runFFmpeg(ctx, t, t.env, cmdString, t.stats, t.ffmpegLog)
+	if err != nil {
+		return err
+	}
+	log.Printf("finished muxing - completed in %s", time.Since(startMux))
+
+	t.status.Stage = StageUploading
+	t.status.StageStart = time.Now()
+	out, err := uploadOutput(ctx, b, dst, output)
+	if err != nil {
+		return err
+	}
+	t.status.Result = &Result{Outputs: []Output{out}}
+	return nil
+}
+
+// LogTail returns the end of ffmpeg's output
+func (t *SubtitleMux) LogTail() []string {
+	return t.ffmpegLog.Tail(logTailLines)
+}
+
+// addRenditions uploads each track as a WebVTT rendition alongside
+// dst, then the source's master playlist with them added to it
+func (t *SubtitleMux) addRenditions(ctx context.Context, b Backend, dst *url.URL, ws *Workspace,
+	tracks [][]subtitle.Cue) ([]Output, error) {
+	input, release, err := openSource(ctx, t.env, t.SrcURL, true, &t.status)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	master, err := os.ReadFile(input)
+	if err != nil {
+		return nil, inputError(fmt.Errorf("failed to read master playlist: %w", err))
+	}
+	t.status.Stage = StageAnalysing
+	t.status.StageStart = time.Now()
+	mpegts, err := t.segmentStart(ctx, string(master))
+	if err != nil {
+		log.Printf("failed to find where the segments start, assuming ffmpeg's default: %+v", err)
+		mpegts = defaultMPEGTSStart
+	}
+
+	t.status.Stage = StageUploading
+	t.status.StageStart = time.Now()
+	outputs := []Output{}
+	media := []string{}
+	for i, cues := range tracks {
+		tr := t.Tracks[i]
+		name := fmt.Sprintf("%s_subs%d", strings.TrimSuffix(path.Base(dst.Path), path.Ext(dst.Path)), i)
+		if tr.Language != "" {
+			name += "_" + tr.Language
+		}
+
+		vtt := ws.Path(name + ".vtt")
+		err = writeRendition(vtt, cues, mpegts)
+		if err != nil {
+			return nil, err
+		}
+		playlist := ws.Path(name + ".m3u8")
+		err = os.WriteFile(playlist, []byte(mediaPlaylist(name+".vtt", subtitle.Duration(cues))), 0644)
+		if err != nil {
+			return nil, NewError(ErrorWorkerFailure, true, fmt.Errorf("failed to write playlist: %w", err))
+		}
+		for _, file := range []string{vtt, playlist} {
+			u := *dst
+			u.Path = path.Join(path.Dir(dst.Path), path.Base(file))
+			out, err := uploadOutput(ctx, b, &u, file)
+			if err != nil {
+				return nil, err
+			}
+			outputs = append(outputs, out)
+		}
+		media = append(media, renditionTag(tr, i, name+".m3u8"))
+	}
+
+	updated, err := addSubtitleGroup(string(master), media)
+	if err != nil {
+		return nil, NewError(ErrorInvalidArgs, false, err)
+	}
+	output := ws.Path(path.Base(dst.Path))
+	err = os.WriteFile(output, []byte(updated), 0644)
+	if err != nil {
+		return nil, NewError(ErrorWorkerFailure, true, fmt.Errorf("failed to write master playlist: %w", err))
+	}
+	out, err := uploadOutput(ctx, b, dst, output)
+	if err != nil {
+		return nil, err
+	}
+	return append(outputs, out), nil
+}
+
+// segmentStart finds the first timestamp of the first variant's
+// segments, so the renditions' cues can be lined up with them
+func (t *SubtitleMux) segmentStart(ctx context.Context, master string) (int64, error) {
+	src, err := parseStorageURL(t.SrcURL)
+	if err != nil {
+		return 0, err
+	}
+	ref, err := url.Parse(playlistURI(master, "#EXT-X-STREAM-INF:"))
+	if err != nil || ref.String() == "" {
+		return 0, fmt.Errorf("master playlist has no variants")
+	}
+	mediaURL := src.ResolveReference(ref)
+	b, u, err := t.env.Store.Resolve(mediaURL.String())
+	if err != nil {
+		return 0, err
+	}
+	r, err := b.Get(ctx, u, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get media playlist: %w", err)
+	}
+	defer r.Close()
+	media, err := io.ReadAll(io.LimitReader(r, 16<<20))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read media playlist: %w", err)
+	}
+	if strings.Contains(string(media), "#EXT-X-MAP:") {
+		// fMP4 segments start from 0
+		return 0, nil
+	}
+	ref, err = url.Parse(playlistURI(string(media), "#EXTINF:"))
+	if err != nil || ref.String() == "" {
+		return 0, fmt.Errorf("media playlist has no segments")
+	}
+	input, release, err := openSource(ctx, t.env, mediaURL.ResolveReference(ref).String(), false, &t.status)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	info, err := probe(ctx, t.env.FFprobe, input)
+	if err != nil {
+		return 0, err
+	}
+	return int64(math.Round(info.StartTime * 90000)), nil
+}
+
+// playlistURI returns the first URI in an HLS playlist after a tag
+func playlistURI(playlist, tag string) string {
+	found := false
+	for _, l := range strings.Split(strings.ReplaceAll(playlist, "\r\n", "\n"), "\n") {
+		l = strings.TrimSpace(l)
+		switch {
+		case strings.HasPrefix(l, tag):
+			found = true
+		case found && l != "" && !strings.HasPrefix(l, "#"):
+			return l
+		}
+	}
+	return ""
+}
+
+// writeRendition writes a track's WebVTT rendition, with its cues'
+// 0 at the segments' first timestamp
+func writeRendition(output string, cues []subtitle.Cue, mpegts int64) error {
+	f, err := os.Create(output)
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, fmt.Errorf("failed to create captions: %w", err))
+	}
+	defer f.Close()
+	err = subtitle.WriteHLSVTT(f, cues, mpegts)
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, fmt.Errorf("failed to write captions: %w", err))
+	}
+	return f.Close()
+}
+
+// mediaPlaylist is an HLS playlist with the whole of a
+// WebVTT file as its only segment
+func mediaPlaylist(vtt string, duration time.Duration) string {
+	target := int(math.Ceil(duration.Seconds()))
+	if target < 1 {
+		target = 1
+	}
+	return fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-PLAYLIST-TYPE:VOD\n"+
+		"#EXTINF:%.3f,\n%s\n#EXT-X-ENDLIST\n", target, duration.Seconds(), vtt)
+}
+
+// renditionTag is the master playlist's tag for a track's rendition
+func renditionTag(tr SubtitleTrack, i int, uri string) string {
+	name := tr.Name
+	if name == "" {
+		name = tr.Language
+	}
+	if name == "" {
+		name = fmt.Sprintf("Subtitles %d", i+1)
+	}
+	tag := fmt.Sprintf("#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"%s\",NAME=\"%s\"", subtitleGroup, name)
+	if tr.Language != "" {
+		tag += fmt.Sprintf(",LANGUAGE=\"%s\"", tr.Language)
+	}
+	isDefault := "NO"
+	if tr.Default {
+		isDefault = "YES"
+	}
+	return tag + fmt.Sprintf(",DEFAULT=%s,AUTOSELECT=YES,URI=\"%s\"", isDefault, uri)
+}
+
+// addSubtitleGroup adds subtitle renditions to a master playlist,
+// replacing any it already had, and points every variant at them
+func addSubtitleGroup(master string, media []string) (string, error) {
+	lines := strings.Split(strings.ReplaceAll(master, "\r\n", "\n"), "\n")
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != "#EXTM3U" {
+		return "", fmt.Errorf("srcURL isn't an HLS playlist")
+	}
+	updated := []string{}
+	variants := 0
+	for _, l := range lines {
+		switch {
+		case strings.HasPrefix(l, "#EXT-X-MEDIA:") && strings.Contains(l, "TYPE=SUBTITLES"):
+			continue
+		case strings.HasPrefix(l, "#EXT-X-STREAM-INF:"):
+			if variants == 0 {
+				updated = append(updated, media...)
+			}
+			variants++
+			l = subtitlesAttr.ReplaceAllString(l, "") + fmt.Sprintf(",SUBTITLES=\"%s\"", subtitleGroup)
+		}
+		updated = append(updated, l)
+	}
+	if variants == 0 {
+		return "", fmt.Errorf("srcURL isn't a master playlist, it doesn't have any variants")
+	}
+	return strings.Join(updated, "\n"), nil
+}
@@ -4,30 +4,83 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
+)
 
-	"github.com/aws/aws-sdk-go/service/s3"
+const (
+	// maxResumes is how many times a task which kept its work when it
+	// failed is requeued to carry on from it, before it's failed
+	maxResumes = 3
+	// resumeWindow is how long kept work waits for its job to be
+	// redelivered to this worker, it may go to another one instead
+	resumeWindow = 30 * time.Minute
 )
 
+// ErrRequeue is returned by Add when a task failed but kept its work,
+// so its job should be requeued for the task to carry on from it
+var ErrRequeue = errors.New("job requeued to resume")
+
 type (
 	// Tasker runs tasks in ffmpeg
 	Tasker struct {
-		tasks map[string]Task
+		mu       sync.RWMutex
+		tasks    map[string]Task
+		finished []Status // Final statuses not yet reported
+		// How many times each task has been requeued to resume
+		resumes map[string]int
 		// depenendencies
-		cdn *s3.S3
+		env *Env
+	}
+	// Env is what tasks need from the worker they're running on
+	Env struct {
+		Store       *Storage
+		Cache       *Cache
+		Workspaces  *Workspaces
+		APIEndpoint string
+		FFmpeg      string // Path of the ffmpeg binary
+		FFprobe     string // Path of the ffprobe binary
+		// Maximum runtime of each task type, jobs can set their own
+		Timeouts map[string]time.Duration
+		// How long ffmpeg can go without progress before it's
+		// killed, and how many times it's retried when it is
+		StallTimeout time.Duration
+		StallRetries int
+	}
+	// logTailer is implemented by tasks which keep ffmpeg's output
+	logTailer interface {
+		LogTail() []string
+	}
+	// resumer is implemented by tasks which can keep their work when
+	// they fail, i.e. an encode which didn't finish uploading
+	resumer interface {
+		// Resumable reports whether the last run kept anything
+		Resumable() bool
+		// Discard removes what was kept once it won't be resumed
+		Discard()
+	}
+	// timeouter is implemented by tasks which can have their own
+	// maximum runtime, zero when they don't
+	timeouter interface {
+		GetTimeout() time.Duration
 	}
 	// Task is a generic representation of a task
 	Task interface {
 		GetID() string
+		GetType() string
 		GetStatus() Status
 		ValidateRequest() error // Generates TaskID as well as validation
 		Start(ctx context.Context) error
 	}
 	Status struct {
-		Stage      string    `json:"stage"`      // Is it downloading / transcoding / uploading
-		StageStart time.Time `json:"stageStart"` // Time of when the stage started
-		Stats      Stats     `json:"stats"`      // For during the transcoding stage
-		Err        error     `json:"err"`        // An error inside the task
+		TaskID     string    `json:"taskID"`            // ID of the task this status belongs to
+		Stage      string    `json:"stage"`             // Is it downloading / transcoding / uploading
+		StageStart time.Time `json:"stageStart"`        // Time of when the stage started
+		Stats      Stats     `json:"stats"`             // For during the transcoding stage
+		Error      *Error    `json:"error,omitempty"`   // Why the task failed
+		LogTail    []string  `json:"logTail,omitempty"` // End of ffmpeg's output when the task failed
+		Log        string    `json:"log,omitempty"`     // Where ffmpeg's full output was uploaded to
+		Result     *Result   `json:"result,omitempty"`  // What the task produced once it's completed
 	}
 )
 
@@ -36,31 +89,152 @@ const (
 	StageUploading   string = "uploading"
 	StageTranscoding string = "transcoding"
 	StageDownloading string = "downloading"
+	StageVerifying   string = "verifying"
+	StageScoring     string = "scoring"
+	StageAnalysing   string = "analysing"
+	StageCompleted   string = "completed"
+	StageFailed      string = "failed"
 )
 
 // New creates a task runner
-func New(cdn *s3.S3) *Tasker {
-	return &Tasker{tasks: make(map[string]Task), cdn: cdn}
+func New(env *Env) *Tasker {
+	return &Tasker{tasks: make(map[string]Task), resumes: make(map[string]int), env: env}
 }
 
 // Add a task to the tasker and start
 func (ta *Tasker) Add(ctx context.Context, t Task) error {
+	ta.mu.Lock()
 	_, exists := ta.tasks[t.GetID()]
 	if exists {
+		ta.mu.Unlock()
 		return errors.New("duplicate job id:" + t.GetID())
 	}
 	ta.tasks[t.GetID()] = t
+	ta.mu.Unlock()
 
-	err := ta.tasks[t.GetID()].Start(ctx)
-	if err != nil {
+	activeTasks.WithLabelValues(t.GetType()).Inc()
+	defer func() {
+		ta.mu.Lock()
 		delete(ta.tasks, t.GetID())
+		ta.mu.Unlock()
+		activeTasks.WithLabelValues(t.GetType()).Dec()
+		encodeSpeed.DeleteLabelValues(t.GetID(), t.GetType())
+	}()
+
+	runCtx := ctx
+	timeout := ta.timeout(t)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := t.Start(runCtx)
+
+	if ctx.Err() != nil {
+		// Cancelled tasks are requeued, so they haven't finished
+		return fmt.Errorf("job cancelled: %w", ctx.Err())
+	}
+	if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("%w after %s", ErrTimeout, timeout)
+	}
+	if ta.requeue(t, err) {
+		return fmt.Errorf("%w: %v", ErrRequeue, err)
+	}
+
+	status := t.GetStatus()
+	status.StageStart = time.Now()
+	if err != nil {
+		status.Stage = StageFailed
+		status.Error = AsError(err)
+		if lt, ok := t.(logTailer); ok {
+			status.LogTail = lt.LogTail()
+		}
+	} else {
+		status.Stage = StageCompleted
+		status.Stats.Percentage = 100
+		status.Stats.ETA = 0
+	}
+	ta.mu.Lock()
+	ta.finished = append(ta.finished, status)
+	ta.mu.Unlock()
+
+	if err != nil {
 		return fmt.Errorf("failed to start job: %w", err)
 	}
-	delete(ta.tasks, t.GetID())
 	return nil
 }
 
+// requeue checks whether a failed task kept its work and can have
+// another go at carrying on from it, otherwise what it kept is removed
+func (ta *Tasker) requeue(t Task, err error) bool {
+	r, ok := t.(resumer)
+	if !ok {
+		return false
+	}
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	id := t.GetID()
+	if err == nil || !r.Resumable() || !AsError(err).Retryable || ta.resumes[id] >= maxResumes {
+		delete(ta.resumes, id)
+		r.Discard()
+		return false
+	}
+	ta.resumes[id]++
+	attempt := ta.resumes[id]
+	// The job may be redelivered to another worker, in which
+	// case nothing will come back for what was kept
+	time.AfterFunc(resumeWindow, func() {
+		ta.mu.Lock()
+		defer ta.mu.Unlock()
+		_, running := ta.tasks[id]
+		if ta.resumes[id] == attempt && !running {
+			delete(ta.resumes, id)
+			r.Discard()
+		}
+	})
+	return true
+}
+
+// Fail records a task as failed without running it, i.e. when
+// its job couldn't be read
+func (ta *Tasker) Fail(taskID string, err error) {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	ta.finished = append(ta.finished, Status{
+		TaskID:     taskID,
+		Stage:      StageFailed,
+		StageStart: time.Now(),
+		Error:      AsError(err),
+	})
+}
+
+// timeout returns how long a task can run for, the task's
+// own limit takes precedence over its type's
+func (ta *Tasker) timeout(t Task) time.Duration {
+	if tt, ok := t.(timeouter); ok && tt.GetTimeout() > 0 {
+		return tt.GetTimeout()
+	}
+	if ta.env == nil {
+		return 0
+	}
+	return ta.env.Timeouts[t.GetType()]
+}
+
+// Finished returns the final statuses of the tasks which have ended
+// since it was last called
+func (ta *Tasker) Finished() []Status {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	finished := ta.finished
+	ta.finished = nil
+	return finished
+}
+
+// GetTasks returns the tasks currently running
 func (ta *Tasker) GetTasks(ctx context.Context) []Task {
+	ta.mu.RLock()
+	defer ta.mu.RUnlock()
 	tasks := []Task{}
 	for task := range ta.tasks {
 		tasks = append(tasks, ta.tasks[task])
@@ -0,0 +1,147 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// defaultDurationTolerance is how many seconds an encode's duration can
+// differ from its source's, containers pad streams slightly differently
+const defaultDurationTolerance = 1.0
+
+var (
+	blackPattern   = regexp.MustCompile(`black_start:\s*(\S+)\s+black_end:\s*(\S+)`)
+	silencePattern = regexp.MustCompile(`silence_start:\s*(\S+)`)
+)
+
+// VerifyOptions are checks an encode has to pass before it's uploaded,
+// on top of matching its source's duration and kinds of streams
+type VerifyOptions struct {
+	// Seconds the duration can differ from the source's by
+	DurationTolerance float64 `json:"durationTolerance,omitempty"`
+	// Don't compare durations, for encodes which trim the source
+	SkipDuration bool   `json:"skipDuration,omitempty"`
+	VideoCodec   string `json:"videoCodec,omitempty"`
+	AudioCodec   string `json:"audioCodec,omitempty"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+	// Longest silence or run of black frames allowed in
+	// seconds, they aren't looked for when 0
+	Silence float64 `json:"silence,omitempty"`
+	Black   float64 `json:"black,omitempty"`
+}
+
+// Validate checks the options make sense
+func (o VerifyOptions) Validate() error {
+	if o.DurationTolerance < 0 || o.Width < 0 || o.Height < 0 || o.Silence < 0 || o.Black < 0 {
+		return fmt.Errorf("verify options can't be negative")
+	}
+	return nil
+}
+
+// verifyOutput checks an encode against its source and the options, the
+// source's info is nil when it couldn't be probed. The error lists every
+// check which failed.
+func verifyOutput(ctx context.Context, env *Env, output string, src *ProbeInfo, args string, opts VerifyOptions) error {
+	info, err := probe(ctx, env.FFprobe, output)
+	if err != nil {
+		return &Error{
+			Category: ErrorVerificationFailure,
+			Message:  fmt.Sprintf("encode failed verification: couldn't be probed: %+v", err),
+			err:      err,
+		}
+	}
+
+	failed := []string{}
+	if src != nil && src.Duration > 0 && !opts.SkipDuration {
+		tolerance := opts.DurationTolerance
+		if tolerance == 0 {
+			tolerance = defaultDurationTolerance
+		}
+		if math.Abs(info.Duration-src.Duration) > tolerance {
+			failed = append(failed, fmt.Sprintf("duration of %.2fs doesn't match the source's %.2fs",
+				info.Duration, src.Duration))
+		}
+	}
+
+	video, hasVideo := info.Stream("video")
+	audio, hasAudio := info.Stream("audio")
+	// Streams the source had should make it through, unless
+	// they've been dropped or picked out with -map
+	if src != nil && !hasArg(args, "-map") {
+		if _, ok := src.Stream("video"); ok && !hasVideo && !hasArg(args, "-vn") {
+			failed = append(failed, "missing video stream")
+		}
+		if _, ok := src.Stream("audio"); ok && !hasAudio && !hasArg(args, "-an") {
+			failed = append(failed, "missing audio stream")
+		}
+	}
+
+	if opts.VideoCodec != "" && video.Codec != opts.VideoCodec {
+		failed = append(failed, fmt.Sprintf("video codec is \"%s\" not \"%s\"", video.Codec, opts.VideoCodec))
+	}
+	if opts.AudioCodec != "" && audio.Codec != opts.AudioCodec {
+		failed = append(failed, fmt.Sprintf("audio codec is \"%s\" not \"%s\"", audio.Codec, opts.AudioCodec))
+	}
+	if (opts.Width > 0 && video.Width != opts.Width) || (opts.Height > 0 && video.Height != opts.Height) {
+		failed = append(failed, fmt.Sprintf("resolution is %dx%d", video.Width, video.Height))
+	}
+
+	// Decoding the whole encode is slow, so only bother if it's passed so far
+	if len(failed) == 0 && ((opts.Black > 0 && hasVideo) || (opts.Silence > 0 && hasAudio)) {
+		found, err := detectBlankness(ctx, env.FFmpeg, output, opts, hasVideo, hasAudio)
+		if err != nil {
+			return err
+		}
+		failed = append(failed, found...)
+	}
+
+	if len(failed) > 0 {
+		return &Error{
+			Category: ErrorVerificationFailure,
+			Message:  "encode failed verification: " + strings.Join(failed, "; "),
+		}
+	}
+	return nil
+}
+
+// detectBlankness decodes an encode looking for silence and black frames
+// which last longer than allowed
+func detectBlankness(ctx context.Context, ffmpeg, output string, opts VerifyOptions, hasVideo, hasAudio bool) ([]string, error) {
+	args := []string{"-hide_banner", "-nostats", "-i", output}
+	if opts.Black > 0 && hasVideo {
+		args = append(args, "-vf", fmt.Sprintf("blackdetect=d=%g", opts.Black))
+	}
+	if opts.Silence > 0 && hasAudio {
+		args = append(args, "-af", fmt.Sprintf("silencedetect=d=%g", opts.Silence))
+	}
+	args = append(args, "-f", "null", "-")
+
+	out, err := exec.CommandContext(ctx, ffmpeg, args...).CombinedOutput()
+	if err != nil {
+		return nil, NewError(ErrorWorkerFailure, true, fmt.Errorf("failed to check for silence and black frames: %w", err))
+	}
+
+	found := []string{}
+	if m := blackPattern.FindStringSubmatch(string(out)); m != nil {
+		found = append(found, fmt.Sprintf("black frames from %ss to %ss", m[1], m[2]))
+	}
+	if m := silencePattern.FindStringSubmatch(string(out)); m != nil {
+		found = append(found, fmt.Sprintf("silence from %ss", m[1]))
+	}
+	return found, nil
+}
+
+// hasArg returns whether an ffmpeg option is in a command line
+func hasArg(args, arg string) bool {
+	for _, f := range strings.Fields(args) {
+		if f == arg {
+			return true
+		}
+	}
+	return false
+}
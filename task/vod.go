@@ -1,20 +1,15 @@
 package task
 
 import (
-	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"strings"
 	"time"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 const TypeVOD string = "video/vod"
@@ -24,27 +19,51 @@ var _ Task = &VOD{}
 // VOD task produces a video for the on demand platform
 type VOD struct {
 	TaskID  string // Task UUID
-	SrcURL  string `json:"srcURL"`  // Location of source file on CDN
+	SrcURL  string `json:"srcURL"`  // Location of source file, see Storage
 	DstArgs string `json:"dstArgs"` // Output file options
-	DstURL  string `json:"dstURL"`  // Destination of finished encode on CDN
-
-	APIEndpoint string
-
-	status Status
-	stats  *Stats
+	DstURL  string `json:"dstURL"`  // Destination of finished encode, see Storage
+	// Download the source to the worker before encoding rather than
+	// streaming it, sources are cached so other jobs can reuse them
+	Download bool `json:"download"`
+	// Worker capabilities the job needs, i.e. "encoder:libsvtav1"
+	Requires []string `json:"requires,omitempty"`
+	// Maximum seconds the job can run for, 0 uses the worker's limit
+	Timeout int `json:"timeout,omitempty"`
+	// Checks the encode has to pass before it's uploaded
+	Verify VerifyOptions `json:"verify"`
+	// Metrics to score the encode against the source with, see Quality
+	Quality []string `json:"quality,omitempty"`
+	// Encode a rendition for each rung of a ladder picked for the
+	// source rather than a single encode, see Ladder
+	Ladder *Ladder `json:"ladder,omitempty"`
+	// Encode in two passes, dstArgs has to set a video bitrate
+	TwoPass bool `json:"twoPass"`
+	// Have the manager split the source into segments encoded across
+	// workers, see Chunked. Workers never run chunked jobs themselves.
+	Chunked *Chunked `json:"chunked,omitempty"`
+	// Images and text drawn over the encode, and subtitles burnt into it
+	Overlays  []Overlay  `json:"overlays,omitempty"`
+	Subtitles *Subtitles `json:"subtitles,omitempty"`
+
+	status    Status
+	stats     *Stats
+	ffmpegLog *FFmpegLog
+	// Workspace kept with an unfinished upload when the task failed
+	kept *Workspace
 
 	// dependencies
-	cdn *s3.S3
+	env *Env
 }
 
+var _ resumer = &VOD{}
+
 // NewVOD initialises a VOD task object so we can
 // add the tasks dependencies
-func NewVOD(cdn *s3.S3, apiEndpoint string) VOD {
+func NewVOD(env *Env) VOD {
 	return VOD{
-		status:      Status{},
-		stats:       &Stats{},
-		cdn:         cdn,
-		APIEndpoint: apiEndpoint,
+		status: Status{},
+		stats:  &Stats{},
+		env:    env,
 	}
 }
 
@@ -53,7 +72,21 @@ func (t *VOD) GetID() string {
 	return t.TaskID
 }
 
+// GetType returns the task's type
+func (t *VOD) GetType() string {
+	return TypeVOD
+}
+
+// GetTimeout returns the job's maximum runtime
+func (t *VOD) GetTimeout() time.Duration {
+	return time.Duration(t.Timeout) * time.Second
+}
+
 func (t *VOD) GetStatus() Status {
+	t.status.TaskID = t.TaskID
+	if t.stats != nil {
+		t.status.Stats = *t.stats
+	}
 	return t.status
 }
 
@@ -66,147 +99,346 @@ func (t *VOD) ValidateRequest() error {
 	if t.DstURL == "" {
 		return fmt.Errorf("missing dstURL")
 	}
-	return nil
+	if err := validateStorageURL(t.SrcURL); err != nil {
+		return fmt.Errorf("invalid srcURL: %w", err)
+	}
+	if err := validateStorageURL(t.DstURL); err != nil {
+		return fmt.Errorf("invalid dstURL: %w", err)
+	}
+	if err := t.Verify.Validate(); err != nil {
+		return err
+	}
+	if err := validateMetrics(t.Quality); err != nil {
+		return err
+	}
+	t.Requires = qualityRequirements(t.Quality, t.Requires)
+	if err := validateOverlays(t.Overlays, t.Subtitles, t.DstArgs); err != nil {
+		return err
+	}
+	t.Requires = overlayRequirements(t.Overlays, t.Subtitles, t.Requires)
+	hasOverlays := len(t.Overlays) > 0 || t.Subtitles != nil
+	if t.TwoPass && !hasVideoBitrate(t.DstArgs) {
+		return fmt.Errorf("twoPass needs a video bitrate in dstArgs, i.e. -b:v 5M")
+	}
+	if t.Chunked != nil {
+		if t.Ladder != nil || t.TwoPass || len(t.Quality) > 0 || hasOverlays {
+			return fmt.Errorf("chunked can't be used with ladder, twoPass, quality, overlays or subtitles")
+		}
+		if err := t.Chunked.Validate(); err != nil {
+			return err
+		}
+	}
+	if t.Ladder != nil {
+		if t.TwoPass {
+			return fmt.Errorf("twoPass can't be used with a ladder")
+		}
+		if hasOverlays {
+			return fmt.Errorf("overlays and subtitles can't be used with a ladder")
+		}
+		if len(t.Quality) > 0 {
+			return fmt.Errorf("quality can't be used with a ladder, its rungs are scored")
+		}
+		if err := t.Ladder.Validate(); err != nil {
+			return err
+		}
+		t.Requires = t.Ladder.requirements(t.Requires)
+	}
+	return ValidateRequirements(t.Requires)
 }
 
 // Start makes a video for VOD
 //
 // General outline
-// Creates a temp file
-// Creates a new S3 session
-// Download video object from S3 and put it in temp file
-// Execute ffmpeg arguements on downloaded file
+// Resolves the source and destination storage backends
+// Creates a workspace for the encode
+// Gets a URL ffmpeg can stream the source from, or downloads it
+// Checks there's space for the encode
+// Execute ffmpeg arguements on the source
+// Verify the encode
+// Score its quality if asked to
 // Upload result file
-func (t *VOD) Start(ctx context.Context) error {
+func (t *VOD) Start(ctx context.Context) (err error) {
 	t.status.Stage = StageStarted
 	t.status.StageStart = time.Now()
+	if t.Chunked != nil {
+		return NewError(ErrorInvalidArgs, false, fmt.Errorf("chunked jobs are split by the manager"))
+	}
 
-	// Change slashes with dashes making it easier to handle in the FS
-	srcPath := strings.Split(t.SrcURL, "/")
-	dstPath := strings.Split(t.DstURL, "/")
-	dstFilename := strings.Join(dstPath[1:], "-")
-
-	url, err := t.presignFileURL(&srcPath[0], aws.String(strings.Join(srcPath[1:], "/")))
+	srcStore, src, err := t.env.Store.Resolve(t.SrcURL)
 	if err != nil {
-		return fmt.Errorf("failed to sign source download: %w", err)
+		return NewError(ErrorInvalidArgs, false, fmt.Errorf("failed to resolve source: %w", err))
 	}
-
-	// Video encoding
-	log.Printf("encoding video: %s", t.GetID())
-	startEnc := time.Now()
-	t.status.Stage = StageTranscoding
-	t.status.StageStart = startEnc
-
-	// TODO More Status Updates Below This Point
-
-	// We're not using the -progress flag since it doesn't give us the duration
-	// of the video which is important to determine the ETA. so we'll just parsing
-	// the normal stdout.
-	cmdString := fmt.Sprintf("%s \"%s\" %s \"%s\" %s",
-		"ffmpeg -y -i", url, t.DstArgs, dstFilename, "2>&1")
-
-	cmd := exec.Command("sh", "-c",
-		cmdString)
-
-	stdout, err := cmd.StdoutPipe()
+	dstStore, dst, err := t.env.Store.Resolve(t.DstURL)
 	if err != nil {
-		return fmt.Errorf("pipe failed: %w", err)
+		return NewError(ErrorInvalidArgs, false, fmt.Errorf("failed to resolve destination: %w", err))
 	}
 
-	log.Printf("%+v", t)
-	log.Println(cmdString)
+	ws, err := t.env.Workspaces.Create(t.TaskID)
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	// Change slashes with dashes making it easier to handle in the FS
+	dstFilename := ws.Path(strings.ReplaceAll(strings.Trim(dst.Path, "/"), "/", "-"))
+	defer func() {
+		if err != nil && hasUploadState(dstFilename) {
+			// Keep the encode so a redelivery can resume uploading it
+			ws.Release()
+			t.kept = ws
+			return
+		}
+		ws.Remove()
+	}()
 
-	// begin encoding
-	err = cmd.Start()
+	t.ffmpegLog, err = newFFmpegLog(ws.Path("ffmpeg.log"))
 	if err != nil {
-		return fmt.Errorf("failed to start ffmpeg: %w", err)
+		return NewError(ErrorWorkerFailure, true, err)
 	}
+	// Runs before the workspace is cleaned up
+	defer finishLog(ctx, t.ffmpegLog, dstStore, withSuffix(dst, ".log"), &t.status)
+
+	var scores QualityScores
+	scoresFile := ""
+	if hasUploadState(dstFilename) {
+		// We were interrupted while uploading this encode before,
+		// so skip straight to carrying on with the upload
+		log.Printf("resuming upload of previous encode: %s", dstFilename)
+		if len(t.Quality) > 0 {
+			scores, scoresFile, err = loadScores(ws)
+			if err != nil {
+				return NewError(ErrorWorkerFailure, true, err)
+			}
+		}
+	} else {
+		// Downloaded when it can't be streamed, or its URL can't be
+		// put on ffmpeg's command line safely
+		input, release, err := openSource(ctx, t.env, t.SrcURL, t.Download, &t.status)
+		if err != nil {
+			return err
+		}
+		defer release()
+		// openSource only moves on to downloading when it fetches the source
+		streamed := t.status.Stage != StageDownloading
+
+		// Checks are skipped when the source can't be probed
+		var srcInfo *ProbeInfo
+		if info, perr := probe(ctx, t.env.FFprobe, input); perr == nil {
+			srcInfo = &info
+		} else {
+			log.Printf("skipping checks against source: %+v", perr)
+		}
 
-	scanner := bufio.NewScanner(stdout)
-	curLine := ""
-	buf := ""
+		if t.Ladder != nil {
+			t.status.Result, err = t.encodeLadder(ctx, ws, input, srcInfo, dstStore, dst)
+			return err
+		}
 
-	for scanner.Scan() {
-		curLine = scanner.Text()
-		buf += curLine
-		ok := getStats(t.stats, buf)
-		if ok {
-			buf = ""
-			log.Printf("%+v", t.stats)
+		if srcInfo != nil {
+			err = ws.Reserve(estimateOutputSize(t.DstArgs, *srcInfo))
+			if err != nil {
+				return fmt.Errorf("failed to reserve disk space: %w", err)
+			}
 		}
-	}
 
-	err = cmd.Wait()
-	if err != nil {
-		return fmt.Errorf("exec failed to wait: %+v: %s", err, curLine)
+		err = t.transcode(ctx, ws, input, dstFilename)
+		if err != nil {
+			return err
+		}
+
+		err = t.verify(ctx, dstFilename, srcInfo)
+		if err != nil {
+			return err
+		}
+
+		if len(t.Quality) > 0 {
+			t.status.Stage = StageScoring
+			t.status.StageStart = time.Now()
+			scores, scoresFile, err = scoreQuality(ctx, t, t.env, t.stats, t.ffmpegLog, dstFilename, input, ws, t.Quality)
+			if err != nil {
+				return err
+			}
+			err = saveScores(ws, scores)
+			if err != nil {
+				return NewError(ErrorWorkerFailure, true, err)
+			}
+		}
+
+		// When ffmpeg streams the source we count the whole
+		// object as downloaded once it's been encoded
+		if streamed {
+			if info, err := srcStore.Stat(ctx, src); err == nil {
+				bytesDownloaded.Add(float64(info.Size))
+			}
+		}
 	}
 
-	log.Printf("finished encoding - completed in %s", time.Since(startEnc))
 	startUp := time.Now()
 	t.status.Stage = StageUploading
 	t.status.StageStart = startUp
 
 	// Uploading encoded file
-	_, err = t.uploadFile(dstFilename, dstPath)
+	out, err := t.uploadFile(ctx, dstFilename, dstStore, dst)
 	if err != nil {
-		return fmt.Errorf("failed to upload file: %w", err)
+		return NewError(ErrorUploadFailure, true, fmt.Errorf("failed to upload file: %w", err))
+	}
+	result := &Result{Outputs: []Output{out}, Quality: scores}
+	if scoresFile != "" {
+		out, err = uploadOutput(ctx, dstStore, withSuffix(dst, ".quality.json"), scoresFile)
+		if err != nil {
+			return err
+		}
+		result.Outputs = append(result.Outputs, out)
 	}
+	t.status.Result = result
 
 	log.Printf("finished uploading - completed in %s", time.Since(startUp))
 
 	return nil
 }
 
-func (t *VOD) presignFileURL(bucket, key *string) (string, error) {
-	req, _ := t.cdn.GetObjectRequest(&s3.GetObjectInput{
-		Bucket: bucket,
-		Key:    key,
-	})
-	return req.Presign(6 * time.Hour) // TODO: Look into time
+// Resumable reports whether the task kept its encode when it failed,
+// so a redelivery can carry on uploading it
+func (t *VOD) Resumable() bool {
+	return t.kept != nil
+}
+
+// Discard removes the kept encode once the job won't be redelivered
+func (t *VOD) Discard() {
+	if t.kept != nil {
+		t.kept.Remove()
+		t.kept = nil
+	}
 }
 
-func (t *VOD) uploadFile(src string, dst []string) (string, error) {
-	file, err := os.Open(src)
+// saveScores keeps the encode's quality scores alongside its upload
+// state, so resuming the upload doesn't lose them
+func saveScores(ws *Workspace, scores QualityScores) error {
+	b, err := json.Marshal(scores)
 	if err != nil {
-		err = fmt.Errorf("failed to open encoded file: %w", err)
-		return "", err
+		return fmt.Errorf("failed to marshal scores: %w", err)
 	}
-	defer file.Close()
-	sess, err := session.NewSession(&t.cdn.Config)
+	err = os.WriteFile(ws.Path("scores.json"), b, 0644)
 	if err != nil {
-		return "", fmt.Errorf("failed to create new cdn session: %w", err)
+		return fmt.Errorf("failed to save scores: %w", err)
 	}
-	uploader := s3manager.NewUploader(sess)
-	upload, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(dst[0]),
-		Key:    aws.String(strings.Join(dst[1:], "/")),
-		Body:   file,
-	})
+	return nil
+}
+
+// loadScores reads the scores saved by an earlier attempt, and
+// the path of the frame scores to upload with them
+func loadScores(ws *Workspace) (QualityScores, string, error) {
+	b, err := os.ReadFile(ws.Path("scores.json"))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read saved scores: %w", err)
+	}
+	scores := QualityScores{}
+	err = json.Unmarshal(b, &scores)
 	if err != nil {
-		err = fmt.Errorf("failed to upload encoded file: %w", err)
-		return "", err
+		return nil, "", fmt.Errorf("failed to unmarshal saved scores: %w", err)
+	}
+	return scores, ws.Path("quality.json"), nil
+}
+
+// verify checks the encode is what was expected
+func (t *VOD) verify(ctx context.Context, output string, src *ProbeInfo) error {
+	log.Printf("verifying encode: %s", t.GetID())
+	startVer := time.Now()
+	t.status.Stage = StageVerifying
+	t.status.StageStart = startVer
+
+	err := verifyOutput(ctx, t.env, output, src, t.DstArgs, t.Verify)
+	if err != nil {
+		return err
+	}
+	log.Printf("finished verifying - completed in %s", time.Since(startVer))
+	return nil
+}
+
+// transcode runs ffmpeg on the input, writing the output to a local file
+func (t *VOD) transcode(ctx context.Context, ws *Workspace, input, output string) error {
+	overlays, release, err := overlayArgs(ctx, t.env, ws, t.Overlays, t.Subtitles, t.Download, &t.status)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Video encoding
+	log.Printf("encoding video: %s", t.GetID())
+	startEnc := time.Now()
+	t.status.Stage = StageTranscoding
+	t.status.StageStart = startEnc
+
+	args := strings.TrimSpace(overlays + " " + t.DstArgs)
+	if t.TwoPass {
+		// The first pass only analyses the video, for the
+		// second to spend the bitrate where it's needed
+		passlog := ws.Path("passlog")
+		cmdString := fmt.Sprintf("\"%s\" -y -i \"%s\" %s -pass 1 -passlogfile \"%s\" -an -f null %s 2>&1",
+			t.env.FFmpeg, input, args, passlog, os.DevNull)
+		err := runFFmpeg(ctx, t, t.env, cmdString, t.stats, t.ffmpegLog)
+		if err != nil {
+			return fmt.Errorf("failed first pass: %w", err)
+		}
+		args = fmt.Sprintf("%s -pass 2 -passlogfile \"%s\"", args, passlog)
+	}
+
+	// We're not using the -progress flag since it doesn't give us the duration
+	// of the video which is important to determine the ETA. so we'll just parsing
+	// the normal stdout.
+	cmdString := fmt.Sprintf("\"%s\" -y -i \"%s\" %s \"%s\" %s",
+		t.env.FFmpeg, input, args, output, "2>&1")
+
+	log.Printf("%+v", t)
+
+	err = runFFmpeg(ctx, t, t.env, cmdString, t.stats, t.ffmpegLog)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("finished encoding - completed in %s", time.Since(startEnc))
+	return nil
+}
+
+// LogTail returns the end of ffmpeg's output
+func (t *VOD) LogTail() []string {
+	return t.ffmpegLog.Tail(logTailLines)
+}
+
+// uploadFile uploads the encoded file, retrying if it's interrupted.
+// Returns where it was uploaded to alongside its size and checksums.
+func (t *VOD) uploadFile(ctx context.Context, src string, b Backend, dst *url.URL) (Output, error) {
+	out, err := uploadOutput(ctx, b, dst, src)
+	if err != nil {
+		return Output{}, err
 	}
-	file.Close()
 
 	// Deleting local encoded file
 	err = os.Remove(src)
 	if err != nil {
 		err = fmt.Errorf("failed to delete source file: %w", err)
-		return "", err
+		return Output{}, err
+	}
+
+	err = notifyFinished(t.env, t.TaskID)
+	if err != nil {
+		return Output{}, err
 	}
+	log.Println("uploaded video!")
+
+	return out, nil
+}
 
+// notifyFinished tells web-api a job's encode has been uploaded
+func notifyFinished(env *Env, jobID string) error {
 	c := http.Client{}
 
-	res, err := c.Post(os.Getenv("VT_WAPI_ENDPOINT")+"/v1/internal/encoder/transcode_finished/"+t.TaskID, "", nil)
+	res, err := c.Post(env.APIEndpoint+"/v1/internal/encoder/transcode_finished/"+jobID, "", nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to post to vt: %w", err)
+		return fmt.Errorf("failed to post to vt: %w", err)
 	}
 
 	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to send complete status to web-api")
+		return fmt.Errorf("failed to send complete status to web-api")
 	}
-	log.Println("uploaded video!")
-
-	return upload.Location, nil
+	return nil
 }
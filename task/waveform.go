@@ -0,0 +1,312 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ystv/video-transcode/waveform"
+)
+
+const TypeWaveform string = "audio/waveform"
+
+// Defaults for waveforms which leave them out, the same as audiowaveform's
+const (
+	defaultSamplesPerPixel = 256
+	defaultWaveformBits    = 16
+	defaultWaveformWidth   = 800
+	defaultWaveformHeight  = 250
+	defaultWaveformColor   = "#989898"
+	defaultWaveformBg      = "#00000000" // Transparent
+	// Used when the source's sample rate isn't known
+	defaultWaveformRate = 48000
+)
+
+// waveformFormats are the peak data formats
+var waveformFormats = map[string]bool{"json": true, "dat": true}
+
+var _ Task = &Waveform{}
+
+type (
+	// WaveformImage is a PNG of the whole waveform
+	WaveformImage struct {
+		Width  int `json:"width,omitempty"`
+		Height int `json:"height,omitempty"`
+		// "#rrggbb" or "#rrggbbaa"
+		Color      string `json:"color,omitempty"`
+		Background string `json:"background,omitempty"`
+	}
+	// Waveform task decodes a source's audio into the peak data
+	// waveform displays are drawn from, i.e. for scrubbing in an editor
+	Waveform struct {
+		TaskID string `json:"taskID"`
+		SrcURL string `json:"srcURL"`
+		// The outputs are named after it with their format's extension,
+		// defaults to alongside the source
+		DstURL string `json:"dstURL,omitempty"`
+		// Index of the source's audio track, from 0
+		Track int `json:"track,omitempty"`
+		// Samples each pixel of peaks covers, defaults to 256
+		SamplesPerPixel int `json:"samplesPerPixel,omitempty"`
+		// 8 or 16, defaults to 16
+		Bits int `json:"bits,omitempty"`
+		// "json" and "dat", the formats of audiowaveform
+		Formats  []string       `json:"formats,omitempty"`
+		Image    *WaveformImage `json:"image,omitempty"`
+		Download bool           `json:"download"`
+		// Worker capabilities the job needs
+		Requires []string `json:"requires,omitempty"`
+		// Maximum seconds the job can run for, 0 uses the worker's limit
+		Timeout int `json:"timeout,omitempty"`
+
+		status    Status
+		stats     *Stats
+		ffmpegLog *FFmpegLog
+
+		// dependencies
+		env *Env
+	}
+)
+
+// Validate checks the image makes sense, filling in its defaults
+func (i *WaveformImage) Validate() error {
+	if i.Width == 0 {
+		i.Width = defaultWaveformWidth
+	}
+	if i.Height == 0 {
+		i.Height = defaultWaveformHeight
+	}
+	if i.Color == "" {
+		i.Color = defaultWaveformColor
+	}
+	if i.Background == "" {
+		i.Background = defaultWaveformBg
+	}
+	if i.Width < 1 || i.Height < 1 || i.Width > 10000 || i.Height > 10000 {
+		return fmt.Errorf("image width and height have to be between 1 and 10000")
+	}
+	if _, err := waveform.ParseColor(i.Color); err != nil {
+		return fmt.Errorf("image color: %w", err)
+	}
+	if _, err := waveform.ParseColor(i.Background); err != nil {
+		return fmt.Errorf("image background: %w", err)
+	}
+	return nil
+}
+
+// NewWaveform initialises a Waveform task object so we can
+// add the tasks dependencies
+func NewWaveform(env *Env) Waveform {
+	return Waveform{
+		stats: &Stats{},
+		env:   env,
+	}
+}
+
+// GetID returns a task ID
+func (t *Waveform) GetID() string {
+	return t.TaskID
+}
+
+// GetType returns the task's type
+func (t *Waveform) GetType() string {
+	return TypeWaveform
+}
+
+// GetTimeout returns the job's maximum runtime
+func (t *Waveform) GetTimeout() time.Duration {
+	return time.Duration(t.Timeout) * time.Second
+}
+
+// GetStatus returns the task's status
+func (t *Waveform) GetStatus() Status {
+	t.status.TaskID = t.TaskID
+	if t.stats != nil {
+		t.status.Stats = *t.stats
+	}
+	return t.status
+}
+
+// ValidateRequest checks the request
+func (t *Waveform) ValidateRequest() error {
+	if t.SrcURL == "" {
+		return fmt.Errorf("missing srcURL")
+	}
+	if err := validateStorageURL(t.SrcURL); err != nil {
+		return fmt.Errorf("invalid srcURL: %w", err)
+	}
+	if t.DstURL != "" {
+		if err := validateStorageURL(t.DstURL); err != nil {
+			return fmt.Errorf("invalid dstURL: %w", err)
+		}
+	}
+	if t.SamplesPerPixel == 0 {
+		t.SamplesPerPixel = defaultSamplesPerPixel
+	}
+	if t.Bits == 0 {
+		t.Bits = defaultWaveformBits
+	}
+	if len(t.Formats) == 0 && t.Image == nil {
+		t.Formats = []string{"json"}
+	}
+	if t.Track < 0 || t.SamplesPerPixel < 1 {
+		return fmt.Errorf("track can't be negative and samplesPerPixel has to be at least 1")
+	}
+	if t.Bits != 8 && t.Bits != 16 {
+		return fmt.Errorf("bits has to be 8 or 16")
+	}
+	for _, f := range t.Formats {
+		if !waveformFormats[f] {
+			return fmt.Errorf("unknown format \"%s\", it has to be \"json\" or \"dat\"", f)
+		}
+	}
+	if t.Image != nil {
+		if err := t.Image.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := ValidateRequirements(t.Requires); err != nil {
+		return err
+	}
+	t.TaskID = uuid.NewString()
+	return nil
+}
+
+// Start decodes the source's audio, finds its peaks and
+// uploads them in each format
+func (t *Waveform) Start(ctx context.Context) error {
+	t.status.Stage = StageStarted
+	t.status.StageStart = time.Now()
+
+	dstURL := t.DstURL
+	if dstURL == "" {
+		dstURL = t.SrcURL
+	}
+	b, dst, err := t.env.Store.Resolve(dstURL)
+	if err != nil {
+		return NewError(ErrorInvalidArgs, false, fmt.Errorf("failed to resolve destination: %w", err))
+	}
+	ws, err := t.env.Workspaces.Create(t.TaskID)
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer ws.Remove()
+	t.ffmpegLog, err = newFFmpegLog(ws.Path("ffmpeg.log"))
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	defer finishLog(ctx, t.ffmpegLog, b, withSuffix(dst, ".log"), &t.status)
+
+	input, release, err := openSource(ctx, t.env, t.SrcURL, t.Download, &t.status)
+	if err != nil {
+		return err
+	}
+	defer release()
+	srcInfo, err := probe(ctx, t.env.FFprobe, input)
+	if err != nil {
+		return inputError(err)
+	}
+	audio, ok := srcInfo.NthStream("audio", t.Track)
+	if !ok {
+		return NewError(ErrorInvalidArgs, false, fmt.Errorf("source doesn't have audio track %d", t.Track))
+	}
+	rate := audio.SampleRate
+	if rate == 0 {
+		rate = defaultWaveformRate
+	}
+
+	// Decoded to mono 16-bit samples, which take up 2 bytes each
+	err = ws.Reserve(int64(srcInfo.Duration*float64(rate)) * 2)
+	if err != nil {
+		return NewError(ErrorWorkerFailure, true, err)
+	}
+	log.Printf("decoding audio for waveform: %s", t.GetID())
+	startDec := time.Now()
+	t.status.Stage = StageAnalysing
+	t.status.StageStart = startDec
+	samples := ws.Path("samples.raw")
+	cmdString := fmt.Sprintf("\"%s\" -y -i \"%s\" -map 0:a:%d -ac 1 -ar %d -c:a pcm_s16le -f s16le \"%s\" 2>&1",
+		t.env.FFmpeg, input, t.Track, rate, samples)
+	err = runFFmpeg(ctx, t, t.env, cmdString, t.stats, t.ffmpegLog)
+	if err != nil {
+		return err
+	}
+	data, err := t.computePeaks(samples, rate)
+	if err != nil {
+		return err
+	}
+	log.Printf("finished waveform - completed in %s", time.Since(startDec))
+
+	t.status.Stage = StageUploading
+	t.status.StageStart = time.Now()
+	t.status.Result = &Result{}
+	for _, format := range t.Formats {
+		out, err := t.writeOutput(ctx, b, dst, ws, format, func(f *os.File) error {
+			if format == "dat" {
+				return data.WriteBinary(f)
+			}
+			return data.WriteJSON(f)
+		})
+		if err != nil {
+			return err
+		}
+		t.status.Result.Outputs = append(t.status.Result.Outputs, out)
+	}
+	if t.Image != nil {
+		fg, _ := waveform.ParseColor(t.Image.Color)
+		bg, _ := waveform.ParseColor(t.Image.Background)
+		out, err := t.writeOutput(ctx, b, dst, ws, "png", func(f *os.File) error {
+			return data.WritePNG(f, t.Image.Width, t.Image.Height, fg, bg)
+		})
+		if err != nil {
+			return err
+		}
+		t.status.Result.Outputs = append(t.status.Result.Outputs, out)
+	}
+	return nil
+}
+
+// LogTail returns the end of ffmpeg's output
+func (t *Waveform) LogTail() []string {
+	return t.ffmpegLog.Tail(logTailLines)
+}
+
+// computePeaks reads the decoded samples
+func (t *Waveform) computePeaks(samples string, rate int) (*waveform.Data, error) {
+	f, err := os.Open(samples)
+	if err != nil {
+		return nil, NewError(ErrorWorkerFailure, true, fmt.Errorf("failed to open samples: %w", err))
+	}
+	defer f.Close()
+	data, err := waveform.Compute(f, rate, t.SamplesPerPixel, t.Bits)
+	if err != nil {
+		return nil, NewError(ErrorWorkerFailure, true, err)
+	}
+	return data, nil
+}
+
+// writeOutput writes a file with write then uploads it, named
+// after dst with the extension swapped for ext
+func (t *Waveform) writeOutput(ctx context.Context, b Backend, dst *url.URL, ws *Workspace, ext string,
+	write func(*os.File) error) (Output, error) {
+	output := ws.Path("waveform." + ext)
+	f, err := os.Create(output)
+	if err != nil {
+		return Output{}, NewError(ErrorWorkerFailure, true, fmt.Errorf("failed to create %s: %w", ext, err))
+	}
+	err = write(f)
+	f.Close()
+	if err != nil {
+		return Output{}, NewError(ErrorWorkerFailure, true, fmt.Errorf("failed to write %s: %w", ext, err))
+	}
+
+	u := *dst
+	u.Path = strings.TrimSuffix(u.Path, path.Ext(u.Path)) + "." + ext
+	return uploadOutput(ctx, b, &u, output)
+}
@@ -0,0 +1,151 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// workspaceRetention is how long a workspace holding an unfinished
+// upload is kept for, giving the job a chance to be redelivered
+const workspaceRetention = 24 * time.Hour
+
+// ErrInsufficientSpace is returned when there isn't enough free
+// disk space for a task
+var ErrInsufficientSpace = errors.New("insufficient disk space")
+
+type (
+	// Workspaces hands out a scratch directory to each task under a
+	// root, keeping track of the disk space they expect to use
+	Workspaces struct {
+		mu       sync.Mutex
+		root     string
+		minFree  int64 // Bytes to always leave free
+		reserved map[string]int64
+	}
+	// Workspace is a task's scratch directory
+	Workspace struct {
+		Dir string
+
+		taskID string
+		ws     *Workspaces
+	}
+)
+
+// NewWorkspaces creates the workspace root, removing any workspaces
+// left behind by tasks which didn't get to clean up after themselves
+func NewWorkspaces(root string, minFree int64) (*Workspaces, error) {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workspace root: %w", err)
+	}
+	ws := &Workspaces{
+		root:     root,
+		minFree:  minFree,
+		reserved: make(map[string]int64),
+	}
+	ws.removeOrphans()
+	return ws, nil
+}
+
+// removeOrphans removes workspaces under the root, apart from recent
+// ones with an unfinished upload which can be resumed
+func (ws *Workspaces) removeOrphans() {
+	dirs, err := ioutil.ReadDir(ws.root)
+	if err != nil {
+		log.Printf("failed to list workspaces: %+v", err)
+		return
+	}
+	for _, d := range dirs {
+		path := filepath.Join(ws.root, d.Name())
+		if d.IsDir() && time.Since(d.ModTime()) < workspaceRetention {
+			uploads, _ := filepath.Glob(filepath.Join(path, "*.upload.json"))
+			if len(uploads) > 0 {
+				log.Printf("keeping workspace with unfinished upload: %s", d.Name())
+				continue
+			}
+		}
+		log.Printf("removing orphaned workspace: %s", d.Name())
+		err = os.RemoveAll(path)
+		if err != nil {
+			log.Printf("failed to remove workspace %s: %+v", d.Name(), err)
+		}
+	}
+}
+
+// Create makes the workspace for a task, one left by an earlier
+// attempt at the same task is reused
+func (ws *Workspaces) Create(taskID string) (*Workspace, error) {
+	if taskID == "" || filepath.Base(taskID) != taskID {
+		return nil, fmt.Errorf("invalid task id for workspace \"%s\"", taskID)
+	}
+	dir := filepath.Join(ws.root, taskID)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workspace: %w", err)
+	}
+	// Bump the modified time so it isn't mistaken for an old workspace
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+	return &Workspace{Dir: dir, taskID: taskID, ws: ws}, nil
+}
+
+// Path returns the path of a file in the workspace
+func (w *Workspace) Path(name string) string {
+	return filepath.Join(w.Dir, name)
+}
+
+// Reserve checks there is enough free space for the task to write size
+// bytes, taking into account what other tasks have reserved
+func (w *Workspace) Reserve(size int64) error {
+	ws := w.ws
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	free, err := freeSpace(ws.root)
+	if err != nil {
+		return fmt.Errorf("failed to get free disk space: %w", err)
+	}
+	if free < 0 {
+		// Can't tell on this platform
+		ws.reserved[w.taskID] = size
+		return nil
+	}
+	others := int64(0)
+	for id, r := range ws.reserved {
+		if id != w.taskID {
+			others += r
+		}
+	}
+	available := free - others - ws.minFree
+	if size > available {
+		return fmt.Errorf("%w: need %d bytes, %d available", ErrInsufficientSpace, size, available)
+	}
+	ws.reserved[w.taskID] = size
+	return nil
+}
+
+// Remove deletes the workspace and releases its reservation
+func (w *Workspace) Remove() {
+	w.ws.mu.Lock()
+	delete(w.ws.reserved, w.taskID)
+	w.ws.mu.Unlock()
+
+	err := os.RemoveAll(w.Dir)
+	if err != nil {
+		log.Printf("failed to remove workspace %s: %+v", w.taskID, err)
+	}
+}
+
+// Release keeps the workspace on disk for a later attempt,
+// but releases its reservation
+func (w *Workspace) Release() {
+	w.ws.mu.Lock()
+	delete(w.ws.reserved, w.taskID)
+	w.ws.mu.Unlock()
+}
@@ -0,0 +1,202 @@
+// Package waveform generates the peak data waveform displays are
+// drawn from, in the formats of BBC's audiowaveform
+package waveform
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+// version of the audiowaveform formats written
+const version = 2
+
+// colorPattern matches colours as hex, with an optional alpha
+var colorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{6}|[0-9a-fA-F]{8})$`)
+
+// Data is the minimum and maximum of each pixel's
+// worth of samples of mono audio
+type Data struct {
+	SampleRate      int
+	SamplesPerPixel int
+	Bits            int     // 8 or 16
+	Peaks           []int16 // Minimum then maximum of each pixel
+}
+
+// jsonData is the JSON format's layout
+type jsonData struct {
+	Version         int     `json:"version"`
+	Channels        int     `json:"channels"`
+	SampleRate      int     `json:"sample_rate"`
+	SamplesPerPixel int     `json:"samples_per_pixel"`
+	Bits            int     `json:"bits"`
+	Length          int     `json:"length"`
+	Data            []int16 `json:"data"`
+}
+
+// Compute reads signed 16-bit little endian mono samples, finding the
+// peaks of each samplesPerPixel of them. 8-bit peaks are scaled down
+// from the 16-bit samples. An odd byte at the end is ignored.
+func Compute(r io.Reader, sampleRate, samplesPerPixel, bits int) (*Data, error) {
+	if samplesPerPixel < 1 {
+		return nil, fmt.Errorf("samples per pixel has to be at least 1")
+	}
+	if bits != 8 && bits != 16 {
+		return nil, fmt.Errorf("bits has to be 8 or 16")
+	}
+	d := &Data{
+		SampleRate:      sampleRate,
+		SamplesPerPixel: samplesPerPixel,
+		Bits:            bits,
+	}
+	br := bufio.NewReader(r)
+	sample := make([]byte, 2)
+	count := 0
+	var lo, hi int16
+	for {
+		_, err := io.ReadFull(br, sample)
+		// A trailing half sample, i.e. from a cut off stream, is dropped
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read samples: %w", err)
+		}
+		s := int16(binary.LittleEndian.Uint16(sample))
+		if count == 0 || s < lo {
+			lo = s
+		}
+		if count == 0 || s > hi {
+			hi = s
+		}
+		count++
+		if count == samplesPerPixel {
+			d.add(lo, hi)
+			count = 0
+		}
+	}
+	if count > 0 {
+		d.add(lo, hi)
+	}
+	return d, nil
+}
+
+// add adds a pixel's peaks at the data's bit depth
+func (d *Data) add(lo, hi int16) {
+	if d.Bits == 8 {
+		lo, hi = lo>>8, hi>>8
+	}
+	d.Peaks = append(d.Peaks, lo, hi)
+}
+
+// Length returns how many pixels there are
+func (d *Data) Length() int {
+	return len(d.Peaks) / 2
+}
+
+// WriteJSON writes the data in audiowaveform's JSON format
+func (d *Data) WriteJSON(w io.Writer) error {
+	peaks := d.Peaks
+	if peaks == nil {
+		peaks = []int16{}
+	}
+	return json.NewEncoder(w).Encode(jsonData{
+		Version:         version,
+		Channels:        1,
+		SampleRate:      d.SampleRate,
+		SamplesPerPixel: d.SamplesPerPixel,
+		Bits:            d.Bits,
+		Length:          d.Length(),
+		Data:            peaks,
+	})
+}
+
+// WriteBinary writes the data in audiowaveform's binary .dat format
+func (d *Data) WriteBinary(w io.Writer) error {
+	flags := uint32(0)
+	if d.Bits == 8 {
+		flags = 1
+	}
+	b := bufio.NewWriter(w)
+	header := []interface{}{
+		int32(version), flags, int32(d.SampleRate), int32(d.SamplesPerPixel),
+		uint32(d.Length()), int32(1),
+	}
+	for _, v := range header {
+		if err := binary.Write(b, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	for _, p := range d.Peaks {
+		var err error
+		if d.Bits == 8 {
+			err = b.WriteByte(byte(int8(p)))
+		} else {
+			err = binary.Write(b, binary.LittleEndian, p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return b.Flush()
+}
+
+// WritePNG draws the whole waveform as a width x height PNG, each
+// column covering as many pixels of the data as it needs to
+func (d *Data) WritePNG(w io.Writer, width, height int, fg, bg color.Color) error {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, bg)
+		}
+	}
+
+	full := 32768.0
+	if d.Bits == 8 {
+		full = 128
+	}
+	length := d.Length()
+	for x := 0; x < width && length > 0; x++ {
+		from := x * length / width
+		to := (x + 1) * length / width
+		if to <= from {
+			to = from + 1
+		}
+		lo, hi := d.Peaks[2*from], d.Peaks[2*from+1]
+		for i := from + 1; i < to; i++ {
+			if d.Peaks[2*i] < lo {
+				lo = d.Peaks[2*i]
+			}
+			if d.Peaks[2*i+1] > hi {
+				hi = d.Peaks[2*i+1]
+			}
+		}
+		// Positive is up, with silence along the middle
+		top := int((1 - float64(hi)/full) * float64(height-1) / 2)
+		bottom := int((1 - float64(lo)/full) * float64(height-1) / 2)
+		for y := top; y <= bottom && y < height; y++ {
+			img.Set(x, y, fg)
+		}
+	}
+	return png.Encode(w, img)
+}
+
+// ParseColor reads a colour written as "#rrggbb" or "#rrggbbaa"
+func ParseColor(s string) (color.NRGBA, error) {
+	if !colorPattern.MatchString(s) {
+		return color.NRGBA{}, fmt.Errorf("invalid colour \"%s\", it has to be #rrggbb or #rrggbbaa", s)
+	}
+	v, _ := strconv.ParseUint(s[1:], 16, 32)
+	if len(s) == 7 {
+		v = v<<8 | 0xff
+	}
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
@@ -0,0 +1,113 @@
+package waveform
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"image/color"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// update rewrites the golden files with what's written now
+var update = flag.Bool("update", false, "update the golden files")
+
+// testSamples are 10 samples, so with 4 a pixel the last pixel is short
+var testSamples = []int16{0, 1000, -1000, 32767, -32768, 256, -256, 255, -1, 12345}
+
+func samples(s []int16) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, s)
+	return buf.Bytes()
+}
+
+func TestCompute(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		bits  int
+		want  []int16
+	}{
+		{"16-bit", samples(testSamples), 16, []int16{-1000, 32767, -32768, 256, -1, 12345}},
+		// Scaled down by shifting, so -1 stays -1 and 255 becomes 0
+		{"8-bit", samples(testSamples), 8, []int16{-4, 127, -128, 1, -1, 48}},
+		{"odd trailing byte", append(samples(testSamples), 0x7f), 16, []int16{-1000, 32767, -32768, 256, -1, 12345}},
+		{"single byte", []byte{0x7f}, 16, nil},
+		{"empty", nil, 16, nil},
+	}
+	for _, tt := range tests {
+		d, err := Compute(bytes.NewReader(tt.input), 48000, 4, tt.bits)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(d.Peaks, tt.want) {
+			t.Errorf("%s: peaks = %v, want %v", tt.name, d.Peaks, tt.want)
+		}
+	}
+
+	if _, err := Compute(bytes.NewReader(nil), 48000, 0, 16); err == nil {
+		t.Error("Compute with 0 samples per pixel succeeded")
+	}
+	if _, err := Compute(bytes.NewReader(nil), 48000, 4, 12); err == nil {
+		t.Error("Compute with 12 bits succeeded")
+	}
+}
+
+func TestGolden(t *testing.T) {
+	for _, bits := range []int{8, 16} {
+		d, err := Compute(bytes.NewReader(samples(testSamples)), 48000, 4, bits)
+		if err != nil {
+			t.Fatalf("Compute: %v", err)
+		}
+		formats := []struct {
+			ext   string
+			write func(*bytes.Buffer) error
+		}{
+			{"dat", func(b *bytes.Buffer) error { return d.WriteBinary(b) }},
+			{"json", func(b *bytes.Buffer) error { return d.WriteJSON(b) }},
+		}
+		for _, f := range formats {
+			buf := &bytes.Buffer{}
+			if err := f.write(buf); err != nil {
+				t.Fatalf("%d-bit %s: %v", bits, f.ext, err)
+			}
+			golden := filepath.Join("testdata", map[int]string{8: "8bit", 16: "16bit"}[bits]+"."+f.ext)
+			if *update {
+				if err := ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("%d-bit %s doesn't match %s:\n%q\nwant\n%q", bits, f.ext, golden, buf.Bytes(), want)
+			}
+		}
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	tests := []struct {
+		s    string
+		want color.NRGBA
+		ok   bool
+	}{
+		{"#ff8000", color.NRGBA{R: 0xff, G: 0x80, A: 0xff}, true},
+		{"#FF800080", color.NRGBA{R: 0xff, G: 0x80, A: 0x80}, true},
+		{"ff8000", color.NRGBA{}, false},
+		{"#ff80", color.NRGBA{}, false},
+		{"#gg8000", color.NRGBA{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseColor(tt.s)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseColor(%q) = %v, %v, want %v, ok %t", tt.s, got, err, tt.want, tt.ok)
+		}
+	}
+}
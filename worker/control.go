@@ -0,0 +1,66 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// Commands the manager can send to a worker
+const (
+	// CommandDrain tells a worker to stop taking tasks and
+	// exit once its running tasks have finished
+	CommandDrain = "DRAIN"
+	// CommandListen tells a worker to take tasks from a queue
+	// of jobs with requirements it meets
+	CommandListen = "LISTEN"
+)
+
+// Command is sent by the manager to a worker
+type Command struct {
+	Command string `json:"command"`
+	Queue   string `json:"queue,omitempty"` // For LISTEN
+}
+
+// ListenControl runs the commands the manager sends to this worker
+func (w *Worker) ListenControl() error {
+	ch, err := w.mq.GetChannel()
+	if err != nil {
+		return fmt.Errorf("failed to get channel: %w", err)
+	}
+	defer ch.Close()
+
+	msgChan, err := w.mq.ListenControl(ch, w.conf.WorkerID)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case d, ok := <-msgChan:
+			if !ok {
+				return nil
+			}
+			var cmd Command
+			err := json.Unmarshal(d.Body, &cmd)
+			if err != nil {
+				log.Printf("failed to unmarshal command: %+v", err)
+				continue
+			}
+			switch cmd.Command {
+			case CommandDrain:
+				log.Println("manager asked us to drain")
+				w.Drain()
+			case CommandListen:
+				err := w.listenQueue(cmd.Queue)
+				if err != nil {
+					log.Printf("failed to listen to \"%s\": %+v", cmd.Queue, err)
+				}
+			default:
+				log.Printf("ignoring unknown command \"%s\"", cmd.Command)
+			}
+		case <-w.done:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package worker
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/ystv/video-transcode/task"
+)
+
+// ServeMetrics exposes the worker's prometheus metrics on
+// the configured address
+func (w *Worker) ServeMetrics() error {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	err := task.RegisterMetrics(reg)
+	if err != nil {
+		return fmt.Errorf("failed to register task metrics: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+
+	log.Printf("serving metrics on %s", w.conf.MetricsAddr)
+	return http.ListenAndServe(w.conf.MetricsAddr, mux)
+}
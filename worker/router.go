@@ -3,19 +3,23 @@ package worker
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
+	"time"
 
+	"github.com/streadway/amqp"
 	"github.com/ystv/video-transcode/event"
 	"github.com/ystv/video-transcode/task"
 )
 
-// Listen will listen for all new Queue publications
-// and print them to the console.
+// Listen will listen for all new Queue publications and run
+// them, until the worker is drained
 func (w *Worker) Listen(wg *sync.WaitGroup) error {
 
 	defer wg.Done()
+	defer close(w.done)
 
 	ch, err := w.mq.GetChannel()
 	if err != nil {
@@ -23,50 +27,218 @@ func (w *Worker) Listen(wg *sync.WaitGroup) error {
 	}
 	defer ch.Close()
 
-	msgChan, err := event.ListenToQueues(ch, w.conf.TasksEnabled)
+	concurrency := w.conf.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	consumer, err := event.NewConsumer(ch, concurrency)
 	if err != nil {
-		return fmt.Errorf("failed to start listening channels")
+		return fmt.Errorf("failed to create consumer: %w", err)
+	}
+	for _, queue := range w.conf.TasksEnabled {
+		err = consumer.Listen(queue)
+		if err != nil {
+			return fmt.Errorf("failed to start listening channels: %w", err)
+		}
 	}
+	w.consumerMu.Lock()
+	w.consumer = consumer
+	w.consumerMu.Unlock()
 
-	// Going through all deliveries
-	for d := range msgChan {
-		switch d.RoutingKey {
-		case task.TypeVOD:
-			log.Println("video/vod job received!")
-			t := task.NewVOD(w.cdn, w.conf.APIEndpoint)
-			err := json.Unmarshal(d.Body, &t)
-			if err != nil {
-				err = fmt.Errorf("failed to unmarshal json: %w", err)
-				log.Printf("%+v", err)
-			}
-			err = w.task.Add(context.Background(), &t)
-			if err != nil {
-				err = fmt.Errorf("failed to add job: %w", err)
-				log.Printf("%+v", err)
-			}
+	go func() {
+		<-w.drain
+		err := consumer.Stop()
+		if err != nil {
+			log.Printf("failed to stop listening: %+v", err)
+		}
+	}()
 
-		case task.TypeSimpleVideo:
-			log.Println("video/simple job received!")
-			t := task.SimpleVideo{}
-			err := json.Unmarshal(d.Body, &t)
-			if err != nil {
-				err = fmt.Errorf("failed to unmarshal json: %w", err)
-				log.Printf("%+v", err)
-			}
-			err = w.task.Add(context.Background(), &t)
+	// Tasks are cancelled if they haven't finished
+	// by the drain deadline
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Going through all deliveries, prefetch stops us
+	// getting more than we can run at once
+	running := sync.WaitGroup{}
+	for d := range consumer.Deliveries() {
+		if w.draining() {
+			// Delivered before we stopped listening, so leave it for another worker
+			err := d.Nack(false, true)
 			if err != nil {
-				err = fmt.Errorf("failed to add job: %w", err)
-				log.Printf("%+v", err)
+				log.Printf("failed to requeue message: %+v", err)
 			}
-			log.Println("job added to task manager!")
-		}
-		// Acknowledge msg
-		err := d.Ack(false)
-		if err != nil {
-			err = fmt.Errorf("failed to acknowledge message: %w", err)
+			continue
 		}
-		log.Println("job well done lads")
+		running.Add(1)
+		go func(d amqp.Delivery) {
+			defer running.Done()
+			w.handle(ctx, d)
+		}(d)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(w.conf.DrainTimeout):
+		log.Println("drain deadline passed, cancelling running tasks")
+		cancel()
+		<-finished
 	}
 	log.Println("that'll do")
 	return nil
 }
+
+// handle runs a task from the queue, acknowledging it once it's done.
+// Tasks which were cancelled, or kept their work to resume, are requeued.
+func (w *Worker) handle(ctx context.Context, d amqp.Delivery) {
+	// Queues of jobs with requirements have them after the task type
+	taskType, _ := task.ParseQueueName(d.RoutingKey)
+	var t task.Task
+	switch taskType {
+	case task.TypeVOD:
+		log.Println("video/vod job received!")
+		vod := task.NewVOD(w.env)
+		t = &vod
+	case task.TypeSimpleVideo:
+		log.Println("video/simple job received!")
+		sv := task.NewSimpleVideo(w.env)
+		t = &sv
+	case task.TypeQuality:
+		log.Println("video/quality job received!")
+		q := task.NewQuality(w.env)
+		t = &q
+	case task.TypeClip:
+		log.Println("video/clip job received!")
+		c := task.NewClip(w.env)
+		t = &c
+	case task.TypeConcat:
+		log.Println("video/concat job received!")
+		c := task.NewConcat(w.env)
+		t = &c
+	case task.TypeSplit:
+		log.Println("video/split job received!")
+		sp := task.NewSplit(w.env)
+		t = &sp
+	case task.TypeSegment:
+		log.Println("video/segment job received!")
+		seg := task.NewSegment(w.env)
+		t = &seg
+	case task.TypeMux:
+		log.Println("video/mux job received!")
+		mux := task.NewMux(w.env)
+		t = &mux
+	case task.TypeSubtitleConvert:
+		log.Println("subtitle/convert job received!")
+		sc := task.NewSubtitleConvert(w.env)
+		t = &sc
+	case task.TypeSubtitleExtract:
+		log.Println("subtitle/extract job received!")
+		se := task.NewSubtitleExtract(w.env)
+		t = &se
+	case task.TypeSubtitleMux:
+		log.Println("subtitle/mux job received!")
+		sm := task.NewSubtitleMux(w.env)
+		t = &sm
+	case task.TypeAudioExtract:
+		log.Println("audio/extract job received!")
+		ae := task.NewAudioExtract(w.env)
+		t = &ae
+	case task.TypeWaveform:
+		log.Println("audio/waveform job received!")
+		wf := task.NewWaveform(w.env)
+		t = &wf
+	default:
+		log.Printf("unknown task type \"%s\"", taskType)
+	}
+
+	requeue := false
+	if t != nil {
+		requeue = w.run(ctx, t, d.Body)
+	}
+
+	if ctx.Err() != nil || requeue {
+		err := d.Nack(false, true)
+		if err != nil {
+			log.Printf("failed to requeue message: %+v", err)
+		}
+		log.Println("job requeued")
+		return
+	}
+	// Acknowledge msg
+	err := d.Ack(false)
+	if err != nil {
+		err = fmt.Errorf("failed to acknowledge message: %w", err)
+		log.Printf("%+v", err)
+	}
+	log.Println("job well done lads")
+}
+
+// run decodes a job into its task and runs it, returning whether the
+// job should be requeued for the task to resume. Jobs which can't be
+// decoded are reported as failed so they don't go missing.
+func (w *Worker) run(ctx context.Context, t task.Task, body []byte) bool {
+	err := json.Unmarshal(body, t)
+	if err != nil {
+		err = fmt.Errorf("failed to unmarshal json: %w", err)
+		log.Printf("%+v", err)
+		// Try for just the ID so the manager can be told
+		job := struct{ TaskID string }{}
+		if json.Unmarshal(body, &job) == nil && job.TaskID != "" {
+			w.task.Fail(job.TaskID, task.NewError(task.ErrorInvalidArgs, false, err))
+		}
+		return false
+	}
+	err = w.task.Add(ctx, t)
+	if errors.Is(err, task.ErrRequeue) {
+		log.Printf("job %s stopped, requeueing it to resume: %+v", t.GetID(), err)
+		return true
+	}
+	if err != nil {
+		// Its failure has been recorded in its final status
+		log.Printf("job %s failed: %+v", t.GetID(), err)
+		return false
+	}
+	log.Printf("job %s finished", t.GetID())
+	return false
+}
+
+// listenQueue starts taking jobs from a queue of jobs with
+// requirements, if this worker can run them
+func (w *Worker) listenQueue(queue string) error {
+	taskType, requires := task.ParseQueueName(queue)
+	enabled := false
+	for _, t := range w.conf.TasksEnabled {
+		if t == taskType {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return fmt.Errorf("task type \"%s\" isn't enabled", taskType)
+	}
+	if !w.conf.Capabilities.SatisfiesAll(requires) {
+		return fmt.Errorf("missing capabilities for \"%s\"", queue)
+	}
+
+	w.consumerMu.Lock()
+	consumer := w.consumer
+	w.consumerMu.Unlock()
+	if consumer == nil {
+		return fmt.Errorf("not listening yet")
+	}
+	return consumer.Listen(queue)
+}
+
+// queues returns the queues the worker is taking jobs from
+func (w *Worker) queues() []string {
+	w.consumerMu.Lock()
+	defer w.consumerMu.Unlock()
+	if w.consumer == nil {
+		return []string{}
+	}
+	return w.consumer.Queues()
+}
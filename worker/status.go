@@ -11,12 +11,33 @@ import (
 	"github.com/ystv/video-transcode/task"
 )
 
+// States a worker reports itself in
+const (
+	StateRunning  = "RUNNING"
+	StateDraining = "DRAINING"
+	StateEnd      = "END" // The worker has stopped and won't send any more
+)
+
+// Status is the snapshot a worker publishes to the encode-status
+// exchange, it doubles as the worker's heartbeat
 type Status struct {
-	WorkerID     string
-	TasksEnabled []string
-	CurrentTasks []task.Status
+	WorkerID      string        `json:"workerID"`
+	State         string        `json:"state"`
+	TasksEnabled  []string      `json:"tasksEnabled"`
+	Queues        []string      `json:"queues"` // Queues tasks are being taken from
+	CurrentTasks  []task.Status `json:"currentTasks"`
+	FinishedTasks []task.Status `json:"finishedTasks,omitempty"` // Tasks which ended since the last snapshot
+	// Sent every capabilitiesEvery snapshots since they don't change
+	Capabilities *task.Capabilities `json:"capabilities,omitempty"`
 }
 
+// capabilitiesEvery is how many snapshots are sent between ones
+// including the worker's capabilities
+const capabilitiesEvery = 15
+
+// PubStatus sends the worker's status every couple of seconds,
+// finishing with an END status once it has stopped taking tasks.
+// Failed sends are logged and tried again on the next tick.
 func (w *Worker) PubStatus(wg *sync.WaitGroup) error {
 	status := Status{
 		WorkerID:     w.conf.WorkerID,
@@ -25,24 +46,46 @@ func (w *Worker) PubStatus(wg *sync.WaitGroup) error {
 
 	defer wg.Done()
 
-	var err error
-	var reqJSON []byte
-	t := time.Tick(2 * time.Second)
-	for {
+	t := time.NewTicker(2 * time.Second)
+	defer t.Stop()
+	for n := 0; ; n++ {
+		status.Capabilities = nil
+		if n%capabilitiesEvery == 0 {
+			status.Capabilities = &w.conf.Capabilities
+		}
 		select {
-		case <-t:
-			for _, task := range w.task.GetTasks(context.Background()) {
-				status.CurrentTasks = append(status.CurrentTasks, task.GetStatus())
-				log.Printf("%+v", err)
-			}
-			reqJSON, err = json.Marshal(status)
-			if err != nil {
-				return fmt.Errorf("failed to marshal: %w", err)
+		case <-t.C:
+			status.State = StateRunning
+			if w.draining() {
+				status.State = StateDraining
 			}
-			err = w.mq.SendStatus("encode-status", reqJSON)
+			err := w.sendStatus(&status)
 			if err != nil {
-				return fmt.Errorf("SendStatus failed: %w", err)
+				log.Printf("failed to publish status: %+v", err)
 			}
+		case <-w.done:
+			status.State = StateEnd
+			return w.sendStatus(&status)
 		}
 	}
 }
+
+func (w *Worker) sendStatus(status *Status) error {
+	status.Queues = w.queues()
+	status.CurrentTasks = []task.Status{}
+	for _, task := range w.task.GetTasks(context.Background()) {
+		status.CurrentTasks = append(status.CurrentTasks, task.GetStatus())
+	}
+	// Ones which failed to send last time are kept until they're sent
+	status.FinishedTasks = append(status.FinishedTasks, w.task.Finished()...)
+	reqJSON, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("failed to marshal: %w", err)
+	}
+	err = w.mq.SendStatus("encode-status", reqJSON)
+	if err != nil {
+		return fmt.Errorf("SendStatus failed: %w", err)
+	}
+	status.FinishedTasks = nil
+	return nil
+}
@@ -5,8 +5,8 @@ import (
 	"log"
 	"os"
 	"sync"
+	"time"
 
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/ystv/video-transcode/event"
 	"github.com/ystv/video-transcode/task"
 )
@@ -14,8 +14,11 @@ import (
 // Config stores the settings
 type Config struct {
 	WorkerID     string
-	APIEndpoint  string
 	TasksEnabled []string
+	Concurrency  int           // Tasks run at once
+	DrainTimeout time.Duration // How long running tasks get to finish when draining
+	MetricsAddr  string        // Optional address to serve prometheus metrics on
+	Capabilities task.Capabilities
 }
 
 // Worker is a control object  which listens on both
@@ -25,11 +28,44 @@ type Worker struct {
 	// dependencies
 	task *task.Tasker
 	mq   *event.Eventer
-	cdn  *s3.S3
+	env  *task.Env
+
+	drain     chan struct{} // Closed when the worker starts draining
+	drainOnce sync.Once
+	done      chan struct{} // Closed once the worker has stopped taking tasks
+
+	consumerMu sync.Mutex
+	consumer   *event.Consumer
+}
+
+func New(conf Config, mq *event.Eventer, tasker *task.Tasker, env *task.Env) *Worker {
+	return &Worker{
+		conf:  conf,
+		mq:    mq,
+		task:  tasker,
+		env:   env,
+		drain: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// Drain stops the worker taking new tasks, Run returns once the
+// running tasks have finished or been cancelled and requeued
+func (w *Worker) Drain() {
+	w.drainOnce.Do(func() {
+		log.Printf("draining, waiting up to %s for tasks to finish", w.conf.DrainTimeout)
+		close(w.drain)
+	})
 }
 
-func New(conf Config, mq *event.Eventer, tasker *task.Tasker, cdn *s3.S3) *Worker {
-	return &Worker{conf: conf, mq: mq, task: tasker, cdn: cdn}
+// draining returns whether the worker has started draining
+func (w *Worker) draining() bool {
+	select {
+	case <-w.drain:
+		return true
+	default:
+		return false
+	}
 }
 
 func (w *Worker) Run() error {
@@ -38,10 +74,12 @@ func (w *Worker) Run() error {
 
 	wg.Add(1)
 	// Listen for new tasks on the message queue
-	go w.Listen(&wg)
-	// if err != nil {
-	// 	log.Printf("failed to listen: %+v", err)
-	// }
+	go func() {
+		err := w.Listen(&wg)
+		if err != nil {
+			log.Printf("failed to listen: %+v", err)
+		}
+	}()
 
 	wg.Add(1)
 	// Send back status to the message queue
@@ -50,9 +88,27 @@ func (w *Worker) Run() error {
 	// 	log.Printf("failed to publish status: %+v", err)
 	// }
 
+	// Listen for commands from the manager
+	go func() {
+		err := w.ListenControl()
+		if err != nil {
+			log.Printf("failed to listen for commands: %+v", err)
+		}
+	}()
+
+	if w.conf.MetricsAddr != "" {
+		go func() {
+			err := w.ServeMetrics()
+			if err != nil {
+				log.Printf("failed to serve metrics: %+v", err)
+			}
+		}()
+	}
+
 	log.Printf("VT ready, worker ID: %s, PID: %d", w.conf.WorkerID, os.Getpid())
 
 	wg.Wait()
+	log.Println("worker stopped")
 
 	return nil
 }